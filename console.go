@@ -14,6 +14,7 @@ import (
 
 	"transparent/config"
 	"transparent/server"
+	"transparent/tProxy"
 
 	"go.uber.org/zap"
 
@@ -107,7 +108,13 @@ func main() {
 	)
 
 	<-signalChan // 当接收到上述任意信号时继续执行
-	time.AfterFunc(5*time.Second, func() {
+
+	// 优雅关闭等待连接结束后仍未退出时强制退出
+	drain := config.GetConf().DrainTimeout
+	if drain == 0 {
+		drain = tProxy.DefaultDrainTimeout
+	}
+	time.AfterFunc(time.Duration(max(drain, 0)+5)*time.Second, func() {
 		log.Info("程序强制关闭")
 		os.Exit(1)
 	})
@@ -19,6 +19,7 @@ package channel
 
 import (
 	"context"
+	"sync/atomic"
 
 	"transparent/gvisor.dev/gvisor/pkg/sync"
 	"transparent/gvisor.dev/gvisor/pkg/tcpip"
@@ -137,7 +138,7 @@ var (
 // Endpoint is link layer endpoint that stores outbound packets in a channel
 // and allows injection of inbound packets.
 type Endpoint struct {
-	mtu                uint32
+	mtu                atomic.Uint32
 	linkAddr           tcpip.LinkAddress
 	LinkEPCapabilities stack.LinkEndpointCapabilities
 	SupportedGSOKind   stack.SupportedGSO
@@ -152,13 +153,14 @@ type Endpoint struct {
 
 // New creates a new channel endpoint.
 func New(size int, mtu uint32, linkAddr tcpip.LinkAddress) *Endpoint {
-	return &Endpoint{
+	e := &Endpoint{
 		q: &queue{
 			c: make(chan stack.PacketBufferPtr, size),
 		},
-		mtu:      mtu,
 		linkAddr: linkAddr,
 	}
+	e.mtu.Store(mtu)
+	return e
 }
 
 // Close closes e. Further packet injections will return an error, and all pending
@@ -221,9 +223,15 @@ func (e *Endpoint) IsAttached() bool {
 }
 
 // MTU implements stack.LinkEndpoint.MTU. It returns the value initialized
-// during construction.
+// during construction or the last value passed to SetMTU.
 func (e *Endpoint) MTU() uint32 {
-	return e.mtu
+	return e.mtu.Load()
+}
+
+// SetMTU changes the MTU reported to the stack. Existing connections keep
+// the MSS negotiated at handshake; new connections use the new value.
+func (e *Endpoint) SetMTU(mtu uint32) {
+	e.mtu.Store(mtu)
 }
 
 // Capabilities implements stack.LinkEndpoint.Capabilities.
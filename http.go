@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -9,6 +10,9 @@ import (
 	"time"
 
 	"transparent/log"
+	"transparent/server"
+	"transparent/utils/bandwidth"
+	"transparent/utils/rules"
 )
 
 func gohttp() {
@@ -17,7 +21,8 @@ func gohttp() {
 	runtime.MemProfileRate = 128 * 1024
 	go func() {
 		defer log.Recover("http")
-		ln, err := net.Listen("tcp", ":0")
+		// 控制接口可以修改限速、替换路由数据库，只监听本机
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
 		if err != nil {
 			panic(err)
 		}
@@ -26,6 +31,10 @@ func gohttp() {
 				log.Debug(fmt.Sprint("端口:", ln.Addr().(*net.TCPAddr).Port))
 				log.Debug(fmt.Sprint("metrics: ", fmt.Sprintf("http://127.0.0.1:%d/metrics", ln.Addr().(*net.TCPAddr).Port)))
 				log.Debug(fmt.Sprint("pprof: ", fmt.Sprintf("http://127.0.0.1:%d/debug/pprof", ln.Addr().(*net.TCPAddr).Port)))
+				log.Debug(fmt.Sprint("bandwidth: ", fmt.Sprintf("http://127.0.0.1:%d/bandwidth", ln.Addr().(*net.TCPAddr).Port)))
+				log.Debug(fmt.Sprint("status: ", fmt.Sprintf("http://127.0.0.1:%d/status", ln.Addr().(*net.TCPAddr).Port)))
+				log.Debug(fmt.Sprint("geo: ", fmt.Sprintf("http://127.0.0.1:%d/geo", ln.Addr().(*net.TCPAddr).Port)))
+				log.Debug(fmt.Sprint("upstreams: ", fmt.Sprintf("http://127.0.0.1:%d/upstreams", ln.Addr().(*net.TCPAddr).Port)))
 				<-time.After(30 * 60 * time.Second)
 			}
 		}()
@@ -56,9 +65,40 @@ func gohttp() {
 			result += fmt.Sprint("memStats.GCSys:", memStats.GCSys, " 为垃圾回收器从操作系统获得的内存字节数。\n")                 /// 为垃圾回收器从操作系统获得的内存字节数。
 			result += fmt.Sprint("memStats.OtherSys:", memStats.OtherSys, " 为其他内存管理用途从操作系统获得的内存字节数。\n")        ///  为其他内存管理用途从操作系统获得的内存字节数。
 
+			// 上游熔断状态
+			for _, u := range server.Status().Upstreams {
+				result += fmt.Sprintf("upstream.%s.breaker:%s trips:%d rejected:%d failures:%d 上游熔断状态、累计熔断次数、熔断期间拒绝的连接数和当前连续失败次数\n",
+					u.Name, u.Breaker.State, u.Breaker.Trips, u.Breaker.Rejected, u.Breaker.Failures)
+			}
+
 			fmt.Fprintf(w, result)
 		})
 
+		// 控制接口
+		http.Handle("/bandwidth", bandwidth.Handler(bandwidth.Default()))
+		http.Handle("/geo", rules.Handler(rules.DefaultGeo()))
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(server.Status())
+		})
+		// GET 返回各上游的健康检查统计，POST ?name=上游名称 立即测试该上游(为空时测试当前上游)
+		http.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.Method {
+			case http.MethodGet:
+				json.NewEncoder(w).Encode(server.Status().Upstreams)
+			case http.MethodPost:
+				res, err := server.TestUpstream(r.URL.Query().Get("name"))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				json.NewEncoder(w).Encode(res)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		})
+
 		panic(http.Serve(ln, nil))
 	}()
 }
@@ -7,12 +7,15 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"slices"
 	"time"
+
+	"transparent/proto/dns"
 )
 
 // 全局加密密钥（实际使用中应通过安全方式分发，长度必须为16/24/32字节）
@@ -115,20 +118,32 @@ func Base64Decode(encoded string) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(encoded)
 }
 
-func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error) {
+func GetConn(ctx context.Context, dialer *dns.Dialer, s string, targetAddr string) (net.Conn, error) {
+	conn, err := Dial(ctx, dialer, s)
+	if err != nil {
+		return nil, err
+	}
+	return Open(ctx, conn, targetAddr)
+}
+
+// Dial 连接代理服务器，还未发送目标地址，可预先建立后通过 Open 使用
+func Dial(ctx context.Context, dialer *dns.Dialer, s string) (net.Conn, error) {
 	// 1. 解析代理URL获取认证信息和服务器地址
 	_, server, _, _, err := ParseURL(s)
 	if err != nil {
 		return nil, fmt.Errorf("解析代理URL失败: %w", err)
 	}
 
-	// 2. 创建TCP拨号器并连接到代理服务器
-	var Dialer net.Dialer
-	conn, err := Dialer.DialContext(ctx, "tcp", server)
+	// 2. 通过拨号器连接到代理服务器
+	conn, err := dialer.DialContext(ctx, "tcp", server)
 	if err != nil {
 		return nil, fmt.Errorf("连接代理服务器失败: %w", err)
 	}
+	return conn, nil
+}
 
+// Open 在已连接的代理服务器连接上发送目标地址并等待回复，失败时关闭连接
+func Open(ctx context.Context, conn net.Conn, targetAddr string) (net.Conn, error) {
 	done := make(chan struct{})
 	defer func() {
 		for range done {
@@ -145,6 +160,23 @@ func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error)
 		}
 	}()
 
+	if err := handshake(conn, targetAddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &Conn{
+		conn: conn,
+	}
+
+	return c, nil
+}
+
+// ErrRefused 服务端回复了错误，通常是服务端连接目标失败，代理服务器本身可用
+var ErrRefused = errors.New("代理服务器拒绝")
+
+// handshake 发送Base64编码的目标地址并等待服务端回复，服务端连接目标成功时回复ok，否则回复错误原因
+func handshake(conn net.Conn, targetAddr string) error {
 	buf := make([]byte, 4)
 
 	targetAddr = Base64Encode([]byte(targetAddr))
@@ -155,18 +187,15 @@ func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error)
 	buf = append(buf, []byte(targetAddr)...)
 
 	// 发送消息到服务端
-	_, err = conn.Write(buf)
-	if err != nil {
-		conn.Close()
-		return nil, err
+	if _, err := conn.Write(buf); err != nil {
+		return err
 	}
 
 	buf = make([]byte, 4)
 
 	if _, err := io.ReadFull(conn, buf); err != nil {
 		log.Printf("读取响应失败: %v", err)
-		conn.Close()
-		return nil, err
+		return err
 	}
 
 	parsedNum := binary.BigEndian.Uint32(buf)
@@ -174,20 +203,13 @@ func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error)
 	buf = make([]byte, parsedNum)
 
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		conn.Close()
-		return nil, err
+		return err
 	}
 	response := string(buf)
 	if response != "ok" {
-		conn.Close()
-		return nil, fmt.Errorf(response)
+		return fmt.Errorf("%w: %s", ErrRefused, response)
 	}
-
-	c := &Conn{
-		conn: conn,
-	}
-
-	return c, nil
+	return nil
 }
 
 type Conn struct {
@@ -199,7 +221,7 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 	if len(c.data) > 0 {
 		if len(c.data) > len(b) {
 			n = copy(b, c.data[:len(b)])
-			c.data = c.data[:n]
+			c.data = c.data[n:]
 			return
 		} else {
 			n = copy(b, c.data)
@@ -217,7 +239,7 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 	if len(c.data) > 0 {
 		if len(c.data) > len(b) {
 			n = copy(b, c.data[:len(b)])
-			c.data = c.data[:n]
+			c.data = c.data[n:]
 			return
 		} else {
 			n = copy(b, c.data)
@@ -244,6 +266,14 @@ func (c *Conn) Close() error {
 	return c.conn.Close()
 }
 
+// CloseWrite 关闭底层连接的写方向，对端读完已发送的数据后收到EOF
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
 func (c *Conn) LocalAddr() net.Addr {
 	return c.conn.LocalAddr()
 }
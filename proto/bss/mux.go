@@ -0,0 +1,43 @@
+package bss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"transparent/proto/dns"
+	"transparent/proto/mux"
+)
+
+// DialMux 连接代理服务器并协商多路复用，返回承载多路复用会话的连接
+// 服务端不支持时返回 mux.ErrUnsupported
+func DialMux(ctx context.Context, dialer *dns.Dialer, s string) (net.Conn, error) {
+	conn, err := GetConn(ctx, dialer, s, mux.Target)
+	if errors.Is(err, ErrRefused) {
+		return nil, fmt.Errorf("%w: %v", mux.ErrUnsupported, err)
+	}
+	return conn, err
+}
+
+// OpenStream 在多路复用连接池中打开到目标地址的流，每个流按普通连接的协议握手
+// 会话所在的连接已加密，流中的数据不再重复加密
+func OpenStream(ctx context.Context, pool *mux.Pool, targetAddr string) (net.Conn, error) {
+	st, err := pool.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 通过ctx控制握手超时
+	stop := context.AfterFunc(ctx, func() { st.SetDeadline(time.Now()) })
+	err = handshake(st, targetAddr)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
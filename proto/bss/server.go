@@ -0,0 +1,53 @@
+package bss
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"transparent/proto/mux"
+	"transparent/proto/tunnel"
+)
+
+// Server bss服务端，每个连接先读取Base64编码的目标地址，连接目标成功后回复ok，之后的数据加密转发
+// 目标地址为 mux.Target 时在加密的连接上运行多路复用会话，每个流按同样的协议握手，流中的数据不再重复加密
+type Server struct {
+	// 连接目标使用的拨号函数，为nil时使用net.Dialer
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// 多路复用会话配置
+	Mux mux.Config
+
+	// 拒绝多路复用协商，客户端改用独立连接
+	DisableMux bool
+}
+
+// Serve 接受连接直到监听关闭
+func (s *Server) Serve(ln net.Listener) error {
+	return s.tunnel().Serve(ln)
+}
+
+// ServeConn 处理一个客户端连接
+func (s *Server) ServeConn(conn net.Conn) {
+	s.tunnel().ServeConn(conn)
+}
+
+// tunnel 按bss协议配置的服务端
+func (s *Server) tunnel() *tunnel.Server {
+	return &tunnel.Server{
+		Dial:       s.Dial,
+		Mux:        s.Mux,
+		DisableMux: s.DisableMux,
+		Decode:     decodeTarget,
+		Wrap:       func(conn net.Conn) net.Conn { return &Conn{conn: conn} },
+	}
+}
+
+// decodeTarget 解码Base64编码的目标地址
+func decodeTarget(b []byte) (string, error) {
+	target, err := Base64Decode(string(b))
+	if err != nil {
+		return "", fmt.Errorf("目标地址编码错误: %w", err)
+	}
+	return string(target), nil
+}
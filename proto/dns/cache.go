@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// cacheEntry 缓存项
+type cacheEntry struct {
+	ips        []net.IP
+	expiration time.Time
+}
+
+// cacheResolver 带TTL缓存的解析器
+type cacheResolver struct {
+	r      Resolver
+	minTTL time.Duration
+	maxTTL time.Duration
+	mu     sync.Mutex
+	mm     map[string]*cacheEntry
+}
+
+// 缓存项数量上限，超过后在写入时清理过期项
+const maxCacheEntries = 4096
+
+func newCacheResolver(r Resolver, minTTL, maxTTL time.Duration) *cacheResolver {
+	return &cacheResolver{
+		r:      r,
+		minTTL: minTTL,
+		maxTTL: maxTTL,
+		mm:     map[string]*cacheEntry{},
+	}
+}
+
+func (c *cacheResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	key := network + "|" + host
+
+	// 1. 查缓存
+	c.mu.Lock()
+	if e, ok := c.mm[key]; ok {
+		if time.Now().Before(e.expiration) {
+			c.mu.Unlock()
+			return e.ips, nil
+		}
+		delete(c.mm, key)
+	}
+	c.mu.Unlock()
+
+	// 2. 查询上游
+	var (
+		ips []net.IP
+		ttl time.Duration
+		err error
+	)
+	if tr, ok := c.r.(ttlResolver); ok {
+		ips, ttl, err = tr.lookupIPTTL(ctx, network, host)
+	} else {
+		ips, err = c.r.LookupIP(ctx, network, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("解析结果为空: " + host)
+	}
+
+	// 3. 写缓存，TTL限制在[minTTL, maxTTL]之间
+	ttl = min(max(ttl, c.minTTL), c.maxTTL)
+
+	c.mu.Lock()
+	if len(c.mm) >= maxCacheEntries {
+		now := time.Now()
+		for k, v := range c.mm {
+			if now.After(v.expiration) {
+				delete(c.mm, k)
+			}
+		}
+	}
+	if len(c.mm) < maxCacheEntries {
+		c.mm[key] = &cacheEntry{
+			ips:        ips,
+			expiration: time.Now().Add(ttl),
+		}
+	}
+	c.mu.Unlock()
+
+	return ips, nil
+}
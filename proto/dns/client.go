@@ -0,0 +1,226 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// exchanger 发送一条DNS报文并返回应答报文
+type exchanger interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// ttlResolver 可返回记录TTL的解析器，供缓存使用
+type ttlResolver interface {
+	lookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error)
+}
+
+// client 基于exchanger的解析器，负责构造查询和解析应答
+type client struct {
+	ex   exchanger
+	name string
+}
+
+func (c *client) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := c.lookupIPTTL(ctx, network, host)
+	return ips, err
+}
+
+func (c *client) lookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+
+	types, err := queryTypes(network)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 1. A 与 AAAA 并行查询
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	results := make([]result, len(types))
+	wg := sync.WaitGroup{}
+	for i, t := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, ttl, err := c.query(ctx, host, t)
+			results[i] = result{ips: ips, ttl: ttl, err: err}
+		}()
+	}
+	wg.Wait()
+
+	// 2. 合并结果，TTL取最小值
+	var (
+		ips    []net.IP
+		ttl    time.Duration
+		errs   []error
+		hasTTL bool
+	)
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		ips = append(ips, r.ips...)
+		if len(r.ips) > 0 && (!hasTTL || r.ttl < ttl) {
+			ttl = r.ttl
+			hasTTL = true
+		}
+	}
+
+	if len(ips) == 0 {
+		if len(errs) > 0 {
+			return nil, 0, fmt.Errorf("%s 解析 %s 失败: %w", c.name, host, errors.Join(errs...))
+		}
+		return nil, 0, fmt.Errorf("%s 解析 %s 无结果", c.name, host)
+	}
+
+	return ips, ttl, nil
+}
+
+// query 执行单个类型的查询
+func (c *client) query(ctx context.Context, host string, t dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	q, id, err := buildQuery(host, t)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := c.ex.exchange(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return parseAnswer(resp, id, t)
+}
+
+// queryTypes 根据网络类型返回需要查询的记录类型
+func queryTypes(network string) ([]dnsmessage.Type, error) {
+	switch network {
+	case "ip", "tcp", "udp", "":
+		return []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}, nil
+	case "ip4", "tcp4", "udp4":
+		return []dnsmessage.Type{dnsmessage.TypeA}, nil
+	case "ip6", "tcp6", "udp6":
+		return []dnsmessage.Type{dnsmessage.TypeAAAA}, nil
+	default:
+		return nil, fmt.Errorf("不支持的网络类型: %s", network)
+	}
+}
+
+// buildQuery 构造DNS查询报文
+func buildQuery(host string, t dnsmessage.Type) ([]byte, uint16, error) {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("域名格式错误 host:%s error:%w", host, err)
+	}
+
+	id := newID()
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:               id,
+		RecursionDesired: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  name,
+		Type:  t,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return msg, id, nil
+}
+
+// parseAnswer 解析应答报文中的A/AAAA记录
+func parseAnswer(resp []byte, id uint16, t dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("解析DNS应答失败: %w", err)
+	}
+
+	if h.ID != id {
+		return nil, 0, fmt.Errorf("DNS应答ID不匹配")
+	}
+
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		// 域名不存在，返回空结果
+		return nil, 0, nil
+	default:
+		return nil, 0, fmt.Errorf("DNS应答错误: %s", h.RCode)
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		ips    []net.IP
+		ttl    uint32
+		hasTTL bool
+	)
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if ah.Type != t {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		switch t {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		}
+
+		if !hasTTL || ah.TTL < ttl {
+			ttl = ah.TTL
+			hasTTL = true
+		}
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
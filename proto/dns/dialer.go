@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Dialer 先通过Resolver解析域名再建立连接的拨号器
+// 同时实现 proxy.Dialer 和 proxy.ContextDialer 接口
+type Dialer struct {
+	// 底层拨号器，可设置超时、KeepAlive、本地地址等
+	Base net.Dialer
+
+	// 域名解析器，为nil时使用全局解析器
+	Resolver Resolver
+
+	// 连接已解析出的IP地址，为nil时使用Base
+	// 可用于每次连接前选择本地端口、记录正在连接的地址等
+	DialIP func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewDialer 创建使用指定解析器的拨号器，r为nil时使用全局解析器
+func NewDialer(r Resolver) *Dialer {
+	return &Dialer{Resolver: r}
+}
+
+func (d *Dialer) resolver() Resolver {
+	if d.Resolver != nil {
+		return d.Resolver
+	}
+	return Default()
+}
+
+// Dial 建立连接
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext 解析addr中的域名并依次尝试连接解析出的IP
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. IP地址直接连接
+	if ip := net.ParseIP(host); ip != nil {
+		return d.dialIP(ctx, network, addr)
+	}
+
+	// 2. 解析域名
+	ips, err := d.resolver().LookupIP(ctx, lookupNetwork(network), host)
+	if err != nil {
+		return nil, fmt.Errorf("解析域名失败 host:%s error:%w", host, err)
+	}
+
+	// 3. 依次尝试连接
+	var errs []error
+	for _, ip := range ips {
+		conn, err := d.dialIP(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("解析域名无可用地址 host:%s", host)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialIP 连接IP地址
+func (d *Dialer) dialIP(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.DialIP != nil {
+		return d.DialIP(ctx, network, addr)
+	}
+	return d.Base.DialContext(ctx, network, addr)
+}
+
+// lookupNetwork 将拨号网络类型转换为解析网络类型
+func lookupNetwork(network string) string {
+	switch network {
+	case "tcp4", "udp4":
+		return "ip4"
+	case "tcp6", "udp6":
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
@@ -0,0 +1,152 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newDoHServer 启动一个本地DoH服务，对所有A查询返回ip
+func newDoHServer(t *testing.T, ip [4]byte, ttl uint32, count *atomic.Int32) *httptest.Server {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+
+		body, _ := io.ReadAll(r.Body)
+		var req dnsmessage.Message
+		if err := req.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: req.ID, Response: true},
+			Questions: req.Questions,
+		}
+		q := req.Questions[0]
+		if q.Type == dnsmessage.TypeA {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: ip},
+			})
+		}
+
+		b, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(b)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestDoH(srv *httptest.Server) *client {
+	return &client{
+		ex:   &doh{url: srv.URL + "/dns-query", client: srv.Client()},
+		name: srv.URL,
+	}
+}
+
+func TestDoHLookup(t *testing.T) {
+	var count atomic.Int32
+	srv := newDoHServer(t, [4]byte{10, 1, 2, 3}, 300, &count)
+
+	ips, ttl, err := newTestDoH(srv).lookupIPTTL(context.Background(), "ip4", "proxy.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 1, 2, 3)) {
+		t.Fatalf("unexpected ips: %v", ips)
+	}
+	if ttl != 300*time.Second {
+		t.Fatalf("unexpected ttl: %v", ttl)
+	}
+}
+
+func TestCacheResolver(t *testing.T) {
+	var count atomic.Int32
+	srv := newDoHServer(t, [4]byte{10, 1, 2, 3}, 1, &count)
+
+	r := newCacheResolver(newTestDoH(srv), 50*time.Millisecond, time.Hour)
+	for i := 0; i < 3; i++ {
+		if _, err := r.LookupIP(context.Background(), "ip4", "proxy.example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count.Load(); n != 1 {
+		t.Fatalf("expected 1 upstream query, got %d", n)
+	}
+
+	// maxTTL截断为10ms，过期后应重新查询
+	r = newCacheResolver(newTestDoH(srv), time.Millisecond, 10*time.Millisecond)
+	r.LookupIP(context.Background(), "ip4", "proxy.example.com")
+	time.Sleep(20 * time.Millisecond)
+	r.LookupIP(context.Background(), "ip4", "proxy.example.com")
+	if n := count.Load(); n != 3 {
+		t.Fatalf("expected 3 upstream queries, got %d", n)
+	}
+}
+
+type failResolver struct{}
+
+func (failResolver) LookupIP(context.Context, string, string) ([]net.IP, error) {
+	return nil, errors.New("fail")
+}
+
+func TestRaceResolver(t *testing.T) {
+	var count atomic.Int32
+	srv := newDoHServer(t, [4]byte{10, 1, 2, 3}, 60, &count)
+
+	r := &raceResolver{resolvers: []Resolver{failResolver{}, newTestDoH(srv)}}
+	ips, err := r.LookupIP(context.Background(), "ip4", "proxy.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 {
+		t.Fatalf("unexpected ips: %v", ips)
+	}
+
+	r = &raceResolver{resolvers: []Resolver{failResolver{}, failResolver{}}}
+	if _, err := r.LookupIP(context.Background(), "ip4", "proxy.example.com"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+type staticResolver []net.IP
+
+func (r staticResolver) LookupIP(context.Context, string, string) ([]net.IP, error) {
+	return r, nil
+}
+
+func TestDialerDialIP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	var dialed []string
+	d := NewDialer(staticResolver{net.IPv4(127, 0, 0, 1)})
+	d.DialIP = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return d.Base.DialContext(ctx, network, addr)
+	}
+
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("proxy.example.com", fmt.Sprint(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if want := net.JoinHostPort("127.0.0.1", fmt.Sprint(port)); len(dialed) != 1 || dialed[0] != want {
+		t.Fatalf("unexpected dialed addrs: %v, want %s", dialed, want)
+	}
+}
@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// raceResolver 并行查询多个解析器，返回最先成功的结果
+type raceResolver struct {
+	resolvers []Resolver
+}
+
+func (r *raceResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := r.lookupIPTTL(ctx, network, host)
+	return ips, err
+}
+
+func (r *raceResolver) lookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // 取得结果后取消其余查询
+
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+
+	resultChan := make(chan result, len(r.resolvers))
+	for _, res := range r.resolvers {
+		go func() {
+			var rt result
+			if tr, ok := res.(ttlResolver); ok {
+				rt.ips, rt.ttl, rt.err = tr.lookupIPTTL(ctx, network, host)
+			} else {
+				rt.ips, rt.err = res.LookupIP(ctx, network, host)
+			}
+			resultChan <- rt
+		}()
+	}
+
+	errs := make([]error, 0, len(r.resolvers))
+	for range r.resolvers {
+		rt := <-resultChan
+		if rt.err == nil && len(rt.ips) > 0 {
+			return rt.ips, rt.ttl, nil
+		}
+		if rt.err != nil {
+			errs = append(errs, rt.err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, 0, errors.New("解析结果为空: " + host)
+	}
+	return nil, 0, errors.Join(errs...)
+}
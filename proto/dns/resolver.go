@@ -0,0 +1,164 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Resolver 域名解析器
+// network: "ip"、"ip4" 或 "ip6"，含义与 net.Resolver.LookupIP 相同
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// Config 解析器配置
+type Config struct {
+	// 上游DNS服务器列表，多个服务器并行竞速，取最先成功的结果
+	Servers []ServerConfig
+
+	// 是否关闭缓存
+	DisableCache bool
+
+	// 缓存TTL下限/上限(秒)，为0时分别使用 defaultMinTTL / defaultMaxTTL
+	MinTTL int
+	MaxTTL int
+
+	// 单次查询超时(秒)，为0时使用 defaultTimeout
+	Timeout int
+}
+
+// ServerConfig 单个上游DNS服务器配置
+type ServerConfig struct {
+	// 服务器地址，支持以下格式:
+	//   https://dns.google/dns-query  DNS-over-HTTPS
+	//   tls://dns.google:853          DNS-over-TLS
+	//   udp://8.8.8.8:53              明文UDP
+	//   system                        系统解析器
+	Url string
+
+	// 引导IP，用于连接DoH/DoT服务器自身而无需再次解析其域名
+	Bootstrap []string
+}
+
+const (
+	defaultMinTTL  = 60
+	defaultMaxTTL  = 3600
+	defaultTimeout = 5
+)
+
+var defaultResolver atomic.Pointer[Resolver]
+
+// Default 返回全局解析器，未设置时使用系统解析器
+func Default() Resolver {
+	if r := defaultResolver.Load(); r != nil {
+		return *r
+	}
+	return systemResolver{}
+}
+
+// SetDefault 设置全局解析器，传入nil时恢复为系统解析器
+func SetDefault(r Resolver) {
+	if r == nil {
+		defaultResolver.Store(nil)
+		return
+	}
+	defaultResolver.Store(&r)
+}
+
+// New 根据配置创建解析器
+// cfg为nil或未配置服务器时返回系统解析器
+func New(cfg *Config) (Resolver, error) {
+	if cfg == nil || len(cfg.Servers) == 0 {
+		return systemResolver{}, nil
+	}
+
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout * time.Second
+	}
+
+	// 1. 创建各个上游
+	resolvers := make([]Resolver, 0, len(cfg.Servers))
+	for _, s := range cfg.Servers {
+		r, err := newServer(s, timeout)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, r)
+	}
+
+	// 2. 多个上游时并行竞速
+	var r Resolver
+	if len(resolvers) == 1 {
+		r = resolvers[0]
+	} else {
+		r = &raceResolver{resolvers: resolvers}
+	}
+
+	// 3. 缓存
+	if cfg.DisableCache {
+		return r, nil
+	}
+
+	minTTL, maxTTL := cfg.MinTTL, cfg.MaxTTL
+	if minTTL <= 0 {
+		minTTL = defaultMinTTL
+	}
+	if maxTTL <= 0 {
+		maxTTL = defaultMaxTTL
+	}
+	if minTTL > maxTTL {
+		return nil, fmt.Errorf("DNS缓存配置错误: MinTTL(%d) > MaxTTL(%d)", minTTL, maxTTL)
+	}
+
+	return newCacheResolver(r,
+		time.Duration(minTTL)*time.Second,
+		time.Duration(maxTTL)*time.Second,
+	), nil
+}
+
+// newServer 根据单个服务器配置创建解析器
+func newServer(s ServerConfig, timeout time.Duration) (Resolver, error) {
+	if s.Url == "system" {
+		return systemResolver{}, nil
+	}
+
+	u, err := url.Parse(s.Url)
+	if err != nil {
+		return nil, fmt.Errorf("解析DNS服务器地址失败 url:%s error:%w", s.Url, err)
+	}
+
+	bootstrap := make([]net.IP, 0, len(s.Bootstrap))
+	for _, b := range s.Bootstrap {
+		ip := net.ParseIP(b)
+		if ip == nil {
+			return nil, fmt.Errorf("DNS引导IP格式错误 url:%s bootstrap:%s", s.Url, b)
+		}
+		bootstrap = append(bootstrap, ip)
+	}
+
+	var ex exchanger
+	switch u.Scheme {
+	case "https":
+		ex = newDoH(u, bootstrap, timeout)
+	case "tls":
+		ex = newDoT(u, bootstrap, timeout)
+	case "udp":
+		ex = newUDP(u, timeout)
+	default:
+		return nil, fmt.Errorf("不支持的DNS服务器类型: %s", u.Scheme)
+	}
+
+	return &client{ex: ex, name: s.Url}, nil
+}
+
+// systemResolver 系统解析器
+type systemResolver struct{}
+
+func (systemResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, network, host)
+}
@@ -0,0 +1,215 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// newID 生成随机的DNS报文ID
+func newID() uint16 {
+	b := make([]byte, 2)
+	rand.Read(b)
+	return binary.BigEndian.Uint16(b)
+}
+
+// bootstrapDialer 连接DoH/DoT服务器
+// 配置了引导IP时直接连接引导IP，否则使用系统解析器解析服务器域名
+type bootstrapDialer struct {
+	bootstrap []net.IP
+	dialer    net.Dialer
+}
+
+func (d *bootstrapDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(d.bootstrap) == 0 {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range d.bootstrap {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// doh DNS-over-HTTPS (RFC 8484)
+type doh struct {
+	url    string
+	client *http.Client
+}
+
+func newDoH(u *url.URL, bootstrap []net.IP, timeout time.Duration) *doh {
+	d := &bootstrapDialer{
+		bootstrap: bootstrap,
+		dialer:    net.Dialer{Timeout: timeout},
+	}
+
+	return &doh{
+		url: u.String(),
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext:         d.DialContext,
+				TLSClientConfig:     &tls.Config{ServerName: u.Hostname()},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     90 * time.Second,
+				// 不使用系统代理，否则解析请求可能绕回本程序
+				Proxy: nil,
+			},
+		},
+	}
+}
+
+func (d *doh) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH服务器返回错误状态码: %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
+
+// dot DNS-over-TLS (RFC 7858)
+type dot struct {
+	addr      string
+	tlsConfig *tls.Config
+	dialer    *bootstrapDialer
+	timeout   time.Duration
+}
+
+func newDoT(u *url.URL, bootstrap []net.IP, timeout time.Duration) *dot {
+	port := u.Port()
+	if port == "" {
+		port = "853"
+	}
+
+	return &dot{
+		addr:      net.JoinHostPort(u.Hostname(), port),
+		tlsConfig: &tls.Config{ServerName: u.Hostname()},
+		dialer: &bootstrapDialer{
+			bootstrap: bootstrap,
+			dialer:    net.Dialer{Timeout: timeout},
+		},
+		timeout: timeout,
+	}
+}
+
+func (d *dot) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("连接DoT服务器失败: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	tlsConn := tls.Client(conn, d.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("DoT握手失败: %w", err)
+	}
+
+	return exchangeStream(tlsConn, query)
+}
+
+// exchangeStream 在流式连接上发送带2字节长度前缀的DNS报文
+func exchangeStream(conn io.ReadWriter, query []byte) ([]byte, error) {
+	buf := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(buf, uint16(len(query)))
+	buf = append(buf, query...)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// udp 明文UDP DNS
+type udp struct {
+	addr    string
+	timeout time.Duration
+}
+
+func newUDP(u *url.URL, timeout time.Duration) *udp {
+	port := u.Port()
+	if port == "" {
+		port = "53"
+	}
+
+	return &udp{
+		addr:    net.JoinHostPort(u.Hostname(), port),
+		timeout: timeout,
+	}
+}
+
+func (d *udp) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, 1500)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp[:n], nil
+}
@@ -3,26 +3,32 @@ package http
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+
+	"transparent/proto/dns"
 )
 
+// ErrRefused 代理服务器拒绝CONNECT请求(认证失败除外)，通常是连接目标失败，代理服务器本身可用
+var ErrRefused = errors.New("代理服务器拒绝连接目标")
+
 // GetConn 通过HTTP CONNECT代理建立到目标地址的隧道连接
+// dialer: 连接代理服务器使用的拨号器
 // s: 代理服务器URL，格式为 [http://][user:password@]host:port
 // targetAddr: 要通过代理连接的目标地址，格式为 "host:port"
 // 返回值: 已建立的隧道连接和可能的错误
-func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error) {
+func GetConn(ctx context.Context, dialer *dns.Dialer, s string, targetAddr string) (net.Conn, error) {
 	// 1. 解析代理URL获取认证信息和服务器地址
 	auth, server, _, _, err := ParseURL(s)
 	if err != nil {
 		return nil, fmt.Errorf("解析代理URL失败: %w", err)
 	}
 
-	// 2. 创建TCP拨号器并连接到代理服务器
-	var Dialer net.Dialer
-	conn, err := Dialer.DialContext(ctx, "tcp", server)
+	// 2. 通过拨号器连接到代理服务器
+	conn, err := dialer.DialContext(ctx, "tcp", server)
 	if err != nil {
 		return nil, fmt.Errorf("连接代理服务器失败: %w", err)
 	}
@@ -71,11 +77,15 @@ func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error)
 	}
 	defer resp.Body.Close()
 
-	// 7. 检查响应状态码(需要200表示成功)
-	if resp.StatusCode != http.StatusOK {
+	// 7. 检查响应状态码(需要200表示成功)，认证失败是代理服务器的问题，其余错误状态码与目标有关
+	if resp.StatusCode == http.StatusProxyAuthRequired {
 		conn.Close()
 		return nil, fmt.Errorf("代理服务器返回错误状态码: %d", resp.StatusCode)
 	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("%w: 状态码 %d", ErrRefused, resp.StatusCode)
+	}
 
 	// 8. 处理可能的缓冲数据(防止粘包)
 	if n := reader.Buffered(); n > 0 {
@@ -0,0 +1,227 @@
+package mixed
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// 请求头最大长度
+const maxHeaderSize = 64 << 10
+
+// httpHandshake 读取HTTP代理请求
+// CONNECT请求返回目标地址，prefix为nil
+// 普通请求返回目标地址和改写为origin-form后的请求头，请求体保留在reader中原样转发
+func httpHandshake(r *bufio.Reader, w io.Writer, cfg *Config) (target string, prefix []byte, err error) {
+	// 1. 读取请求行和请求头
+	lines, err := readHeaderLines(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("读取HTTP请求头失败: %w", err)
+	}
+
+	method, uri, version, ok := parseRequestLine(lines[0])
+	if !ok {
+		io.WriteString(w, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return "", nil, fmt.Errorf("HTTP请求行格式错误: %q", lines[0])
+	}
+
+	// 2. 认证
+	if cfg.Username != "" && !checkBasicAuth(cfg, headerValue(lines[1:], "Proxy-Authorization")) {
+		io.WriteString(w, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: Basic realm=\"proxy\"\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return "", nil, errors.New("HTTP代理认证失败")
+	}
+
+	// 3. CONNECT隧道
+	if method == "CONNECT" {
+		if _, _, err := net.SplitHostPort(uri); err != nil {
+			io.WriteString(w, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+			return "", nil, fmt.Errorf("CONNECT目标地址格式错误: %s", uri)
+		}
+		return uri, nil, nil
+	}
+
+	// 4. 普通HTTP请求，改写为origin-form并去掉代理相关请求头
+	// 连接只转发到第一个请求的目标，请求和响应都改为 Connection: close，客户端的后续请求使用新连接
+	// 协议升级(如WebSocket)的请求保留原有的Connection头，升级后连接不再承载HTTP请求
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		io.WriteString(w, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return "", nil, fmt.Errorf("HTTP代理请求地址格式错误: %s", uri)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	target = net.JoinHostPort(u.Hostname(), port)
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "%s %s %s\r\n", method, u.RequestURI(), version)
+	hasHost := false
+	upgrade := headerValue(lines[1:], "Upgrade") != ""
+	for _, line := range lines[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "proxy-authorization", "proxy-connection":
+			continue
+		case "connection", "keep-alive":
+			if !upgrade {
+				continue
+			}
+		case "host":
+			hasHost = true
+		}
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	if !hasHost {
+		fmt.Fprintf(&buf, "Host: %s\r\n", u.Host)
+	}
+	if !upgrade {
+		buf.WriteString("Connection: close\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	return target, buf.Bytes(), nil
+}
+
+// closeWriter 把目标的响应头改为 Connection: close 后写给客户端，之后的数据原样写入
+// 1xx临时响应原样转发并继续等待最终响应，101切换协议后不再改写
+type closeWriter struct {
+	w    io.Writer
+	buf  []byte
+	done bool
+}
+
+func (c *closeWriter) Write(b []byte) (int, error) {
+	if c.done {
+		return c.w.Write(b)
+	}
+
+	c.buf = append(c.buf, b...)
+	for !c.done {
+		i := bytes.Index(c.buf, []byte("\r\n\r\n"))
+		if i < 0 {
+			if len(c.buf) <= maxHeaderSize {
+				return len(b), nil // 等待完整的响应头
+			}
+			c.done = true // 不是HTTP响应，原样转发
+			break
+		}
+
+		var head []byte
+		head, c.done = rewriteResponseHeader(c.buf[:i+4])
+		if _, err := c.w.Write(head); err != nil {
+			return 0, err
+		}
+		c.buf = c.buf[i+4:]
+	}
+
+	rest := c.buf
+	c.buf = nil
+	if len(rest) > 0 {
+		if _, err := c.w.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// rewriteResponseHeader 去掉响应头中的连接保持相关字段并加上 Connection: close
+// 返回false表示为1xx临时响应，之后还有最终响应
+func rewriteResponseHeader(head []byte) ([]byte, bool) {
+	lines := strings.Split(strings.TrimSuffix(string(head), "\r\n\r\n"), "\r\n")
+	_, status, _ := strings.Cut(lines[0], " ")
+	switch {
+	case strings.HasPrefix(status, "101"):
+		return head, true
+	case strings.HasPrefix(status, "1"):
+		return head, false
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString(lines[0])
+	buf.WriteString("\r\n")
+	for _, line := range lines[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "connection", "keep-alive", "proxy-connection":
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("Connection: close\r\n\r\n")
+	return buf.Bytes(), true
+}
+
+// readHeaderLines 读取请求行和请求头，直到空行为止
+func readHeaderLines(r *bufio.Reader) ([]string, error) {
+	var (
+		lines []string
+		size  int
+	)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size += len(line)
+		if size > maxHeaderSize {
+			return nil, errors.New("请求头过长")
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(lines) == 0 {
+				continue // 忽略请求行之前的空行
+			}
+			return lines, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+// parseRequestLine 解析请求行 "METHOD URI VERSION"
+func parseRequestLine(line string) (method, uri, version string, ok bool) {
+	method, rest, ok1 := strings.Cut(line, " ")
+	uri, version, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || !strings.HasPrefix(version, "HTTP/") {
+		return "", "", "", false
+	}
+	return method, uri, version, true
+}
+
+// headerValue 返回指定请求头的值
+func headerValue(lines []string, key string) string {
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), key) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// checkBasicAuth 校验 "Basic base64(user:pass)" 格式的认证信息
+func checkBasicAuth(cfg *Config, auth string) bool {
+	scheme, encoded, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	return ok && checkAuth(cfg, user, pass)
+}
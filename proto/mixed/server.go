@@ -0,0 +1,138 @@
+package mixed
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Config 本地混合(SOCKS5/HTTP)代理入站配置
+type Config struct {
+	// 监听地址 (格式: ip:port，如 127.0.0.1:7890)
+	Listen string
+
+	// 认证用户名和密码，为空时不认证
+	Username string
+	Password string
+
+	// 握手超时(秒)，为0时使用 defaultHandshakeTimeout
+	HandshakeTimeout int
+}
+
+const defaultHandshakeTimeout = 10
+
+// 入站协议类型
+const (
+	protoSocks5 = iota
+	protoHTTPConnect
+	protoHTTP
+)
+
+// Request 已完成握手、等待回复的入站请求
+type Request struct {
+	// 客户端请求的目标地址(host:port)
+	Target string
+
+	conn   net.Conn
+	reader *bufio.Reader
+	proto  int
+	prefix []byte // 普通HTTP请求改写后的请求头，需要先发送给目标
+}
+
+// Handshake 完成入站握手，自动识别SOCKS5和HTTP(CONNECT/普通请求)
+// 握手失败时已按协议回复错误，调用方只需关闭连接
+func Handshake(conn net.Conn, cfg *Config) (*Request, error) {
+	timeout := time.Duration(cfg.HandshakeTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	req := &Request{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	// 根据首字节识别协议
+	first, err := req.reader.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("读取入站首字节失败: %w", err)
+	}
+
+	if first[0] == socks5Version {
+		req.proto = protoSocks5
+		req.Target, err = socks5Handshake(req.reader, conn, cfg)
+	} else {
+		req.Target, req.prefix, err = httpHandshake(req.reader, conn, cfg)
+		req.proto = protoHTTPConnect
+		if req.prefix != nil {
+			req.proto = protoHTTP
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// Accept 通知客户端连接目标成功，返回可用于转发的连接
+// 读取返回的连接时会先得到握手阶段已缓冲的数据
+func (r *Request) Accept() (net.Conn, error) {
+	switch r.proto {
+	case protoSocks5:
+		if err := socks5Reply(r.conn, socks5RepSuccess); err != nil {
+			return nil, err
+		}
+	case protoHTTPConnect:
+		if _, err := io.WriteString(r.conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Conn{Conn: r.conn, r: r.reader, w: r.conn}
+	if len(r.prefix) > 0 {
+		c.r = io.MultiReader(bytes.NewReader(r.prefix), r.reader)
+		c.w = &closeWriter{w: r.conn}
+	}
+	return c, nil
+}
+
+// Reject 通知客户端连接目标失败
+func (r *Request) Reject() {
+	switch r.proto {
+	case protoSocks5:
+		socks5Reply(r.conn, socks5RepFailure)
+	case protoHTTPConnect, protoHTTP:
+		io.WriteString(r.conn, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+	}
+}
+
+// Conn 握手完成后的入站连接
+// 普通HTTP请求的连接写入时改写响应头，使客户端的后续请求不在该连接上发送
+type Conn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// CloseWrite 关闭底层连接的写方向
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,209 @@
+package mixed
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// serve 在本地端口上运行一次握手，返回目标地址和握手后连接读到的首段数据
+func serve(t *testing.T, cfg *Config) (addr string, result chan [2]string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	result = make(chan [2]string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := Handshake(conn, cfg)
+		if err != nil {
+			result <- [2]string{"", err.Error()}
+			return
+		}
+		c, err := req.Accept()
+		if err != nil {
+			result <- [2]string{"", err.Error()}
+			return
+		}
+
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		result <- [2]string{req.Target, line}
+	}()
+
+	return ln.Addr().String(), result
+}
+
+func TestSocks5(t *testing.T) {
+	cfg := &Config{Username: "user", Password: "pass"}
+	addr, result := serve(t, cfg)
+
+	dialer, err := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "user", Password: "pass"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "hello\n")
+
+	r := <-result
+	if r[0] != "example.com:443" || r[1] != "hello\n" {
+		t.Fatalf("unexpected result: %q", r)
+	}
+}
+
+func TestSocks5AuthFail(t *testing.T) {
+	addr, result := serve(t, &Config{Username: "user", Password: "pass"})
+
+	dialer, _ := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "user", Password: "bad"}, proxy.Direct)
+	if _, err := dialer.Dial("tcp", "example.com:443"); err == nil {
+		t.Fatal("expected auth failure")
+	}
+	if r := <-result; r[0] != "" {
+		t.Fatalf("unexpected target: %q", r[0])
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	addr, result := serve(t, &Config{})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	io.WriteString(conn, "hello\n")
+
+	r := <-result
+	if r[0] != "example.com:443" || r[1] != "hello\n" {
+		t.Fatalf("unexpected result: %q", r)
+	}
+}
+
+func TestHTTPPlain(t *testing.T) {
+	addr, result := serve(t, &Config{})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET http://example.com/a?b=1 HTTP/1.1\r\nHost: example.com\r\nProxy-Connection: keep-alive\r\n\r\n")
+
+	r := <-result
+	if r[0] != "example.com:80" || strings.TrimSpace(r[1]) != "GET /a?b=1 HTTP/1.1" {
+		t.Fatalf("unexpected result: %q", r)
+	}
+}
+
+func TestHTTPAuthRequired(t *testing.T) {
+	addr, _ := serve(t, &Config{Username: "user", Password: "pass"})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPPlainKeepAlive(t *testing.T) {
+	// 两个目标分别回复自己的名称
+	targets := map[string]string{}
+	for _, name := range []string{"a", "b"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(srv.Close)
+		targets[name+".test:80"] = srv.Listener.Addr().String()
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	// 按握手得到的目标地址转发
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				req, err := Handshake(conn, &Config{})
+				if err != nil {
+					return
+				}
+				target, err := net.Dial("tcp", targets[req.Target])
+				if err != nil {
+					req.Reject()
+					return
+				}
+				defer target.Close()
+				c, _ := req.Accept()
+				go io.Copy(target, c)
+				io.Copy(c, target)
+			}()
+		}
+	}()
+
+	// 客户端经过同一个代理时会复用连接请求不同的目标
+	proxyURL, _ := url.Parse("http://" + ln.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer client.CloseIdleConnections()
+
+	for _, name := range []string{"a", "b"} {
+		resp, err := client.Get("http://" + name + ".test/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != name || !resp.Close {
+			t.Fatalf("got %q from %s, close=%v", body, name, resp.Close)
+		}
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Fatalf("accepted = %d", n)
+	}
+}
@@ -0,0 +1,169 @@
+package mixed
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5RepSuccess         = 0x00
+	socks5RepFailure         = 0x01
+	socks5RepCmdNotSupported = 0x07
+	socks5RepAddrNotSupport  = 0x08
+)
+
+// socks5Handshake 完成SOCKS5服务端握手并读取请求，仅支持CONNECT命令
+// 请求结果由调用方通过 socks5Reply 回复
+func socks5Handshake(r *bufio.Reader, w io.Writer, cfg *Config) (string, error) {
+	// 1. 协商认证方式: VER NMETHODS METHODS...
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", fmt.Errorf("读取SOCKS5认证方式失败: %w", err)
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", fmt.Errorf("读取SOCKS5认证方式失败: %w", err)
+	}
+
+	method := byte(socks5AuthNone)
+	if cfg.Username != "" {
+		method = socks5AuthPassword
+	}
+	supported := false
+	for _, m := range methods {
+		if m == method {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		w.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return "", errors.New("SOCKS5客户端不支持所需的认证方式")
+	}
+	if _, err := w.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+
+	// 2. 用户名密码认证 (RFC 1929)
+	if method == socks5AuthPassword {
+		if err := socks5Auth(r, w, cfg); err != nil {
+			return "", err
+		}
+	}
+
+	// 3. 读取请求: VER CMD RSV ATYP DST.ADDR DST.PORT
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return "", fmt.Errorf("读取SOCKS5请求失败: %w", err)
+	}
+	if head[1] != socks5CmdConnect {
+		socks5Reply(w, socks5RepCmdNotSupported)
+		return "", fmt.Errorf("不支持的SOCKS5命令: %d", head[1])
+	}
+
+	var host string
+	switch head[3] {
+	case socks5AddrIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		l, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, l)
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socks5Reply(w, socks5RepAddrNotSupport)
+		return "", fmt.Errorf("不支持的SOCKS5地址类型: %d", head[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socks5Auth 用户名密码认证
+func socks5Auth(r *bufio.Reader, w io.Writer, cfg *Config) error {
+	// VER ULEN UNAME PLEN PASSWD
+	ver, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ver != 0x01 {
+		return fmt.Errorf("不支持的SOCKS5认证版本: %d", ver)
+	}
+
+	readField := func() ([]byte, error) {
+		l, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, l)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	}
+
+	user, err := readField()
+	if err != nil {
+		return err
+	}
+	pass, err := readField()
+	if err != nil {
+		return err
+	}
+
+	if !checkAuth(cfg, string(user), string(pass)) {
+		w.Write([]byte{0x01, 0x01})
+		return errors.New("SOCKS5认证失败")
+	}
+
+	_, err = w.Write([]byte{0x01, 0x00})
+	return err
+}
+
+// socks5Reply 回复请求结果，BND.ADDR填0
+func socks5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// checkAuth 校验用户名密码
+func checkAuth(cfg *Config, user, pass string) bool {
+	u := subtle.ConstantTimeCompare([]byte(user), []byte(cfg.Username))
+	p := subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.Password))
+	return u&p == 1
+}
@@ -0,0 +1,299 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pair 通过本地TCP连接创建一对会话
+func pair(t *testing.T, cfg Config) (*Session, *Session) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := Client(conn, cfg), Server(<-accepted, cfg)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// echo 服务端把每个流收到的数据原样发回，读到EOF后关闭写方向
+func echo(s *Session) {
+	for {
+		st, err := s.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer st.Close()
+			io.Copy(st, st)
+			st.CloseWrite()
+		}()
+	}
+}
+
+func TestStreams(t *testing.T) {
+	client, server := pair(t, Config{})
+	go echo(server)
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			st, err := client.OpenStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+
+			data := make([]byte, 300*1024)
+			rand.Read(data)
+			go func() {
+				st.Write(data)
+				st.CloseWrite()
+			}()
+			got, err := io.ReadAll(st)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("echo mismatch: %d bytes, err=%v", len(got), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 双方都关闭写方向后流被移除
+	deadline := time.Now().Add(time.Second)
+	for client.NumStreams()+server.NumStreams() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("streams not released: client=%d server=%d", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.IdleSince().IsZero() {
+		t.Fatal("expected idle session")
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	client, server := pair(t, Config{Window: 64 * 1024})
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 对端不读取时最多发送一个接收窗口
+	st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := st.Write(make([]byte, 200*1024))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != 64*1024 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+
+	// 其他流不受影响
+	other, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 对端读取后恢复发送
+	go io.Copy(io.Discard, peer)
+	st.SetWriteDeadline(time.Time{})
+	if _, err := st.Write(make([]byte, 200*1024)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	client, server := pair(t, Config{})
+
+	st, _ := client.OpenStream()
+	peer, _ := server.AcceptStream()
+
+	// 写方向未关闭时Close重置流，对端读写都失败
+	st.Close()
+	if _, err := peer.Read(make([]byte, 1)); !errors.Is(err, ErrReset) {
+		t.Fatalf("read err = %v", err)
+	}
+	if _, err := peer.Write([]byte("x")); !errors.Is(err, ErrReset) {
+		t.Fatalf("write err = %v", err)
+	}
+
+	// 读超时
+	st2, _ := client.OpenStream()
+	st2.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := st2.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read err = %v", err)
+	}
+
+	// 会话关闭后所有流结束
+	server.Close()
+	st2.SetReadDeadline(time.Time{})
+	if _, err := st2.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected error after session close")
+	}
+	if _, err := client.OpenStream(); err == nil {
+		t.Fatal("expected error opening on closed session")
+	}
+}
+
+func TestPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go echo(Server(conn, Config{}))
+		}
+	}()
+
+	var dials int
+	p := NewPool(PoolConfig{Conns: 2, Streams: 2}, func(ctx context.Context) (net.Conn, error) {
+		dials++
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	defer p.Close()
+
+	// 第一个流使用新连接，第二个流在已有连接忙时建立第二个连接，之后按流数分配直到全满
+	var streams []*Stream
+	for range 4 {
+		st, err := p.Open(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, st)
+	}
+	if dials != 2 {
+		t.Fatalf("dials = %d", dials)
+	}
+	if s := p.Stats(); s.Sessions != 2 || s.Streams != 4 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	if _, err := p.Open(context.Background()); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("err = %v", err)
+	}
+
+	streams[0].Close()
+	if _, err := p.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 服务端不支持时停止尝试
+	off := NewPool(PoolConfig{Conns: 1}, func(ctx context.Context) (net.Conn, error) {
+		return nil, ErrUnsupported
+	})
+	for range 2 {
+		if _, err := off.Open(context.Background()); !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("err = %v", err)
+		}
+	}
+	if !off.Stats().Disabled {
+		t.Fatal("expected disabled pool")
+	}
+}
+
+func TestPoolDrain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go echo(Server(conn, Config{}))
+		}
+	}()
+
+	var dials int
+	p := NewPool(PoolConfig{Conns: 2, Streams: 2}, func(ctx context.Context) (net.Conn, error) {
+		dials++
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	defer p.Close()
+
+	// 两个流使用两个连接，关闭其中一个流后该连接空闲
+	a, err := p.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// 空闲连接立即关闭，之后不再打开新的流
+	p.Drain()
+	if _, err := p.Open(context.Background()); !errors.Is(err, ErrClosed) || dials != 2 {
+		t.Fatalf("err = %v, dials = %d", err, dials)
+	}
+	if s := p.Stats(); s.Sessions != 1 || s.Streams != 1 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	// 剩余的流继续转发，结束后连接关闭
+	if _, err := a.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(a, buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("got %q, err=%v", buf, err)
+	}
+	a.Close()
+	if s := p.Stats(); s.Sessions != 0 {
+		t.Fatalf("session not closed after last stream: %+v", s)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	cfg, ok, err := ParseURL("oks://127.0.0.1:8080?mux=4&streams=16")
+	if err != nil || !ok || cfg.Conns != 4 || cfg.Streams != 16 {
+		t.Fatalf("cfg=%+v ok=%v err=%v", cfg, ok, err)
+	}
+	if _, ok, err := ParseURL("oks://127.0.0.1:8080"); ok || err != nil {
+		t.Fatal("expected mux disabled")
+	}
+	if _, _, err := ParseURL("oks://127.0.0.1:8080?mux=x"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,245 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultStreams 默认的每个连接的流数上限
+	DefaultStreams = 32
+
+	// DefaultIdleTimeout 默认的空闲连接关闭时长(秒)
+	DefaultIdleTimeout = 60
+)
+
+var (
+	// ErrUnsupported 服务端不支持多路复用
+	ErrUnsupported = errors.New("mux: 服务端不支持多路复用")
+
+	// ErrPoolFull 所有连接的流数都已达到上限
+	ErrPoolFull = errors.New("mux: 连接池已满")
+)
+
+// PoolConfig 连接池配置
+type PoolConfig struct {
+	Config
+
+	// 连接数上限
+	Conns int
+
+	// 每个连接的流数上限，为0时使用默认值32
+	Streams int
+
+	// 没有流的连接空闲超过该时长(秒)后关闭，为0时使用默认值60
+	IdleTimeout int
+}
+
+// PoolStats 连接池统计
+type PoolStats struct {
+	Sessions int
+	Streams  int
+	Disabled bool `json:",omitempty"` // 服务端不支持，已改用独立连接
+}
+
+// ParseURL 从上游地址的查询参数读取多路复用配置，如 oks://host:port?mux=4&streams=32
+// mux 为连接数，streams 为每个连接的流数上限，未设置mux或为0时返回false
+func ParseURL(s string) (PoolConfig, bool, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return PoolConfig{}, false, err
+	}
+	q := u.Query()
+	if q.Get("mux") == "" {
+		return PoolConfig{}, false, nil
+	}
+
+	var cfg PoolConfig
+	if cfg.Conns, err = strconv.Atoi(q.Get("mux")); err != nil || cfg.Conns < 0 {
+		return PoolConfig{}, false, fmt.Errorf("多路复用连接数错误: %s", q.Get("mux"))
+	}
+	if v := q.Get("streams"); v != "" {
+		if cfg.Streams, err = strconv.Atoi(v); err != nil || cfg.Streams < 0 {
+			return PoolConfig{}, false, fmt.Errorf("多路复用流数错误: %s", v)
+		}
+	}
+	return cfg, cfg.Conns > 0, nil
+}
+
+// Pool 多路复用连接池，新流优先使用流最少的连接，连接都在使用中且未达上限时建立新连接
+type Pool struct {
+	cfg  PoolConfig
+	dial func(ctx context.Context) (net.Conn, error) // 建立已完成协商的连接
+
+	mu       sync.Mutex
+	sessions []*Session
+	dialing  int
+	dialed   chan struct{} // 每次建立连接结束时关闭并替换
+	closed   bool
+	disabled atomic.Bool
+}
+
+// NewPool 创建连接池，dial 连接服务端并完成多路复用协商，服务端不支持时返回 ErrUnsupported
+func NewPool(cfg PoolConfig, dial func(ctx context.Context) (net.Conn, error)) *Pool {
+	if cfg.Conns <= 0 {
+		cfg.Conns = 1
+	}
+	if cfg.Streams <= 0 {
+		cfg.Streams = DefaultStreams
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	return &Pool{cfg: cfg, dial: dial, dialed: make(chan struct{})}
+}
+
+// Open 打开新的流，连接数已达上限且都在建立中时等待
+// 服务端不支持多路复用时返回 ErrUnsupported，之后不再尝试；所有连接都已满时返回 ErrPoolFull
+func (p *Pool) Open(ctx context.Context) (*Stream, error) {
+	for {
+		if p.disabled.Load() {
+			return nil, ErrUnsupported
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrClosed
+		}
+		p.prune()
+
+		// 1. 有空闲连接或连接数已达上限时使用流最少的连接
+		best := p.leastLoaded()
+		full := len(p.sessions)+p.dialing >= p.cfg.Conns
+		if best != nil && (best.NumStreams() == 0 || full) {
+			p.mu.Unlock()
+			return best.OpenStream()
+		}
+		if full {
+			if p.dialing == 0 {
+				p.mu.Unlock()
+				return nil, ErrPoolFull
+			}
+
+			// 等待建立中的连接
+			dialed := p.dialed
+			p.mu.Unlock()
+			select {
+			case <-dialed:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		// 2. 建立新连接
+		p.dialing++
+		p.mu.Unlock()
+		return p.dialOpen(ctx, best)
+	}
+}
+
+// dialOpen 建立新连接并在其上打开流，失败时使用已有的连接best
+func (p *Pool) dialOpen(ctx context.Context, best *Session) (*Stream, error) {
+	conn, err := p.dial(ctx)
+
+	p.mu.Lock()
+	p.dialing--
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+	if err != nil {
+		p.mu.Unlock()
+		if errors.Is(err, ErrUnsupported) {
+			p.disabled.Store(true)
+			return nil, err
+		}
+		if best != nil {
+			return best.OpenStream()
+		}
+		return nil, err
+	}
+	if p.closed {
+		p.mu.Unlock()
+		conn.Close()
+		return nil, ErrClosed
+	}
+	s := Client(conn, p.cfg.Config)
+	p.sessions = append(p.sessions, s)
+	p.mu.Unlock()
+
+	return s.OpenStream()
+}
+
+// Stats 返回连接池统计
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := PoolStats{Disabled: p.disabled.Load()}
+	for _, s := range p.sessions {
+		if !s.IsClosed() {
+			st.Sessions++
+			st.Streams += s.NumStreams()
+		}
+	}
+	return st
+}
+
+// Drain 停止建立新连接和打开新的流，没有流的连接立即关闭，其余连接在最后一个流结束后关闭
+// 之后 Open 返回 ErrClosed，Close 仍会立即关闭所有连接
+func (p *Pool) Drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, s := range p.sessions {
+		s.CloseWhenIdle()
+	}
+}
+
+// Close 关闭所有连接
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, s := range p.sessions {
+		s.Close()
+	}
+	p.sessions = nil
+}
+
+// leastLoaded 返回流数未达上限的连接中流最少的，调用方持有锁
+func (p *Pool) leastLoaded() *Session {
+	var best *Session
+	var n int
+	for _, s := range p.sessions {
+		if c := s.NumStreams(); c < p.cfg.Streams && (best == nil || c < n) {
+			best, n = s, c
+		}
+	}
+	return best
+}
+
+// prune 移除已关闭的连接，关闭空闲超时的连接，调用方持有锁
+func (p *Pool) prune() {
+	timeout := time.Duration(p.cfg.IdleTimeout) * time.Second
+	live := p.sessions[:0]
+	for _, s := range p.sessions {
+		if idle := s.IdleSince(); !idle.IsZero() && time.Since(idle) > timeout {
+			s.Close()
+		}
+		if !s.IsClosed() {
+			live = append(live, s)
+		}
+	}
+	clear(p.sessions[len(live):])
+	p.sessions = live
+}
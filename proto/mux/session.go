@@ -0,0 +1,355 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Target 客户端请求多路复用时代替目标地址发送的保留地址
+// 不支持多路复用的服务端会把它当作普通目标，连接失败后回复错误，客户端据此改用独立连接
+const Target = "v1.mux.invalid:0"
+
+const (
+	version    = 1
+	headerSize = 8 // 版本(1) 命令(1) 长度(2) 流ID(4)
+
+	// maxFrame 单个数据帧的最大长度
+	maxFrame = 32 * 1024
+
+	// initialWindow 新流的初始发送额度，双方无需协商即可发送，更大的接收窗口通过窗口更新帧授予
+	initialWindow = 64 * 1024
+
+	// DefaultWindow 默认的每个流的接收窗口(字节)
+	DefaultWindow = 256 * 1024
+
+	// DefaultBacklog 默认的等待Accept的流数量上限
+	DefaultBacklog = 64
+)
+
+// 帧类型
+const (
+	cmdSYN byte = iota // 打开流
+	cmdFIN             // 关闭写方向，对端读完数据后收到EOF
+	cmdRST             // 重置流，双方立即结束
+	cmdPSH             // 数据
+	cmdUPD             // 窗口更新，负载为授予的发送额度(4字节)
+)
+
+var (
+	// ErrClosed 会话已关闭
+	ErrClosed = errors.New("mux: 会话已关闭")
+
+	// ErrReset 流被对端重置
+	ErrReset = errors.New("mux: 流被对端重置")
+
+	// errProtocol 对端违反协议，会话被关闭
+	errProtocol = errors.New("mux: 协议错误")
+)
+
+// Config 会话配置
+type Config struct {
+	// 每个流的接收窗口(字节)，对端最多发送这么多未被读取的数据，为0时使用默认值256KiB，不小于64KiB
+	Window int
+
+	// 等待Accept的流数量上限，超过时重置新流，为0时使用默认值64
+	Backlog int
+}
+
+// Session 在一个连接上承载多个双向流，每个流独立流量控制
+type Session struct {
+	conn   net.Conn
+	window int
+
+	writeMu sync.Mutex // 串行写帧
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	idle    time.Time // 没有流时开始空闲的时间
+	drain   bool      // 最后一个流结束后关闭
+
+	accept  chan *Stream
+	die     chan struct{}
+	dieOnce sync.Once
+	err     error
+}
+
+// Client 创建客户端会话，只有客户端打开流
+func Client(conn net.Conn, cfg Config) *Session {
+	return newSession(conn, cfg, 1)
+}
+
+// Server 创建服务端会话，通过 AcceptStream 接受客户端打开的流
+func Server(conn net.Conn, cfg Config) *Session {
+	return newSession(conn, cfg, 2)
+}
+
+func newSession(conn net.Conn, cfg Config, firstID uint32) *Session {
+	if cfg.Window == 0 {
+		cfg.Window = DefaultWindow
+	}
+	if cfg.Backlog <= 0 {
+		cfg.Backlog = DefaultBacklog
+	}
+
+	s := &Session{
+		conn:    conn,
+		window:  max(cfg.Window, initialWindow),
+		streams: map[uint32]*Stream{},
+		nextID:  firstID,
+		idle:    time.Now(),
+		accept:  make(chan *Stream, cfg.Backlog),
+		die:     make(chan struct{}),
+	}
+	go s.recvLoop()
+	return s
+}
+
+// OpenStream 打开新的流
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(id, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, nil); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	st.grantWindow()
+	return st, nil
+}
+
+// AcceptStream 等待对端打开的流
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.die:
+		return nil, s.closeErr()
+	}
+}
+
+// NumStreams 返回未结束的流数量
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IdleSince 返回会话开始空闲的时间，有流时返回零值
+func (s *Session) IdleSince() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.streams) > 0 {
+		return time.Time{}
+	}
+	return s.idle
+}
+
+// CloseWhenIdle 没有流时立即关闭，否则在最后一个流结束后关闭
+func (s *Session) CloseWhenIdle() {
+	s.mu.Lock()
+	s.drain = true
+	idle := len(s.streams) == 0
+	s.mu.Unlock()
+
+	if idle {
+		s.Close()
+	}
+}
+
+// IsClosed 会话是否已关闭
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close 关闭会话和底层连接，所有流随之结束
+func (s *Session) Close() error {
+	s.closeWithError(ErrClosed)
+	return nil
+}
+
+// LocalAddr 底层连接的本地地址
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr 底层连接的远端地址
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// closeWithError 记录原因并关闭会话
+func (s *Session) closeWithError(err error) {
+	s.dieOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.die)
+		s.conn.Close()
+	})
+}
+
+// closeErr 会话关闭的原因
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil || errors.Is(s.err, io.EOF) {
+		return ErrClosed
+	}
+	return s.err
+}
+
+// writeFrame 写入一帧，负载不超过 maxFrame
+func (s *Session) writeFrame(cmd byte, id uint32, payload []byte) error {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = version
+	buf[1] = cmd
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], id)
+	copy(buf[headerSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.IsClosed() {
+		return s.closeErr()
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+// writeUpdate 授予对端发送额度
+func (s *Session) writeUpdate(id uint32, n int) error {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n))
+	return s.writeFrame(cmdUPD, id, b[:])
+}
+
+// recvLoop 读取帧并分发给各个流，出错时关闭会话
+// 收帧协程不直接写帧，避免双方都在等待对方读取时死锁
+func (s *Session) recvLoop() {
+	hdr := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.conn, hdr); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if hdr[0] != version {
+			s.closeWithError(fmt.Errorf("%w: 不支持的版本 %d", errProtocol, hdr[0]))
+			return
+		}
+		cmd := hdr[1]
+		id := binary.BigEndian.Uint32(hdr[4:])
+
+		var payload []byte
+		if n := binary.BigEndian.Uint16(hdr[2:]); n > 0 {
+			payload = make([]byte, n)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				s.closeWithError(err)
+				return
+			}
+		}
+
+		if err := s.handleFrame(cmd, id, payload); err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+// handleFrame 处理一帧，已结束的流的帧直接丢弃
+func (s *Session) handleFrame(cmd byte, id uint32, payload []byte) error {
+	if cmd == cmdSYN {
+		return s.handleSYN(id)
+	}
+
+	st := s.stream(id)
+	if st == nil {
+		return nil
+	}
+
+	switch cmd {
+	case cmdPSH:
+		return st.push(payload)
+	case cmdUPD:
+		if len(payload) != 4 {
+			return fmt.Errorf("%w: 窗口更新帧长度 %d", errProtocol, len(payload))
+		}
+		st.addCredit(int(binary.BigEndian.Uint32(payload)))
+	case cmdFIN:
+		st.remoteFin()
+	case cmdRST:
+		st.remoteReset()
+	default:
+		return fmt.Errorf("%w: 未知的帧类型 %d", errProtocol, cmd)
+	}
+	return nil
+}
+
+// handleSYN 接受对端打开的流，等待Accept的流过多时重置
+func (s *Session) handleSYN(id uint32) error {
+	s.mu.Lock()
+	if _, ok := s.streams[id]; ok || id%2 == s.nextID%2 {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: 无效的流ID %d", errProtocol, id)
+	}
+	st := newStream(id, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- st:
+		go st.grantWindow()
+	default:
+		s.remove(id)
+		go s.writeFrame(cmdRST, id, nil)
+	}
+	return nil
+}
+
+// stream 按ID查找流
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// remove 移除已结束的流，等待关闭的会话在最后一个流结束后关闭
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	if _, ok := s.streams[id]; !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.streams, id)
+	idle := len(s.streams) == 0
+	if idle {
+		s.idle = time.Now()
+	}
+	drain := s.drain
+	s.mu.Unlock()
+
+	if idle && drain {
+		s.Close()
+	}
+}
@@ -0,0 +1,335 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream 会话中的一个双向流，实现 net.Conn 和 CloseWrite
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu       sync.Mutex
+	buf      bytes.Buffer // 已收到未读取的数据
+	consumed int          // 已读取但还未授予对端的额度
+	credit   int          // 剩余发送额度
+	finRecv  bool         // 对端已关闭写方向
+	finSent  bool         // 本端已关闭写方向
+	reset    bool         // 被对端重置
+	closed   bool         // 本端已关闭
+
+	readEv  chan struct{} // 有数据或状态变化
+	writeEv chan struct{} // 发送额度增加或状态变化
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:            id,
+		sess:          sess,
+		credit:        initialWindow,
+		readEv:        make(chan struct{}, 1),
+		writeEv:       make(chan struct{}, 1),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+}
+
+// ID 流ID
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read 读取数据，对端关闭写方向且数据读完后返回 io.EOF
+// 读取的数据累计达到接收窗口一半时授予对端新的发送额度
+func (st *Stream) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.consumed += n
+			grant := 0
+			if st.consumed >= st.sess.window/2 && !st.finRecv && !st.closed {
+				grant, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+
+			if grant > 0 {
+				st.sess.writeUpdate(st.id, grant)
+			}
+			return n, nil
+		}
+
+		var err error
+		switch {
+		case st.reset:
+			err = ErrReset
+		case st.finRecv:
+			err = io.EOF
+		case st.closed:
+			err = net.ErrClosed
+		case st.sess.IsClosed():
+			err = st.sess.closeErr()
+		}
+		st.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		select {
+		case <-st.readEv:
+		case <-st.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-st.sess.die:
+		}
+	}
+}
+
+// Write 发送数据，发送额度用完时等待对端读取
+func (st *Stream) Write(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		st.mu.Lock()
+		var err error
+		switch {
+		case st.reset:
+			err = ErrReset
+		case st.closed, st.finSent:
+			err = net.ErrClosed
+		case st.sess.IsClosed():
+			err = st.sess.closeErr()
+		}
+		if err != nil {
+			st.mu.Unlock()
+			return n, err
+		}
+
+		if st.credit == 0 {
+			st.mu.Unlock()
+			select {
+			case <-st.writeEv:
+			case <-st.writeDeadline.wait():
+				return n, os.ErrDeadlineExceeded
+			case <-st.sess.die:
+			}
+			continue
+		}
+
+		k := min(len(b)-n, maxFrame, st.credit)
+		st.credit -= k
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(cmdPSH, st.id, b[n:n+k]); err != nil {
+			return n, err
+		}
+		n += k
+	}
+	return n, nil
+}
+
+// CloseWrite 关闭写方向，对端读完已发送的数据后收到EOF
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.closed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecv
+	st.mu.Unlock()
+	st.notify()
+
+	err := st.sess.writeFrame(cmdFIN, st.id, nil)
+	if done {
+		st.sess.remove(st.id)
+	}
+	return err
+}
+
+// Close 关闭流，双方的写方向未都关闭时重置流
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	rst := !st.reset && !(st.finSent && st.finRecv)
+	st.mu.Unlock()
+	st.notify()
+
+	// 先发送重置再移除，移除最后一个流时等待关闭的会话随之关闭
+	var err error
+	if rst {
+		err = st.sess.writeFrame(cmdRST, st.id, nil)
+	}
+	st.sess.remove(st.id)
+	return err
+}
+
+// LocalAddr 会话底层连接的本地地址
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+// RemoteAddr 会话底层连接的远端地址
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	st.writeDeadline.set(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.set(t)
+	return nil
+}
+
+// grantWindow 接收窗口大于初始额度时授予对端剩余的额度
+func (st *Stream) grantWindow() {
+	if n := st.sess.window - initialWindow; n > 0 {
+		st.sess.writeUpdate(st.id, n)
+	}
+}
+
+// push 收到数据，超过接收窗口说明对端没有遵守流量控制
+func (st *Stream) push(p []byte) error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	if st.buf.Len()+len(p) > st.sess.window {
+		st.mu.Unlock()
+		return fmt.Errorf("%w: 流 %d 超出接收窗口", errProtocol, st.id)
+	}
+	st.buf.Write(p)
+	st.mu.Unlock()
+
+	signal(st.readEv)
+	return nil
+}
+
+// addCredit 增加发送额度
+func (st *Stream) addCredit(n int) {
+	st.mu.Lock()
+	st.credit += n
+	st.mu.Unlock()
+	signal(st.writeEv)
+}
+
+// remoteFin 对端关闭写方向
+func (st *Stream) remoteFin() {
+	st.mu.Lock()
+	st.finRecv = true
+	done := st.finSent
+	st.mu.Unlock()
+	st.notify()
+
+	if done {
+		st.sess.remove(st.id)
+	}
+}
+
+// remoteReset 对端重置流
+func (st *Stream) remoteReset() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+	st.notify()
+
+	st.sess.remove(st.id)
+}
+
+// notify 唤醒等待中的读写
+func (st *Stream) notify() {
+	signal(st.readEv)
+	signal(st.writeEv)
+}
+
+// signal 非阻塞地发送通知
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// deadline 读写截止时间，到期时关闭通道，与标准库net.Pipe的实现相同
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set 设置截止时间，零值表示不限制
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // 等待定时器关闭通道
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait 返回到期时关闭的通道
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
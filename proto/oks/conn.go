@@ -3,26 +3,44 @@ package oks
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+
+	"transparent/proto/dns"
 )
 
-func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error) {
+// ErrRefused 服务端回复了错误，通常是服务端连接目标失败，代理服务器本身可用
+var ErrRefused = errors.New("代理服务器拒绝")
+
+func GetConn(ctx context.Context, dialer *dns.Dialer, s string, targetAddr string) (net.Conn, error) {
+	conn, err := Dial(ctx, dialer, s)
+	if err != nil {
+		return nil, err
+	}
+	return Open(ctx, conn, targetAddr)
+}
+
+// Dial 连接代理服务器，还未发送目标地址，可预先建立后通过 Open 使用
+func Dial(ctx context.Context, dialer *dns.Dialer, s string) (net.Conn, error) {
 	// 1. 解析代理URL获取认证信息和服务器地址
 	_, server, _, _, err := ParseURL(s)
 	if err != nil {
 		return nil, fmt.Errorf("解析代理URL失败: %w", err)
 	}
 
-	// 2. 创建TCP拨号器并连接到代理服务器
-	var Dialer net.Dialer
-	conn, err := Dialer.DialContext(ctx, "tcp", server)
+	// 2. 通过拨号器连接到代理服务器
+	conn, err := dialer.DialContext(ctx, "tcp", server)
 	if err != nil {
 		return nil, fmt.Errorf("连接代理服务器失败: %w", err)
 	}
+	return conn, nil
+}
 
+// Open 在已连接的代理服务器连接上发送目标地址并等待回复，失败时关闭连接
+func Open(ctx context.Context, conn net.Conn, targetAddr string) (net.Conn, error) {
 	done := make(chan struct{})
 	defer func() {
 		for range done {
@@ -39,6 +57,16 @@ func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error)
 		}
 	}()
 
+	if err := handshake(conn, targetAddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// handshake 发送目标地址并等待服务端回复，服务端连接目标成功时回复ok，否则回复错误原因
+func handshake(conn net.Conn, targetAddr string) error {
 	buf := make([]byte, 4)
 
 	// 使用binary.BigEndian将整数写入字节切片（大端序）
@@ -47,18 +75,15 @@ func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error)
 	buf = append(buf, []byte(targetAddr)...)
 
 	// 发送消息到服务端
-	_, err = conn.Write(buf)
-	if err != nil {
-		conn.Close()
-		return nil, err
+	if _, err := conn.Write(buf); err != nil {
+		return err
 	}
 
 	buf = make([]byte, 4)
 
 	if _, err := io.ReadFull(conn, buf); err != nil {
 		log.Printf("读取响应失败: %v", err)
-		conn.Close()
-		return nil, err
+		return err
 	}
 
 	parsedNum := binary.BigEndian.Uint32(buf)
@@ -66,8 +91,7 @@ func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error)
 	buf = make([]byte, parsedNum)
 
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		conn.Close()
-		return nil, err
+		return err
 	}
 
 	response := string(buf)
@@ -75,9 +99,8 @@ func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error)
 	log.Printf("读取响应: %s", response)
 
 	if response != "ok" {
-		conn.Close()
-		return nil, fmt.Errorf(response)
+		return fmt.Errorf("%w: %s", ErrRefused, response)
 	}
 
-	return conn, nil
+	return nil
 }
@@ -0,0 +1,37 @@
+package oks
+
+import (
+	"context"
+	"net"
+
+	"transparent/proto/mux"
+	"transparent/proto/tunnel"
+)
+
+// Server oks服务端，每个连接先读取目标地址，连接目标成功后回复ok并双向转发
+// 目标地址为 mux.Target 时在该连接上运行多路复用会话，每个流按同样的协议处理
+type Server struct {
+	// 连接目标使用的拨号函数，为nil时使用net.Dialer
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// 多路复用会话配置
+	Mux mux.Config
+
+	// 拒绝多路复用协商，客户端改用独立连接
+	DisableMux bool
+}
+
+// Serve 接受连接直到监听关闭
+func (s *Server) Serve(ln net.Listener) error {
+	return s.tunnel().Serve(ln)
+}
+
+// ServeConn 处理一个客户端连接
+func (s *Server) ServeConn(conn net.Conn) {
+	s.tunnel().ServeConn(conn)
+}
+
+// tunnel 按oks协议配置的服务端，目标地址为原文，数据不做处理
+func (s *Server) tunnel() *tunnel.Server {
+	return &tunnel.Server{Dial: s.Dial, Mux: s.Mux, DisableMux: s.DisableMux}
+}
@@ -0,0 +1,216 @@
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// maxSniffSize 嗅探时最多读取的字节数，超过时放弃
+const maxSniffSize = 8 << 10
+
+// errNeedMore 数据不完整，需要继续读取
+var errNeedMore = errors.New("数据不完整")
+
+// Host 读取连接开头的数据，从TLS ClientHello的SNI或HTTP请求的Host头中获取目标域名
+// 返回域名(无法识别时为空)和已读取的数据，调用方需把已读取的数据原样发送给目标
+// 超过timeout未收到足够数据时停止嗅探(如服务端先发数据的协议)，不视为错误
+// 读取出错(如对端关闭)时同样返回已读取的数据
+func Host(conn net.Conn, timeout time.Duration) (string, []byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 0, 2048)
+	for len(buf) < maxSniffSize {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		if n > 0 {
+			host, perr := parse(buf)
+			if perr != errNeedMore {
+				return host, buf, nil
+			}
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return "", buf, nil
+			}
+			return "", buf, err
+		}
+	}
+	return "", buf, nil
+}
+
+// parse 从连接开头的数据中解析目标域名，无法识别时返回空
+// 数据不完整时返回errNeedMore
+func parse(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", errNeedMore
+	}
+	if b[0] == 0x16 {
+		return parseTLS(b)
+	}
+	return parseHTTP(b)
+}
+
+// parseTLS 解析TLS ClientHello中的SNI，只处理第一个记录
+func parseTLS(b []byte) (string, error) {
+	// 1. 记录头: 类型(1) 版本(2) 长度(2)
+	if len(b) < 5 {
+		return "", errNeedMore
+	}
+	if b[1] != 3 {
+		return "", nil
+	}
+	n := int(binary.BigEndian.Uint16(b[3:5]))
+	if len(b) < 5+n {
+		return "", errNeedMore
+	}
+	b = b[5 : 5+n]
+
+	// 2. 握手消息头: 类型(1) 长度(3)，ClientHello被拆分到多个记录时放弃
+	if len(b) < 4 || b[0] != 0x01 {
+		return "", nil
+	}
+	n = int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	if len(b) < 4+n {
+		return "", nil
+	}
+	b = b[4 : 4+n]
+
+	// 3. 版本(2) 随机数(32) 会话ID 密码套件 压缩方法
+	r := reader(b)
+	if !r.skip(34) || !r.skipVec(1) || !r.skipVec(2) || !r.skipVec(1) {
+		return "", nil
+	}
+
+	// 4. 扩展，server_name类型为0
+	exts, ok := r.vec(2)
+	if !ok {
+		return "", nil
+	}
+	for len(exts) > 0 {
+		typ, ok1 := exts.uint16()
+		data, ok2 := exts.vec(2)
+		if !ok1 || !ok2 {
+			return "", nil
+		}
+		if typ != 0 {
+			continue
+		}
+
+		list, ok := data.vec(2)
+		for ok && len(list) > 0 {
+			var nameType []byte
+			var name reader
+			nameType, ok = list.next(1)
+			if !ok {
+				break
+			}
+			name, ok = list.vec(2)
+			if ok && nameType[0] == 0 {
+				return strings.ToLower(string(name)), nil
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// httpMethods 识别HTTP请求使用的方法
+var httpMethods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// parseHTTP 解析HTTP请求的Host头
+func parseHTTP(b []byte) (string, error) {
+	matched := false
+	for _, m := range httpMethods {
+		if len(b) < len(m) {
+			if strings.HasPrefix(m, string(b)) {
+				return "", errNeedMore
+			}
+			continue
+		}
+		if string(b[:len(m)]) == m {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return "", nil
+	}
+
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", errNeedMore
+	}
+
+	lines := strings.Split(string(b[:end]), "\r\n")
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.ToLower(strings.Trim(host, "[]")), nil
+	}
+	return "", nil
+}
+
+// reader 按TLS编码规则读取字段
+type reader []byte
+
+// next 读取n个字节
+func (r *reader) next(n int) ([]byte, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b, true
+}
+
+// skip 跳过n个字节
+func (r *reader) skip(n int) bool {
+	_, ok := r.next(n)
+	return ok
+}
+
+// uint16 读取2字节整数
+func (r *reader) uint16() (uint16, bool) {
+	b, ok := r.next(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b), true
+}
+
+// vec 读取以lenSize字节长度为前缀的数据
+func (r *reader) vec(lenSize int) (reader, bool) {
+	b, ok := r.next(lenSize)
+	if !ok {
+		return nil, false
+	}
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	v, ok := r.next(n)
+	return reader(v), ok
+}
+
+// skipVec 跳过以lenSize字节长度为前缀的数据
+func (r *reader) skipVec(lenSize int) bool {
+	_, ok := r.vec(lenSize)
+	return ok
+}
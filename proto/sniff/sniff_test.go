@@ -0,0 +1,78 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHostTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: "www.Example.com"}).Handshake()
+	}()
+
+	host, peeked, err := Host(server, time.Second)
+	if err != nil || host != "www.example.com" {
+		t.Fatal(host, err)
+	}
+	if len(peeked) == 0 || peeked[0] != 0x16 {
+		t.Fatal("peeked data should start with the TLS record")
+	}
+}
+
+func TestHostHTTP(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	req := "GET / HTTP/1.1\r\nUser-Agent: test\r\nHost: example.org:8080\r\n\r\n"
+	go func() {
+		// 分两次发送，验证数据不完整时继续读取
+		client.Write([]byte(req[:20]))
+		client.Write([]byte(req[20:]))
+	}()
+
+	host, peeked, err := Host(server, time.Second)
+	if err != nil || host != "example.org" || string(peeked) != req {
+		t.Fatal(host, string(peeked), err)
+	}
+}
+
+func TestHostTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// 服务端先发数据的协议，客户端不发送数据
+	host, peeked, err := Host(server, 50*time.Millisecond)
+	if err != nil || host != "" || len(peeked) != 0 {
+		t.Fatal(host, peeked, err)
+	}
+
+	// 无法识别的协议立即返回
+	go client.Write([]byte("SSH-2.0-OpenSSH\r\n"))
+	host, peeked, err = Host(server, time.Second)
+	if err != nil || host != "" || string(peeked) != "SSH-2.0-OpenSSH\r\n" {
+		t.Fatal(host, string(peeked), err)
+	}
+}
+
+func TestHostEOF(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// 本地程序发送不完整的数据后关闭，已读取的数据仍需返回
+	go func() {
+		client.Write([]byte("GET / HT"))
+		client.Close()
+	}()
+
+	host, peeked, err := Host(server, time.Second)
+	if err == nil || host != "" || string(peeked) != "GET / HT" {
+		t.Fatal(host, string(peeked), err)
+	}
+}
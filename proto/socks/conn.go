@@ -2,17 +2,36 @@ package socks
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 
 	"golang.org/x/net/proxy"
+
+	"transparent/proto/dns"
 )
 
+// ErrRefused 代理服务器回复目标不可达或被拒绝，代理服务器本身可用
+var ErrRefused = errors.New("代理服务器无法连接目标")
+
+// targetReplies 表示目标不可达的SOCKS5回复，与 golang.org/x/net/internal/socks 的错误信息一致
+// 一般性失败(general SOCKS server failure)和不支持的命令视为代理服务器故障
+var targetReplies = []string{
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"address type not supported",
+}
+
 // GetConn 通过SOCKS5代理建立到目标地址的连接
+// dialer: 连接代理服务器使用的拨号器
 // s: SOCKS5代理服务器URL，格式如 "user:password@host:port"
 // targetAddr: 要通过代理连接的目标地址，格式如 "host:port"
 // 返回值: 已建立的网络连接和可能的错误
-func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error) {
+func GetConn(ctx context.Context, dialer *dns.Dialer, s string, targetAddr string) (net.Conn, error) {
 	// 1. 解析代理URL
 	auth, server, err := ParseURL(s) // 解析出认证信息和服务器地址
 	if err != nil {
@@ -20,31 +39,52 @@ func GetConn(ctx context.Context, s string, targetAddr string) (net.Conn, error)
 	}
 
 	// 2. 创建SOCKS5拨号器
-	dialer, err := proxy.SOCKS5(
+	socksDialer, err := proxy.SOCKS5(
 		"tcp",        // 网络类型(tcp)
 		server,       // 代理服务器地址(host:port)
 		auth,         // 认证信息(nil或Auth)
-		proxy.Direct, // 底层拨号器(直接连接)
+		proxy.Direct, // 底层拨号器(不使用，连接由dialer建立)
 	)
 	if err != nil {
 		return nil, fmt.Errorf("创建SOCKS5拨号器失败: %w", err)
 	}
 
-	// 3. 通过代理建立到目标地址的连接
-	// conn, err := dialer.Dial("tcp", targetAddr)
-	// if err != nil {
-	// 	return nil, fmt.Errorf("通过SOCKS5代理连接目标失败: %w", err)
-	// }
-
-	// 将SOCKS拨号器转换为支持Context的接口
-	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
-		// 使用带Context的连接
-		conn, err := contextDialer.DialContext(ctx, "tcp", targetAddr)
-		if err != nil {
-			return nil, fmt.Errorf("contextDialer拨号器失败: %w", err)
+	withConnDialer, ok := socksDialer.(withConnDialer)
+	if !ok {
+		return nil, fmt.Errorf("创建SOCKS5拨号器失败: 不支持DialWithConn")
+	}
+
+	// 3. 连接代理服务器
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, fmt.Errorf("连接代理服务器失败: %w", err)
+	}
+
+	// 4. 在已建立的连接上完成SOCKS5握手
+	// 握手后直接返回底层TCP连接，保留CloseWrite等半关闭能力
+	if _, err := withConnDialer.DialWithConn(ctx, conn, "tcp", targetAddr); err != nil {
+		conn.Close()
+		if isTargetReply(err) {
+			err = fmt.Errorf("%w: %v", ErrRefused, err)
 		}
-		return conn, nil
+		return nil, fmt.Errorf("通过SOCKS5代理连接目标失败: %w", err)
 	}
 
-	return nil, fmt.Errorf("创建ContextDialer拨号器失败")
+	return conn, nil
+}
+
+// withConnDialer 支持在已有连接上完成SOCKS5握手的拨号器
+type withConnDialer interface {
+	DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+}
+
+// isTargetReply 判断握手错误是否为代理服务器回复的目标不可达
+func isTargetReply(err error) bool {
+	msg := err.Error()
+	for _, r := range targetReplies {
+		if strings.HasSuffix(msg, "unknown error "+r) {
+			return true
+		}
+	}
+	return false
 }
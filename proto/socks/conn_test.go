@@ -0,0 +1,67 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"transparent/proto/dns"
+)
+
+// replyServer 完成无认证握手后回复指定的结果
+func replyServer(t *testing.T, rep byte) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// 版本和认证方法
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0})
+
+		// 请求头和IPv4目标地址
+		buf = make([]byte, 10)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		conn.Write([]byte{5, rep, 0, 1, 0, 0, 0, 0, 0, 0})
+	}()
+	return ln.Addr().String()
+}
+
+func TestGetConnReply(t *testing.T) {
+	tests := []struct {
+		rep     byte
+		refused bool
+	}{
+		{0x01, false}, // 一般性失败
+		{0x02, true},
+		{0x03, true},
+		{0x04, true},
+		{0x05, true},
+		{0x07, false}, // 不支持的命令
+	}
+	for _, tt := range tests {
+		addr := replyServer(t, tt.rep)
+		_, err := GetConn(context.Background(), dns.NewDialer(nil), "socks5://"+addr, "127.0.0.1:80")
+		if err == nil {
+			t.Fatalf("rep=%d: expected error", tt.rep)
+		}
+		if errors.Is(err, ErrRefused) != tt.refused {
+			t.Errorf("rep=%d: err = %v, refused = %v", tt.rep, err, tt.refused)
+		}
+	}
+}
@@ -7,22 +7,30 @@ import (
 	"net"
 
 	"github.com/Dreamacro/clash/transport/socks5"
+
+	"transparent/proto/dns"
 )
 
 func GetConn(
 	ctx context.Context,
+	dialer *dns.Dialer,
 	serverAddr string,
 	password string,
 	targetAddr string,
 	sni string,
 	InsecureSkipVerify bool,
 ) (net.Conn, error) {
-	// 解析目标地址为 Socks5 地址格式
-	socks5Addr := socks5.ParseAddr(targetAddr)
+	tlsConn, err := DialTLS(ctx, dialer, serverAddr, sni, InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	return Open(tlsConn, password, targetAddr)
+}
 
-	// 2. 创建TCP拨号器并连接到代理服务器
-	var Dialer net.Dialer
-	conn, err := Dialer.DialContext(ctx, "tcp", serverAddr)
+// DialTLS 连接代理服务器并完成TLS握手，还未写入Trojan头部，可预先建立后通过 Open 使用
+func DialTLS(ctx context.Context, dialer *dns.Dialer, serverAddr string, sni string, InsecureSkipVerify bool) (*tls.Conn, error) {
+	// 通过拨号器连接到代理服务器
+	conn, err := dialer.DialContext(ctx, "tcp", serverAddr)
 	if err != nil {
 		return nil, fmt.Errorf("连接代理服务器失败: %w", err)
 	}
@@ -52,15 +60,39 @@ func GetConn(
 		conn.Close()
 		return nil, fmt.Errorf("Failed to perform TLS handshake: %w", err)
 	}
+	return tlsConn, nil
+}
+
+// Open 在已完成TLS握手的连接上写入Trojan头部，服务端不回复，失败时关闭连接
+func Open(tlsConn *tls.Conn, password string, targetAddr string) (net.Conn, error) {
+	// 解析目标地址为 Socks5 地址格式
+	socks5Addr := socks5.ParseAddr(targetAddr)
 
 	// 计算密码的 SHA224 哈希值
 	hexPassword := hexSha224([]byte(password))
 
 	// 写入 Trojan 头部
 	if err := writeHeader(tlsConn, hexPassword, CommandTCP, socks5Addr); err != nil {
-		conn.Close()
+		tlsConn.Close()
 		return nil, fmt.Errorf("Failed to write Trojan header:  %w", err)
 	}
 
-	return tlsConn, nil
+	return &Conn{Conn: tlsConn}, nil
+}
+
+// Conn Trojan连接
+type Conn struct {
+	*tls.Conn
+}
+
+// CloseWrite 发送TLS close_notify并关闭底层TCP连接的写方向
+func (c *Conn) CloseWrite() error {
+	if err := c.Conn.CloseWrite(); err != nil {
+		return err
+	}
+
+	if cw, ok := c.Conn.NetConn().(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
 }
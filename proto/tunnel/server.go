@@ -0,0 +1,177 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"transparent/proto/mux"
+)
+
+const (
+	// handshakeTimeout 服务端等待客户端请求的超时
+	handshakeTimeout = 10 * time.Second
+
+	// dialTimeout 服务端连接目标的超时
+	dialTimeout = 10 * time.Second
+
+	// maxTargetLen 目标地址的最大长度
+	maxTargetLen = 1024
+)
+
+// Server oks和bss共用的服务端，每个连接先读取长度前缀的目标地址，连接目标成功后回复ok并双向转发
+// 目标地址为 mux.Target 时在该连接上运行多路复用会话，每个流按同样的协议处理
+type Server struct {
+	// 连接目标使用的拨号函数，为nil时使用net.Dialer
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// 多路复用会话配置
+	Mux mux.Config
+
+	// 拒绝多路复用协商，客户端改用独立连接
+	DisableMux bool
+
+	// 解码请求中的目标地址，为nil时按原文处理
+	Decode func(b []byte) (string, error)
+
+	// 包装回复ok之后的独立连接和多路复用的承载连接，流中的数据不再包装，为nil时不包装
+	Wrap func(conn net.Conn) net.Conn
+}
+
+// Serve 接受连接直到监听关闭
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn 处理一个客户端连接
+func (s *Server) ServeConn(conn net.Conn) {
+	s.serve(conn, false)
+}
+
+// serve 处理一个连接或多路复用的流，流中不允许再次协商多路复用
+func (s *Server) serve(conn net.Conn, stream bool) {
+	defer conn.Close()
+
+	// 1. 读取目标地址
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	target, err := s.readRequest(conn)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// 2. 多路复用协商
+	if target == mux.Target {
+		if stream || s.DisableMux {
+			writeReply(conn, "不支持多路复用")
+			return
+		}
+		if writeReply(conn, "ok") != nil {
+			return
+		}
+		sess := mux.Server(s.wrap(conn), s.Mux)
+		defer sess.Close()
+		for {
+			st, err := sess.AcceptStream()
+			if err != nil {
+				return
+			}
+			go s.serve(st, true)
+		}
+	}
+
+	// 3. 连接目标并转发
+	dst, err := s.dial(target)
+	if err != nil {
+		writeReply(conn, err.Error())
+		return
+	}
+	defer dst.Close()
+	if writeReply(conn, "ok") != nil {
+		return
+	}
+	if !stream {
+		conn = s.wrap(conn)
+	}
+	pipe(conn, dst)
+}
+
+// dial 连接目标地址
+func (s *Server) dial(target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	if s.Dial != nil {
+		return s.Dial(ctx, "tcp", target)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", target)
+}
+
+// wrap 按协议包装连接
+func (s *Server) wrap(conn net.Conn) net.Conn {
+	if s.Wrap == nil {
+		return conn
+	}
+	return s.Wrap(conn)
+}
+
+// readRequest 读取并解码客户端请求的目标地址
+func (s *Server) readRequest(conn net.Conn) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > maxTargetLen {
+		return "", fmt.Errorf("目标地址长度错误: %d", n)
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	if s.Decode == nil {
+		return string(buf), nil
+	}
+	return s.Decode(buf)
+}
+
+// writeReply 回复客户端，成功时为ok，否则为错误原因
+func writeReply(conn net.Conn, msg string) error {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(msg)))
+	_, err := conn.Write(append(buf, msg...))
+	return err
+}
+
+// pipe 双向转发，一个方向结束时半关闭另一端的写方向，两个方向都结束后返回
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	half := func(dst, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil {
+			a.Close()
+			b.Close()
+			return
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go half(a, b)
+	go half(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,185 @@
+package tunnel_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"transparent/proto/bss"
+	"transparent/proto/dns"
+	"transparent/proto/mux"
+	"transparent/proto/oks"
+)
+
+// protocol 使用同一服务端流程的协议
+type protocol struct {
+	scheme     string
+	serve      func(disableMux bool) func(net.Conn)
+	getConn    func(ctx context.Context, dialer *dns.Dialer, s, target string) (net.Conn, error)
+	dialMux    func(ctx context.Context, dialer *dns.Dialer, s string) (net.Conn, error)
+	openStream func(ctx context.Context, pool *mux.Pool, target string) (net.Conn, error)
+	refused    error
+}
+
+var protocols = []protocol{
+	{
+		scheme: "oks",
+		serve: func(disableMux bool) func(net.Conn) {
+			return (&oks.Server{DisableMux: disableMux}).ServeConn
+		},
+		getConn:    oks.GetConn,
+		dialMux:    oks.DialMux,
+		openStream: oks.OpenStream,
+		refused:    oks.ErrRefused,
+	},
+	{
+		scheme: "bss",
+		serve: func(disableMux bool) func(net.Conn) {
+			return (&bss.Server{DisableMux: disableMux}).ServeConn
+		},
+		getConn:    bss.GetConn,
+		dialMux:    bss.DialMux,
+		openStream: bss.OpenStream,
+		refused:    bss.ErrRefused,
+	},
+}
+
+// listen 在本地端口运行handler
+func listen(t *testing.T, handler func(net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echoTarget 把收到的数据原样发回的目标服务器
+func echoTarget(t *testing.T) string {
+	return listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+}
+
+// roundTrip 发送数据并读取回显
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, []byte(msg)) {
+		t.Fatalf("got %q, err=%v", buf, err)
+	}
+}
+
+func TestGetConn(t *testing.T) {
+	for _, p := range protocols {
+		t.Run(p.scheme, func(t *testing.T) {
+			target := echoTarget(t)
+			proxyURL := p.scheme + "://" + listen(t, p.serve(false))
+
+			conn, err := p.getConn(context.Background(), dns.NewDialer(nil), proxyURL, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			roundTrip(t, conn, "hello")
+
+			// 服务端连接目标失败时回复错误
+			if _, err := p.getConn(context.Background(), dns.NewDialer(nil), proxyURL, "127.0.0.1:1"); !errors.Is(err, p.refused) {
+				t.Fatalf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestMux(t *testing.T) {
+	for _, p := range protocols {
+		t.Run(p.scheme, func(t *testing.T) {
+			target := echoTarget(t)
+
+			var mu sync.Mutex
+			conns := 0
+			serve := p.serve(false)
+			proxyURL := p.scheme + "://" + listen(t, func(conn net.Conn) {
+				mu.Lock()
+				conns++
+				mu.Unlock()
+				serve(conn)
+			}) + "?mux=1"
+
+			cfg, ok, err := mux.ParseURL(proxyURL)
+			if err != nil || !ok {
+				t.Fatal(ok, err)
+			}
+			dialer := dns.NewDialer(nil)
+			pool := mux.NewPool(cfg, func(ctx context.Context) (net.Conn, error) {
+				return p.dialMux(ctx, dialer, proxyURL)
+			})
+			defer pool.Close()
+
+			// 多个流共用一个连接
+			var wg sync.WaitGroup
+			for range 10 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					conn, err := p.openStream(context.Background(), pool, target)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer conn.Close()
+					roundTrip(t, conn, "hello mux")
+				}()
+			}
+			wg.Wait()
+			mu.Lock()
+			n := conns
+			mu.Unlock()
+			if n != 1 {
+				t.Fatalf("conns = %d", n)
+			}
+
+			// 流中目标连接失败只影响该流
+			if _, err := p.openStream(context.Background(), pool, "127.0.0.1:1"); !errors.Is(err, p.refused) {
+				t.Fatalf("err = %v", err)
+			}
+			if s := pool.Stats(); s.Sessions != 1 {
+				t.Fatalf("unexpected stats: %+v", s)
+			}
+		})
+	}
+}
+
+func TestMuxUnsupported(t *testing.T) {
+	for _, p := range protocols {
+		t.Run(p.scheme, func(t *testing.T) {
+			proxyURL := p.scheme + "://" + listen(t, p.serve(true))
+
+			dialer := dns.NewDialer(nil)
+			pool := mux.NewPool(mux.PoolConfig{Conns: 1}, func(ctx context.Context) (net.Conn, error) {
+				return p.dialMux(ctx, dialer, proxyURL)
+			})
+			if _, err := p.openStream(context.Background(), pool, "127.0.0.1:1"); !errors.Is(err, mux.ErrUnsupported) {
+				t.Fatalf("err = %v", err)
+			}
+		})
+	}
+}
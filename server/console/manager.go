@@ -2,14 +2,17 @@ package console
 
 import (
 	"context"
+	"errors"
 	"sync"
 
 	"go.uber.org/zap"
 
 	"transparent/config"
-
 	"transparent/log"
+
+	"transparent/proto/dns"
 	"transparent/tProxy"
+	"transparent/utils/health"
 	"transparent/utils/taskConsumerManager"
 )
 
@@ -24,33 +27,120 @@ var NewManager = sync.OnceValue(func() *manager {
 
 // manager 结构体管理整个代理服务的核心组件
 type manager struct {
-	tcm *taskConsumerManager.Manager // 任务调度管理器
+	tcm     *taskConsumerManager.Manager // 任务调度管理器
+	proxyMu sync.RWMutex
+	proxy   tProxy.Manager // 当前运行的代理
 }
 
 // Start 启动代理服务的各个组件
 func (m *manager) Start() error {
+	// 全局DNS解析器
+	resolver, err := dns.New(config.GetConf().Dns)
+	if err != nil {
+		return err
+	}
+	dns.SetDefault(resolver)
+
 	proxyJson := &tProxy.ProxyJson{}
 	proxyJson.ProxyUrl = config.GetConf().ProxyUrl
 	proxyJson.ProxyType = config.GetConf().ProxyType
 	proxyJson.TrojanProxy = config.GetConf().TrojanProxy
+	proxyJson.Dns = config.GetConf().ProxyDns
+	proxyJson.Inbound = config.GetConf().Inbound
+	proxyJson.DisableCapture = config.GetConf().DisableCapture
+	proxyJson.Interfaces = config.GetConf().Interfaces
+	proxyJson.Gateway = config.GetConf().Gateway
+	proxyJson.Bypass = config.GetConf().Bypass
+	proxyJson.Rules = config.GetConf().Rules
+	proxyJson.Geo = config.GetConf().Geo
+	proxyJson.KillSwitch = config.GetConf().KillSwitch
+	proxyJson.Upstreams = config.GetConf().Upstreams
+	proxyJson.Group = config.GetConf().Group
+	proxyJson.HealthCheck = config.GetConf().HealthCheck
+	proxyJson.Breaker = config.GetConf().Breaker
+	proxyJson.Retry = config.GetConf().Retry
+	proxyJson.Warm = config.GetConf().Warm
+	proxyJson.DelayHandshake = config.GetConf().DelayHandshake
+	proxyJson.DelayHandshakeDropTimeout = config.GetConf().DelayHandshakeDropTimeout
+	proxyJson.HalfCloseTimeout = config.GetConf().HalfCloseTimeout
+	proxyJson.SwitchPolicy = config.GetConf().SwitchPolicy
+	proxyJson.SwitchDrainTimeout = config.GetConf().SwitchDrainTimeout
+	proxyJson.UpstreamPortRange = config.GetConf().UpstreamPortRange
+	proxyJson.DrainTimeout = config.GetConf().DrainTimeout
+	proxyJson.RestartBackoff = config.GetConf().RestartBackoff
+	proxyJson.RestartMaxBackoff = config.GetConf().RestartMaxBackoff
+	proxyJson.RestartMaxAttempts = config.GetConf().RestartMaxAttempts
+	proxyJson.Workers = config.GetConf().Workers
+	proxyJson.WorkerQueueSize = config.GetConf().WorkerQueueSize
+	proxyJson.Bandwidth = config.GetConf().Bandwidth
+	proxyJson.ProxyBandwidth = config.GetConf().ProxyBandwidth
+	proxyJson.UpstreamBandwidth = config.GetConf().UpstreamBandwidth
+	proxyJson.ConnBandwidth = config.GetConf().ConnBandwidth
+	proxyJson.ProcessBandwidth = config.GetConf().ProcessBandwidth
+	proxyJson.RuleBandwidth = config.GetConf().RuleBandwidth
+	proxyJson.DialTimeout = config.GetConf().DialTimeout
+	proxyJson.ProxyHandshakeTimeout = config.GetConf().ProxyHandshakeTimeout
+	proxyJson.FirstByteTimeout = config.GetConf().FirstByteTimeout
+	proxyJson.UploadIdleTimeout = config.GetConf().UploadIdleTimeout
+	proxyJson.DownloadIdleTimeout = config.GetConf().DownloadIdleTimeout
+	proxyJson.MaxLifetime = config.GetConf().MaxLifetime
+	proxyJson.DisableKeepAlive = config.GetConf().DisableKeepAlive
+	proxyJson.KeepAliveIdle = config.GetConf().KeepAliveIdle
+	proxyJson.KeepAliveInterval = config.GetConf().KeepAliveInterval
+	proxyJson.KeepAliveCount = config.GetConf().KeepAliveCount
+	proxyJson.Stack = config.GetConf().Stack
+
+	// 由监督者运行代理，启动失败或异常退出时按退避时长自动重启
+	s := tProxy.NewSupervisor(proxyJson)
+	m.proxyMu.Lock()
+	m.proxy = s
+	m.proxyMu.Unlock()
 
 	m.tcm.AddTask(1, func(ctx context.Context) {
-		t := tProxy.NewManager(proxyJson)
-		eCh, err := t.Start()
+		eCh, err := s.Start()
 		if err != nil {
-			log.Error("创建代理对象失败", zap.Error(err))
+			// 健康状态已标记为failed，状态接口和界面可以看到原因
+			log.Error("启动代理失败", zap.Error(err))
+			<-ctx.Done()
 			return
 		}
-		defer t.Stop()
 		select {
 		case <-ctx.Done():
+			s.Drain() // 优雅关闭，等待已有连接结束
 		case <-eCh:
+			// 超过最大重启次数，保持阻断直到服务停止，不再重复启动
+			<-ctx.Done()
+			s.Stop()
 		}
 	})
 
 	return nil
 }
 
+// Status 返回代理运行状态
+func (m *manager) Status() tProxy.Status {
+	m.proxyMu.RLock()
+	defer m.proxyMu.RUnlock()
+
+	if m.proxy == nil {
+		return tProxy.Status{}
+	}
+	return m.proxy.Status()
+}
+
+// TestUpstream 立即测试指定上游的延迟，名称为空时测试当前上游
+func (m *manager) TestUpstream(name string) (health.Result, error) {
+	m.proxyMu.RLock()
+	proxy := m.proxy
+	m.proxyMu.RUnlock()
+
+	// 探测可能持续数秒，不持有锁
+	if proxy == nil {
+		return health.Result{}, errors.New("代理未运行")
+	}
+	return proxy.TestUpstream(name)
+}
+
 // Stop 停止所有服务组件
 func (m *manager) Stop() {
 	m.tcm.Stop() // 停止任务消费者管理器，会触发所有任务的优雅关闭
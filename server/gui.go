@@ -5,6 +5,8 @@ package server
 
 import (
 	. "transparent/server/gui"
+	"transparent/tProxy"
+	"transparent/utils/health"
 )
 
 func Start() error {
@@ -14,3 +16,11 @@ func Start() error {
 func Stop() {
 	NewManager().Stop()
 }
+
+func Status() tProxy.Status {
+	return NewManager().Status()
+}
+
+func TestUpstream(name string) (health.Result, error) {
+	return NewManager().TestUpstream(name)
+}
@@ -2,9 +2,11 @@ package gui
 
 import (
 	//"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"sync"
+	"time"
 
 	//	"go.uber.org/zap"
 
@@ -12,6 +14,7 @@ import (
 
 	//	"transparent/log"
 	"transparent/tProxy"
+	"transparent/utils/health"
 	"transparent/utils/taskConsumerManager"
 
 	"fyne.io/fyne/v2"
@@ -88,26 +91,64 @@ func (m *manager) Start() error {
 			return
 		}
 
+		// 已在运行时只切换上游，捕获和协议栈保持运行，已建立的连接不受影响
+		// 创建上游需要解析代理服务器域名，在后台切换，避免阻塞界面和状态刷新
+		m.proxyMu.RLock()
+		running := m.proxtT
+		m.proxyMu.RUnlock()
+		if running != nil && !failed(running) {
+			m.startBut.Disable()
+			go func() {
+				err := running.UpdateProxy(proxyJson)
+				fyne.Do(func() {
+					m.startBut.Enable()
+					if err != nil {
+						dialog.ShowError(err, w)
+					}
+				})
+			}()
+			return
+		}
+
 		m.proxyMu.Lock()
+		defer m.proxyMu.Unlock()
+		if m.proxtT != nil && !failed(m.proxtT) {
+			return // 其他操作已启动
+		}
 		if m.proxtT != nil {
-			m.proxtT.Stop()
+			m.proxtT.Stop() // 放弃重启的代理一直保持阻断，重新启动前停止
+			m.proxtT = nil
 		}
-		proxtT := tProxy.NewManager(proxyJson)
-		m.proxtT = proxtT
-		m.proxyMu.Unlock()
 
+		// 由监督者运行代理，异常退出时自动重启，状态显示在窗口下方
+		proxtT := tProxy.NewSupervisor(proxyJson)
 		eCh, err := proxtT.Start()
 		if err != nil {
 			proxtT.Stop()
 			dialog.ShowError(err, w)
-		} else {
-			m.startBut.Disable()
-			go func() {
-				<-eCh
-				proxtT.Stop()
-				fmt.Println("代理关闭")
-			}()
+			return
 		}
+		m.proxtT = proxtT
+		m.startBut.SetText("切换")
+		go func() {
+			<-eCh
+			// 放弃重启时不停止监督者，阻断保持到用户取消或重新启动
+			if h := proxtT.Health(); h.State == tProxy.HealthFailed {
+				fyne.Do(func() {
+					m.startBut.SetText("启动")
+					dialog.ShowError(fmt.Errorf("代理多次异常退出(%s): %s", h.Reason, h.Error), w)
+				})
+				return
+			}
+			proxtT.Stop()
+			m.proxyMu.Lock()
+			if m.proxtT == proxtT {
+				m.proxtT = nil
+				fyne.Do(func() { m.startBut.SetText("启动") })
+			}
+			m.proxyMu.Unlock()
+			fmt.Println("代理关闭")
+		}()
 	})
 
 	m.cancelBut = widget.NewButton("取消", func() {
@@ -117,14 +158,25 @@ func (m *manager) Start() error {
 		}
 		m.proxtT = nil
 		m.proxyMu.Unlock()
-		m.startBut.Enable()
+		m.startBut.SetText("启动")
 		fmt.Println("代理关闭")
 	})
 
+	// 测试当前上游的延迟
+	latencyLabel := widget.NewLabel("")
+	testBut := widget.NewButton("测速", func() {
+		latencyLabel.SetText("测速中...")
+		go func() {
+			text := latencyText(m.TestUpstream(""))
+			fyne.Do(func() { latencyLabel.SetText(text) })
+		}()
+	})
+
 	// 创建按钮容器，水平排列并居中
 	buttonContainer := container.NewHBox(
 		m.startBut,
 		m.cancelBut,
+		testBut,
 	)
 
 	// 使用Border布局，将按钮容器居中
@@ -134,10 +186,16 @@ func (m *manager) Start() error {
 		buttonContainer,
 	)
 
+	// 运行状态
+	statusLabel := widget.NewLabel("")
+	go m.runStatus(statusLabel)
+
 	// 主容器，垂直排列输入框和按钮行
 	content := container.NewVBox(
 		input,
 		buttonWrapper,
+		statusLabel,
+		latencyLabel,
 	)
 
 	w.SetContent(content)
@@ -152,6 +210,78 @@ func (m *manager) Start() error {
 	return nil
 }
 
+// failed 代理是否已放弃重启
+func failed(p tProxy.Manager) bool {
+	h := p.Status().Health
+	return h != nil && h.State == tProxy.HealthFailed
+}
+
+// runStatus 定期刷新运行状态
+func (m *manager) runStatus(label *widget.Label) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		text := statusText(m.Status())
+		fyne.Do(func() { label.SetText(text) })
+	}
+}
+
+// statusText 运行状态的显示文本
+func statusText(s tProxy.Status) string {
+	if s.Health == nil {
+		return "未运行"
+	}
+
+	switch s.Health.State {
+	case tProxy.HealthRunning:
+		return fmt.Sprintf("运行中  连接数: %d", s.Active)
+	case tProxy.HealthRestarting:
+		return fmt.Sprintf("异常(%s)，%s后第%d次重启",
+			s.Health.Reason, time.Until(s.Health.NextRetry).Round(time.Second), s.Health.Attempts)
+	case tProxy.HealthFailed:
+		return fmt.Sprintf("已停止重启(%s): %s", s.Health.Reason, s.Health.Error)
+	case tProxy.HealthStarting:
+		return "启动中"
+	default:
+		return "未运行"
+	}
+}
+
+// latencyText 测速结果的显示文本
+func latencyText(r health.Result, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	if !r.OK() {
+		return "测速失败: " + r.Error
+	}
+	return fmt.Sprintf("延迟: %d ms", r.Latency)
+}
+
+// TestUpstream 立即测试指定上游的延迟，名称为空时测试当前上游
+func (m *manager) TestUpstream(name string) (health.Result, error) {
+	m.proxyMu.RLock()
+	proxtT := m.proxtT
+	m.proxyMu.RUnlock()
+
+	if proxtT == nil {
+		return health.Result{}, errors.New("代理未运行")
+	}
+	return proxtT.TestUpstream(name)
+}
+
+// Status 返回代理运行状态
+func (m *manager) Status() tProxy.Status {
+	m.proxyMu.RLock()
+	defer m.proxyMu.RUnlock()
+
+	if m.proxtT == nil {
+		return tProxy.Status{}
+	}
+	return m.proxtT.Status()
+}
+
 // Stop 停止所有服务组件
 func (m *manager) Stop() {
 	m.proxyMu.RLock()
@@ -0,0 +1,88 @@
+package tProxy
+
+import (
+	"github.com/shirou/gopsutil/process"
+	"go.uber.org/zap"
+
+	"transparent/log"
+	"transparent/utils/bandwidth"
+)
+
+// loadBandwidth 将配置的带宽限制写入全局限速器集合，之后可通过控制接口调整
+// 全局限速器集合在重启后保留，已设置过(包括通过控制接口调整)的限速不被配置覆盖
+func (m *manager) loadBandwidth() {
+	r := bandwidth.Default()
+
+	if m.proxyJson.Bandwidth != nil {
+		r.SetDefault(bandwidth.ScopeGlobal, "", *m.proxyJson.Bandwidth)
+	}
+	for name, cfg := range m.proxyJson.UpstreamBandwidth {
+		r.SetDefault(bandwidth.ScopeProxy, name, cfg)
+	}
+	if m.proxyJson.ProxyBandwidth != nil { // 单独设置过的上游不再使用
+		for _, up := range m.upstreams() {
+			if up.usesProxy() {
+				r.SetDefault(bandwidth.ScopeProxy, up.name, *m.proxyJson.ProxyBandwidth)
+			}
+		}
+	}
+	if m.proxyJson.ConnBandwidth != nil {
+		r.SetDefault(bandwidth.ScopeConn, "", *m.proxyJson.ConnBandwidth)
+	}
+	for name, cfg := range m.proxyJson.ProcessBandwidth {
+		r.SetDefault(bandwidth.ScopeProcess, name, cfg)
+	}
+	for name, cfg := range m.proxyJson.RuleBandwidth {
+		r.SetDefault(bandwidth.ScopeRule, name, cfg)
+	}
+}
+
+// limiters 返回连接需要经过的限速器
+// up: 连接使用的上游，经过代理服务器时使用该上游的限速器
+// proxied: 是否经过代理服务器
+// process: 发起连接的进程名，未知(如本地代理入站)时为空
+// names: 命中的路由规则的名称，未命中时为空，合并的规则使用第一个设置了限速的名称
+func (m *manager) limiters(up *upstream, proxied bool, process string, names []string) []*bandwidth.Limiter {
+	r := bandwidth.Default()
+
+	var ls []*bandwidth.Limiter
+	if l := r.Get(bandwidth.ScopeGlobal, ""); l != nil {
+		ls = append(ls, l)
+	}
+	if proxied {
+		if l := r.Get(bandwidth.ScopeProxy, up.name); l != nil {
+			ls = append(ls, l)
+		}
+	}
+	if process != "" {
+		if l := r.Get(bandwidth.ScopeProcess, process); l != nil {
+			ls = append(ls, l)
+		}
+	}
+	for _, name := range names {
+		if l := r.Get(bandwidth.ScopeRule, name); l != nil {
+			ls = append(ls, l)
+			break
+		}
+	}
+	if l := r.NewConn(); l != nil {
+		ls = append(ls, l)
+	}
+
+	return ls
+}
+
+// processName 返回进程的可执行文件名，查询失败时返回空字符串
+func processName(pid int32) string {
+	p, err := process.NewProcess(pid)
+	if err != nil {
+		return ""
+	}
+
+	name, err := p.Name()
+	if err != nil {
+		log.Debug("查询进程名失败", zap.Int32("pid", pid), zap.Error(err))
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,136 @@
+package tProxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"transparent/log"
+	"transparent/proto/bss"
+	"transparent/proto/http"
+	"transparent/proto/oks"
+	"transparent/proto/socks"
+	"transparent/utils/breaker"
+)
+
+// ErrBreakerOpen 上游处于熔断状态，连接未经尝试直接失败
+var ErrBreakerOpen = errors.New("上游已熔断")
+
+// immediateResetWindow 连接建立后该时长内未收到数据即被重置，视为上游故障
+// 正常关闭(EOF)可能是目标或客户端先关闭，不计入
+const immediateResetWindow = 2 * time.Second
+
+// errNoVerdict 连接结束但无法判断上游是否正常
+var errNoVerdict = errors.New("无法判断连接结果")
+
+// newBreaker 创建上游的熔断器，直连的上游不熔断
+func (m *manager) newBreaker(up *upstream) *breaker.Breaker {
+	if !up.usesProxy() {
+		return nil
+	}
+
+	b := breaker.New(m.proxyJson.Breaker)
+	if b != nil {
+		b.OnChange = func(from, to breaker.State) { m.breakerChanged(up, from, to) }
+	}
+	return b
+}
+
+// reportUpstream 把经过上游连接的结果计入熔断器
+// 只有与代理服务器之间的传输和握手失败(拨号、TLS、认证、协议错误和超时)计入
+// 目标不可达、连接循环、上游已被回收和无法判断的结果不计入，只归还试探名额
+func (m *manager) reportUpstream(up *upstream, token breaker.Token, err error) {
+	switch {
+	case err == nil:
+		up.breaker.Success(token)
+	case targetRefused(err), errors.Is(err, ErrSelfConnection), errors.Is(err, errNoVerdict), up.ctx.Err() != nil:
+		up.breaker.Release(token)
+	default:
+		log.Debug("上游连接失败", zap.String("upstream", up.name), zap.Error(err))
+		up.breaker.Failure(token)
+	}
+}
+
+// targetRefused 判断错误是否为代理服务器回复的目标不可达，代理服务器本身可用
+func targetRefused(err error) bool {
+	return errors.Is(err, socks.ErrRefused) ||
+		errors.Is(err, http.ErrRefused) ||
+		errors.Is(err, oks.ErrRefused) ||
+		errors.Is(err, bss.ErrRefused)
+}
+
+// breakerChanged 上游熔断状态变化时重新选择上游并更新阻断模式
+func (m *manager) breakerChanged(up *upstream, from, to breaker.State) {
+	if up.ctx.Err() != nil {
+		return
+	}
+
+	fields := []zap.Field{zap.String("upstream", up.name), zap.Stringer("from", from), zap.Stringer("to", to)}
+	switch to {
+	case breaker.Open:
+		log.Warn("上游熔断", append(fields, zap.Int("trips", int(up.breaker.Stats().Trips)))...)
+	case breaker.HalfOpen:
+		log.Info("上游熔断冷却结束，开始试探", fields...)
+		// 主动探测一次作为试探连接，当前上游被阻断时没有其他流量可以试探
+		go m.health.Check(up.ctx, up.name)
+	case breaker.Closed:
+		log.Info("上游恢复可用", fields...)
+	}
+
+	m.selectUpstream()
+	m.kill.setHealthy(m.available(m.currentUpstream()))
+}
+
+// watchedConn 经过上游的连接，根据第一次读取的结果判断上游是否正常
+// 收到数据为成功，读超时和建立后立即被重置为失败，被正常关闭无法判断
+type watchedConn struct {
+	net.Conn
+	start  time.Time
+	once   sync.Once
+	report func(err error)
+}
+
+// watchConn 包装经过上游的连接，第一次读取的结果交给report
+func watchConn(conn net.Conn, report func(err error)) net.Conn {
+	return &watchedConn{Conn: conn, start: time.Now(), report: report}
+}
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	switch {
+	case n > 0:
+		c.done(nil)
+	case err == nil:
+	case errors.Is(err, net.ErrClosed):
+		c.done(errNoVerdict)
+	case isTimeout(err):
+		c.done(err)
+	case errors.Is(err, io.EOF):
+		c.done(errNoVerdict) // 目标关闭或客户端半关闭后服务端关闭
+	case time.Since(c.start) < immediateResetWindow:
+		c.done(fmt.Errorf("连接建立后立即被重置: %w", err))
+	default:
+		c.done(errNoVerdict)
+	}
+	return n, err
+}
+
+// CloseWrite 半关闭写方向
+func (c *watchedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *watchedConn) Close() error {
+	c.done(errNoVerdict)
+	return c.Conn.Close()
+}
+
+// done 只报告第一次的结果
+func (c *watchedConn) done(err error) {
+	c.once.Do(func() { c.report(err) })
+}
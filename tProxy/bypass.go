@@ -0,0 +1,182 @@
+package tProxy
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"transparent/log"
+	"transparent/proto/dns"
+)
+
+const (
+	// maxFilterPrefixes 编译进WinDivert过滤规则的最大网段数，过滤规则长度有限，超出部分在用户态判断
+	maxFilterPrefixes = 64
+
+	// bypassResolveInterval 重新解析直连域名的间隔
+	bypassResolveInterval = 5 * time.Minute
+)
+
+// builtinBypass 内置的直连网段: RFC1918私有网段、CGNAT、链路本地、组播、广播和本网络
+var builtinBypass = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+	"0.0.0.0/8",
+}
+
+// bypassList 不经过代理的目标地址
+type bypassList struct {
+	prefixes []netip.Prefix // 直连网段，前 maxFilterPrefixes 个编译进过滤规则
+	domains  []string       // 直连域名
+
+	// 直连域名解析出的地址，定期整体替换
+	resolved atomic.Pointer[map[[4]byte]struct{}]
+}
+
+// newBypassList 解析直连配置
+func (m *manager) newBypassList() (*bypassList, error) {
+	cfg := m.proxyJson.Bypass
+
+	var cidrs []string
+	if !cfg.DisableBuiltin {
+		cidrs = append(cidrs, builtinBypass...)
+	}
+	cidrs = append(cidrs, cfg.CIDRs...)
+
+	prefixes, ipv6, err := parsePrefixes(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("直连网段错误 error:%w", err)
+	}
+	if len(ipv6) > 0 {
+		log.Warn("直连列表只支持IPv4网段，已忽略IPv6网段", zap.Strings("cidrs", ipv6))
+	}
+
+	b := &bypassList{prefixes: prefixes}
+	for _, d := range cfg.Domains {
+		if d = strings.TrimSuffix(strings.TrimSpace(d), "."); d != "" {
+			b.domains = append(b.domains, d)
+		}
+	}
+	b.resolved.Store(&map[[4]byte]struct{}{})
+
+	if len(prefixes) > maxFilterPrefixes {
+		log.Info("直连网段过多，超出部分在用户态判断", zap.Int("count", len(prefixes)), zap.Int("filter", maxFilterPrefixes))
+	}
+	return b, nil
+}
+
+// match 判断目标地址是否直连
+// 编译进过滤规则的网段不会被捕获，这里同时检查以覆盖超出过滤规则长度的网段、直连域名和过滤规则更新前的连接
+func (b *bypassList) match(dst [4]byte) bool {
+	if b == nil {
+		return false
+	}
+
+	addr := netip.AddrFrom4(dst)
+	for _, p := range b.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	_, ok := (*b.resolved.Load())[dst]
+	return ok
+}
+
+// filter 生成排除直连目标的WinDivert过滤条件，servers为需要同时排除的代理服务器地址
+func (b *bypassList) filter(servers []netip.Prefix) string {
+	var ps []netip.Prefix
+	if b != nil {
+		ps = b.prefixes[:min(len(b.prefixes), maxFilterPrefixes)]
+	}
+	ps = append(ps[:len(ps):len(ps)], servers...)
+	if len(ps) == 0 {
+		return ""
+	}
+	return "not " + prefixFilter("ip.DstAddr", ps)
+}
+
+// resolve 解析直连域名，解析失败的域名保留上次的结果
+func (b *bypassList) resolve(ctx context.Context) {
+	old := *b.resolved.Load()
+	resolved := make(map[[4]byte]struct{}, len(old))
+
+	var failed bool
+	for _, d := range b.domains {
+		ips, err := dns.Default().LookupIP(ctx, "ip4", d)
+		if err != nil {
+			log.Debug("解析直连域名失败", zap.String("domain", d), zap.Error(err))
+			failed = true
+			continue
+		}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				resolved[[4]byte(ip4)] = struct{}{}
+			}
+		}
+	}
+	if failed {
+		for ip := range old {
+			resolved[ip] = struct{}{}
+		}
+	}
+
+	b.resolved.Store(&resolved)
+}
+
+// runBypassResolve 定期解析直连域名，直到ctx取消
+func (m *manager) runBypassResolve(ctx context.Context) {
+	ticker := time.NewTicker(bypassResolveInterval)
+	defer ticker.Stop()
+
+	for {
+		m.bypass.resolve(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// serverPrefixes 返回分组中所有上游的代理服务器地址，编译进过滤规则
+func (m *manager) serverPrefixes() []netip.Prefix {
+	var ps []netip.Prefix
+	seen := map[netip.Addr]bool{}
+	for _, up := range m.upstreams() {
+		up.serverMu.Lock()
+		for ap := range up.servers {
+			if addr := ap.Addr(); addr.Is4() && !seen[addr] {
+				seen[addr] = true
+				ps = append(ps, netip.PrefixFrom(addr, 32))
+			}
+		}
+		up.serverMu.Unlock()
+	}
+	return ps
+}
+
+// prefixFilter 生成匹配任一网段的WinDivert过滤条件
+func prefixFilter(field string, ps []netip.Prefix) string {
+	conds := make([]string, len(ps))
+	for i, p := range ps {
+		first, last := prefixRange(p)
+		if first == last {
+			conds[i] = fmt.Sprintf("%s = %s", field, first)
+		} else {
+			conds[i] = fmt.Sprintf("(%s >= %s and %s <= %s)", field, first, field, last)
+		}
+	}
+	return "(" + strings.Join(conds, " or ") + ")"
+}
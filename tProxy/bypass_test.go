@@ -0,0 +1,134 @@
+package tProxy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// newTestBypass 按直连配置创建直连列表
+func newTestBypass(t *testing.T, disableBuiltin bool, cidrs ...string) *bypassList {
+	m := &manager{proxyJson: &ProxyJson{}}
+	m.proxyJson.Bypass.DisableBuiltin = disableBuiltin
+	m.proxyJson.Bypass.CIDRs = cidrs
+	b, err := m.newBypassList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBypassFilter(t *testing.T) {
+	tests := []struct {
+		name           string
+		disableBuiltin bool
+		cidrs          []string
+		servers        []string
+		want           string
+	}{
+		{
+			name:           "empty",
+			disableBuiltin: true,
+			want:           "",
+		},
+		{
+			name:           "servers only",
+			disableBuiltin: true,
+			servers:        []string{"1.2.3.4/32"},
+			want:           "not (ip.DstAddr = 1.2.3.4)",
+		},
+		{
+			name:           "user cidrs and servers",
+			disableBuiltin: true,
+			cidrs:          []string{"203.0.113.0/24", "198.51.100.7", "fd00::/8"}, // IPv6被忽略
+			servers:        []string{"1.2.3.4/32"},
+			want:           "not ((ip.DstAddr >= 203.0.113.0 and ip.DstAddr <= 203.0.113.255) or ip.DstAddr = 198.51.100.7 or ip.DstAddr = 1.2.3.4)",
+		},
+		{
+			name:  "builtin",
+			cidrs: []string{"198.51.100.7"},
+			want:  "not (" + builtinAllow + " or ip.DstAddr = 198.51.100.7)",
+		},
+	}
+	for _, tt := range tests {
+		b := newTestBypass(t, tt.disableBuiltin, tt.cidrs...)
+		var servers []netip.Prefix
+		for _, s := range tt.servers {
+			servers = append(servers, netip.MustParsePrefix(s))
+		}
+		if got := b.filter(servers); got != tt.want {
+			t.Errorf("%s: filter() = %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+
+	// 未开启直连时只排除代理服务器
+	var b *bypassList
+	if got := b.filter([]netip.Prefix{netip.MustParsePrefix("1.2.3.4/32")}); got != "not (ip.DstAddr = 1.2.3.4)" {
+		t.Errorf("nil bypass: filter() = %s", got)
+	}
+}
+
+func TestBypassMaxFilterPrefixes(t *testing.T) {
+	// 超出过滤规则长度的网段不编译进过滤规则，在用户态判断
+	var cidrs []string
+	for i := range maxFilterPrefixes + 6 {
+		cidrs = append(cidrs, fmt.Sprintf("203.0.%d.1", i))
+	}
+	b := newTestBypass(t, true, cidrs...)
+	servers := []netip.Prefix{netip.MustParsePrefix("1.2.3.4/32")}
+
+	f := b.filter(servers)
+	if n := strings.Count(f, "ip.DstAddr = "); n != maxFilterPrefixes+1 {
+		t.Fatalf("filter has %d prefixes, want %d", n, maxFilterPrefixes+1)
+	}
+	if strings.Contains(f, fmt.Sprintf("203.0.%d.1", maxFilterPrefixes)) || !strings.Contains(f, "1.2.3.4") {
+		t.Fatalf("filter = %s", f)
+	}
+	// 过滤规则不能修改直连网段
+	if len(b.prefixes) != maxFilterPrefixes+6 {
+		t.Fatalf("prefixes = %d", len(b.prefixes))
+	}
+
+	tests := []struct {
+		dst  string
+		want bool
+	}{
+		{"203.0.0.1", true},
+		{fmt.Sprintf("203.0.%d.1", maxFilterPrefixes-1), true},
+		{fmt.Sprintf("203.0.%d.1", maxFilterPrefixes), true}, // 超出过滤规则的网段
+		{fmt.Sprintf("203.0.%d.1", maxFilterPrefixes+5), true},
+		{"203.0.0.2", false},
+		{"1.2.3.4", false}, // 代理服务器由过滤规则排除，不属于直连目标
+	}
+	for _, tt := range tests {
+		if got := b.match(netip.MustParseAddr(tt.dst).As4()); got != tt.want {
+			t.Errorf("match(%s) = %v, want %v", tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestBypassMatchResolved(t *testing.T) {
+	b := newTestBypass(t, false)
+	b.resolved.Store(&map[[4]byte]struct{}{{93, 184, 216, 34}: {}})
+
+	tests := []struct {
+		dst  string
+		want bool
+	}{
+		{"192.168.1.1", true}, // 内置网段
+		{"100.100.1.1", true},
+		{"93.184.216.34", true}, // 直连域名解析出的地址
+		{"8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		if got := b.match(netip.MustParseAddr(tt.dst).As4()); got != tt.want {
+			t.Errorf("match(%s) = %v, want %v", tt.dst, got, tt.want)
+		}
+	}
+
+	var nilList *bypassList
+	if nilList.match([4]byte{192, 168, 1, 1}) {
+		t.Error("nil bypass list should not match")
+	}
+}
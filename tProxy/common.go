@@ -1,8 +1,13 @@
 package tProxy
 
 import (
-	"sync"
-	"time"
+	"transparent/proto/dns"
+	"transparent/proto/mixed"
+	"transparent/utils/bandwidth"
+	"transparent/utils/breaker"
+	"transparent/utils/health"
+	"transparent/utils/rules"
+	"transparent/utils/warm"
 )
 
 type ProxyJson struct {
@@ -30,106 +35,193 @@ type ProxyJson struct {
 
 		InsecureSkipVerify bool
 	}
-}
 
-// item 存储缓存值和过期时间
-type item struct {
-	expiration int64 // UnixNano 时间戳
-}
+	// 解析代理服务器域名使用的DNS配置，为空时使用全局解析器
+	// 备选上游使用相同的配置，每个上游各自创建解析器和缓存
+	Dns *dns.Config
 
-// TTLMap 带过期时间的线程安全Map
-type TTLMap struct {
-	mm    map[string]*item
-	ttl   time.Duration // 默认过期时间
-	mu    sync.Mutex    // 用于清理操作的锁
-	start func()
-	done  chan struct{}
-}
+	// 本地混合(SOCKS5/HTTP)代理入站配置，为空时不监听
+	Inbound *mixed.Config
 
-// NewTTLMap 创建一个新的TTLMap
-func NewTTLMap(defaultTTL time.Duration) *TTLMap {
-	m := &TTLMap{
-		ttl:  defaultTTL,
-		done: make(chan struct{}),
-	}
+	// 关闭数据包捕获，仅使用本地代理入站
+	DisableCapture bool
 
-	m.start = sync.OnceFunc(func() {
-		m.mm = map[string]*item{}
-
-		go func() {
-			ticker := time.NewTicker(3 * time.Second)
-			defer close(m.done)
-			defer ticker.Stop()
-			for {
-				select {
-				case m.done <- struct{}{}:
-					return
-				case <-ticker.C:
-					m.mu.Lock()
-					if m.mm != nil {
-						for k, v := range m.mm {
-							if time.Now().UnixNano() >= v.expiration {
-								delete(m.mm, k)
-							}
-						}
-					}
-					m.mu.Unlock()
-				}
-			}
-		}()
-	})
-
-	return m
-}
+	// 捕获数据包的网卡，按网卡名(不区分大小写)或索引指定，"*" 表示所有已启用的非回环网卡
+	// 为空时使用默认路由所在的网卡
+	Interfaces []string
 
-func (m *TTLMap) Start() {
-	m.start()
-}
+	// 网关模式: 代理其他设备(手机、主机、容器等)以本机为网关转发的TCP连接
+	// Subnets 为需要代理的源网段(如 192.168.1.0/24)，为空时不开启；Exclude 为不代理的源地址或网段
+	// 转发的UDP(包括DNS和QUIC)不经过代理，BlockUDP 为true时丢弃这些网段转发到直连列表以外目标的UDP，
+	// QUIC随之回退为经过代理的TCP
+	Gateway struct {
+		Subnets  []string
+		Exclude  []string
+		BlockUDP bool
+	}
 
-func (m *TTLMap) Stop() {
-	m.mu.Lock()
-	m.mm = nil
-	m.mu.Unlock()
+	// 不经过代理的目标，内置私有网段(RFC1918、CGNAT、链路本地、组播)和代理服务器地址
+	Bypass struct {
+		// 关闭内置的私有网段直连
+		DisableBuiltin bool
 
-	for range m.done {
-	}
-}
+		// 直连的目标网段或地址
+		CIDRs []string
 
-// Set 添加或更新键值对
-func (m *TTLMap) Set(key string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if m.mm != nil {
-		m.mm[key] = &item{
-			expiration: time.Now().Add(m.ttl).UnixNano(),
-		}
+		// 直连的域名，定期解析为IP
+		Domains []string
 	}
-}
 
-// Get 获取值并可选续期
-func (m *TTLMap) Get(key string) bool {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if m.mm == nil {
-		return false
-	}
+	// 路由规则，按顺序匹配，格式为 类型,值,动作(PROXY/DIRECT/REJECT)，如 "GEOIP,CN,DIRECT"、"GEOSITE,google,PROXY"
+	// 未命中任何规则时经过代理，为空时不做路由
+	Rules []string
+
+	// 路由规则使用的GeoIP(mmdb)和GeoSite(geosite.dat或文本域名列表目录)数据库
+	Geo rules.GeoConfig
 
-	if it, ok := m.mm[key]; !ok {
-		return false
-	} else {
-		it.expiration = time.Now().Add(m.ttl).UnixNano()
+	// 阻断模式: 没有可用上游(连续连接失败)或代理异常停止期间丢弃所有出站和转发的数据包，包括直连规则和直连列表的流量
+	// 本地网络(私有网段、链路本地、组播)和代理服务器地址始终放行，Allow 为额外放行的目标网段或地址(如公网DNS服务器)
+	KillSwitch struct {
+		Enable bool
+		Allow  []string
 	}
 
-	return true
-}
+	// 备选上游，格式与界面输入相同，如 "socks5://127.0.0.1:1080#本地"、"trojan://密码@host:443?sni=域名#香港"
+	// #之后为上游名称，默认上游(ProxyType等字段)的名称为default
+	Upstreams []string
 
-// Delete 删除键
-func (m *TTLMap) Delete(key string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if m.mm == nil {
-		return
+	// 上游分组策略: fallback(默认，按顺序使用第一个健康检查可用的上游)、url-test(使用延迟最低的上游) 或 select(固定使用默认上游)
+	Group string
+
+	// 上游健康检查，定期经过每个上游请求探测地址，记录延迟、抖动和成功率
+	HealthCheck health.Config
+
+	// 上游熔断: 连接失败、握手超时或建立后立即被重置连续达到 Failures 次时熔断，冷却 Cooldown 秒内该上游的连接直接失败，
+	// 分组中有其他可用上游时切换过去，之后半开放行 Trials 个试探连接，成功则恢复、失败则重新熔断
+	Breaker breaker.Config
+
+	// 经过代理连接目标失败时，在本地程序的数据发出前依次换用分组中其他可用的上游重试
+	// Attempts 为最多尝试的上游数(包括第一次)，为0时使用默认值3，为1时不重试；Budget 为所有尝试的总时长(秒)，为0时使用默认值30
+	Retry struct {
+		Attempts int
+		Budget   int
 	}
 
-	delete(m.mm, key)
+	// 预连接: 为trojan、oks和bss上游预先建立 Size 个完成传输层握手的连接，新连接取用后只需发送目标地址，取用后在后台补充
+	// 空闲超过 MaxIdle 秒(默认30)的连接关闭后重新建立，应小于代理服务器的空闲超时；开启多路复用的上游不使用
+	Warm warm.Config
+
+	// 延迟握手: 上游连接成功后才与本地程序完成TCP握手
+	// 关闭时先完成握手再连接上游，上游不可用时本地程序会看到连接成功后立即被关闭
+	DelayHandshake bool
+
+	// 延迟握手模式下上游连接失败时丢弃SYN的时长(秒)，为0时立即回复RST
+	DelayHandshakeDropTimeout int
+
+	// 一个方向半关闭后等待另一方向结束的最长时间(秒)，为0时使用默认值60
+	HalfCloseTimeout int
+
+	// 切换上游时已建立连接的处理策略: keep(默认，继续使用旧上游直到结束) 或 drain(等待一段时间后关闭)
+	SwitchPolicy string
+
+	// drain策略下关闭旧连接前等待的时长(秒)，为0时立即关闭
+	SwitchDrainTimeout int
+
+	// 连接上游时绑定的本地端口范围(如 "40000-40999")，捕获时直接排除该范围内的源端口，为空时不绑定
+	UpstreamPortRange string
+
+	// 优雅关闭时等待已有连接结束的时长(秒)，为0时使用默认值10，为负数时不等待
+	DrainTimeout int
+
+	// 异常退出后第一次重启前的等待时长(秒)，之后按指数增长，为0时使用默认值1
+	RestartBackoff int
+
+	// 重启等待时长的上限(秒)，为0时使用默认值60
+	RestartMaxBackoff int
+
+	// 连续失败的最大重启次数，为0时不限制
+	RestartMaxAttempts int
+
+	// 数据包处理协程数，为0时使用CPU核数
+	Workers int
+
+	// 每个处理协程的队列长度，为0时使用默认值1024
+	WorkerQueueSize int
+
+	// 全局带宽限制，所有被代理的连接共享
+	Bandwidth *bandwidth.Config
+
+	// 经过代理服务器的连接的带宽限制，每个上游分别限速，经过同一上游的连接共享
+	ProxyBandwidth *bandwidth.Config
+
+	// 按上游的带宽限制，key为上游名称(默认上游为default)，覆盖 ProxyBandwidth
+	UpstreamBandwidth map[string]bandwidth.Config
+
+	// 每个连接单独的带宽限制
+	ConnBandwidth *bandwidth.Config
+
+	// 按进程的带宽限制，key为可执行文件名(如 chrome.exe，不区分大小写)，同一进程的连接共享
+	ProcessBandwidth map[string]bandwidth.Config
+
+	// 按路由规则的带宽限制，key为规则原文(与 Rules 中的写法相同)，命中同一规则的连接共享
+	RuleBandwidth map[string]bandwidth.Config
+
+	// 连接代理服务器或直连目标的单次拨号超时(秒)，为0时使用默认值10
+	DialTimeout int
+
+	// 拨号完成后与代理服务器握手的超时(秒)，为0时使用默认值10
+	ProxyHandshakeTimeout int
+
+	// 转发开始后等待目标返回首字节的超时(秒)，为0时不限制
+	FirstByteTimeout int
+
+	// 上传/下载方向的空闲超时(秒)，该方向超过该时长未读到数据且另一方向同样空闲时关闭连接，为0时不限制
+	UploadIdleTimeout   int
+	DownloadIdleTimeout int
+
+	// 连接的最长存活时间(秒)，为0时不限制
+	MaxLifetime int
+
+	// 关闭上游连接和协议栈连接的TCP保活
+	DisableKeepAlive bool
+
+	// TCP保活参数: 空闲多久后开始探测(秒)、探测间隔(秒)、探测次数，为0时使用默认值15、15、9
+	KeepAliveIdle     int
+	KeepAliveInterval int
+	KeepAliveCount    int
+
+	// 协议栈调优参数，为0时使用默认值
+	Stack struct {
+		// 通道端点队列长度(数据包)，默认512
+		QueueSize int
+
+		// 最大同时握手中的连接数，默认32768
+		MaxInFlight int
+
+		// 新连接的初始接收窗口(字节)，默认16KB
+		ReceiveWindow int
+
+		// TCP接收/发送缓冲区范围(字节)，默认 4KB/1MB/4MB
+		ReceiveBufferMin     int
+		ReceiveBufferDefault int
+		ReceiveBufferMax     int
+		SendBufferMin        int
+		SendBufferDefault    int
+		SendBufferMax        int
+
+		// 关闭接收缓冲区自动调整
+		DisableModerateReceiveBuffer bool
+
+		// 开启SACK
+		SACK bool
+
+		// 拥塞控制算法: reno(默认) 或 cubic
+		CongestionControl string
+
+		// GRO超时(微秒)，为0时不开启GRO
+		GROTimeout int
+
+		// 开启延迟ACK，默认每个数据段立即ACK
+		DelayedAck bool
+	}
 }
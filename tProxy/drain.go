@@ -0,0 +1,174 @@
+package tProxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"transparent/log"
+)
+
+const (
+	// DefaultDrainTimeout 优雅关闭时等待连接结束的默认时长(秒)
+	DefaultDrainTimeout = 10
+
+	// drainProgressInterval 优雅关闭期间输出进度的间隔
+	drainProgressInterval = time.Second
+
+	// drainFlushTimeout 重置剩余连接后等待RST发出的最长时间
+	drainFlushTimeout = time.Second
+)
+
+// Status 代理运行状态
+type Status struct {
+	Running  bool // 是否正在运行
+	Draining bool // 是否处于优雅关闭阶段
+	Active   int  // 正在转发的连接数
+	Flows    int  // 连接跟踪表中的连接数
+
+	// 健康状态，仅由 Supervisor 填写
+	Health *Health `json:",omitempty"`
+
+	// 阻断模式是否正在阻断，仅由 Supervisor 填写
+	KillSwitch bool `json:",omitempty"`
+
+	// 上游分组中各上游的状态和健康检查结果
+	Upstreams []UpstreamStatus `json:",omitempty"`
+}
+
+// activeConn 正在转发的连接
+// 注销与强制关闭互斥，保证连接关闭后不会再被强制关闭
+type activeConn struct {
+	mu    sync.Mutex
+	done  bool
+	abort func() // 强制关闭，向本地程序发送RST
+}
+
+// track 登记正在转发的连接，返回注销函数
+func (m *manager) track(abort func()) func() {
+	c := &activeConn{abort: abort}
+
+	m.connMu.Lock()
+	m.conns[c] = struct{}{}
+	m.connMu.Unlock()
+
+	return func() {
+		m.connMu.Lock()
+		delete(m.conns, c)
+		m.connMu.Unlock()
+
+		c.mu.Lock()
+		c.done = true
+		c.mu.Unlock()
+	}
+}
+
+// activeConns 返回正在转发的连接数
+func (m *manager) activeConns() int {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	return len(m.conns)
+}
+
+// abortConns 强制关闭所有正在转发的连接
+func (m *manager) abortConns() {
+	m.connMu.Lock()
+	conns := make([]*activeConn, 0, len(m.conns))
+	for c := range m.conns {
+		conns = append(conns, c)
+	}
+	m.connMu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		if !c.done {
+			c.abort()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// abortTCPConn 以RST关闭本地代理入站连接
+func abortTCPConn(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// drainTimeout 优雅关闭时等待连接结束的时长，配置为负数时不等待
+func (m *manager) drainTimeout() time.Duration {
+	if m.proxyJson.DrainTimeout < 0 {
+		return 0
+	}
+	return seconds(m.proxyJson.DrainTimeout, DefaultDrainTimeout*time.Second)
+}
+
+// Drain 优雅关闭
+// 1. 不再接管新连接: 新的SYN原样转发，本地代理入站不再接受连接
+// 2. 等待已有连接结束，直到超时
+// 3. 超时后向仍未结束的本地程序发送RST
+// 4. 停止所有组件
+func (m *manager) Drain() {
+	defer m.Stop()
+
+	if !m.draining.CompareAndSwap(false, true) {
+		return
+	}
+
+	timeout := m.drainTimeout()
+	log.Info("开始优雅关闭", zap.Int("active", m.activeConns()), zap.Duration("timeout", timeout))
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainProgressInterval)
+	defer ticker.Stop()
+
+Loop:
+	for m.activeConns() > 0 {
+		select {
+		case <-deadline.C:
+			break Loop
+		case <-m.tcm.Context().Done():
+			return
+		case <-ticker.C:
+			log.Info("等待连接结束", zap.Int("active", m.activeConns()))
+		}
+	}
+
+	if n := m.activeConns(); n > 0 {
+		log.Warn("优雅关闭超时，重置剩余连接", zap.Int("active", n))
+		m.abortConns()
+		m.waitFlush()
+	}
+
+	log.Info("优雅关闭完成")
+}
+
+// waitFlush 等待协议栈发出的RST经WinDivert发送完毕
+func (m *manager) waitFlush() {
+	if m.channelEp == nil {
+		return
+	}
+
+	deadline := time.Now().Add(drainFlushTimeout)
+	for (m.activeConns() > 0 || m.channelEp.NumQueued() > 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Status 返回当前运行状态
+func (m *manager) Status() Status {
+	s := Status{
+		Running:  m.tcm.Context().Err() == nil,
+		Draining: m.draining.Load(),
+		Active:   m.activeConns(),
+	}
+	if m.flows != nil {
+		s.Flows = m.flows.len()
+	}
+	s.Upstreams = m.upstreamStatus()
+	return s
+}
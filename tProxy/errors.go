@@ -0,0 +1,44 @@
+package tProxy
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// 代理异常退出的原因
+var (
+	ErrDriverMissing     = errors.New("WinDivert驱动不可用")
+	ErrInterfaceNotFound = errors.New("未找到出口网络接口")
+	ErrHandleClosed      = errors.New("WinDivert句柄已关闭")
+)
+
+// 异常原因的简短标识，用于日志和控制接口
+const (
+	ReasonDriverMissing     = "driver_missing"
+	ReasonInterfaceNotFound = "interface_not_found"
+	ReasonHandleClosed      = "handle_closed"
+	ReasonUnknown           = "unknown"
+)
+
+// Reason 返回错误对应的异常原因标识
+func Reason(err error) string {
+	switch {
+	case errors.Is(err, ErrDriverMissing):
+		return ReasonDriverMissing
+	case errors.Is(err, ErrInterfaceNotFound):
+		return ReasonInterfaceNotFound
+	case errors.Is(err, ErrHandleClosed):
+		return ReasonHandleClosed
+	default:
+		return ReasonUnknown
+	}
+}
+
+// isDriverError 判断打开WinDivert失败是否因为驱动或DLL缺失
+func isDriverError(err error) bool {
+	return errors.Is(err, windows.ERROR_FILE_NOT_FOUND) ||
+		errors.Is(err, windows.ERROR_MOD_NOT_FOUND) ||
+		errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) ||
+		errors.Is(err, windows.ERROR_SERVICE_DISABLED)
+}
@@ -0,0 +1,215 @@
+package tProxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"transparent/gvisor.dev/gvisor/pkg/tcpip/header"
+	"transparent/gvisor.dev/gvisor/pkg/tcpip/network/hash"
+	"transparent/gvisor.dev/gvisor/pkg/tcpip/stack"
+	"transparent/gvisor.dev/gvisor/pkg/tcpip/transport/tcpconntrack"
+)
+
+const (
+	// flowConnectTimeout 握手未完成的连接保留时长，需覆盖SYN重传和延迟握手的丢弃时长
+	flowConnectTimeout = 2 * time.Minute
+
+	// flowTimeWait 连接关闭(FIN/RST)后保留的时长，用于转发最后的ACK和重传的FIN
+	flowTimeWait = 60 * time.Second
+
+	// flowSweepInterval 清理过期连接的间隔
+	flowSweepInterval = 3 * time.Second
+)
+
+// flowKey 连接四元组，方向为本地程序发出的方向(original)
+type flowKey struct {
+	srcAddr [4]byte
+	dstAddr [4]byte
+	srcPort uint16
+	dstPort uint16
+}
+
+// newFlowKey 从本地程序发出的数据包中提取四元组
+func newFlowKey(ipv4 header.IPv4, tcpHdr header.TCP) flowKey {
+	return flowKey{
+		srcAddr: ipv4.SourceAddress().As4(),
+		dstAddr: ipv4.DestinationAddress().As4(),
+		srcPort: tcpHdr.SourcePort(),
+		dstPort: tcpHdr.DestinationPort(),
+	}
+}
+
+// newReplyFlowKey 从协议栈回复给本地程序的数据包中提取四元组(转换为original方向)
+func newReplyFlowKey(ipv4 header.IPv4, tcpHdr header.TCP) flowKey {
+	return flowKey{
+		srcAddr: ipv4.DestinationAddress().As4(),
+		dstAddr: ipv4.SourceAddress().As4(),
+		srcPort: tcpHdr.DestinationPort(),
+		dstPort: tcpHdr.SourcePort(),
+	}
+}
+
+// newStackFlowKey 从协议栈连接ID中提取四元组(转换为original方向)
+func newStackFlowKey(id stack.TransportEndpointID) flowKey {
+	return flowKey{
+		srcAddr: id.RemoteAddress.As4(),
+		dstAddr: id.LocalAddress.As4(),
+		srcPort: id.RemotePort,
+		dstPort: id.LocalPort,
+	}
+}
+
+// hash 计算四元组的Jenkins哈希
+func (k flowKey) hash(seed uint32) uint32 {
+	return hash.Hash3Words(
+		uint32(k.srcAddr[0])<<24|uint32(k.srcAddr[1])<<16|uint32(k.srcAddr[2])<<8|uint32(k.srcAddr[3]),
+		uint32(k.dstAddr[0])<<24|uint32(k.dstAddr[1])<<16|uint32(k.dstAddr[2])<<8|uint32(k.dstAddr[3]),
+		uint32(k.srcPort)<<16|uint32(k.dstPort),
+		seed,
+	)
+}
+
+// flowIface 连接被捕获时所在的网卡，协议栈的回复从同一网卡注入
+type flowIface struct {
+	ifIdx    uint32
+	subIfIdx uint32
+	forward  bool // 网关模式下其他设备经本机转发的连接
+}
+
+// flow 单个被代理的连接
+type flow struct {
+	tcb tcpconntrack.TCB
+
+	// 过期时间，零值表示连接已建立、不会因空闲而过期
+	expiration time.Time
+
+	// 已收到FIN/RST，处于TIME_WAIT
+	closing bool
+
+	// 发起连接的进程，未找到时为0
+	pid int32
+
+	// 捕获SYN的网卡
+	iface flowIface
+}
+
+// update 根据状态机结果更新过期时间
+func (f *flow) update(res tcpconntrack.Result, now time.Time) {
+	switch res {
+	case tcpconntrack.ResultAlive:
+		if !f.closing {
+			f.expiration = time.Time{}
+		}
+	case tcpconntrack.ResultReset,
+		tcpconntrack.ResultClosedByOriginator,
+		tcpconntrack.ResultClosedByResponder:
+		// 进入TIME_WAIT，仅在第一次关闭时设置
+		if !f.closing {
+			f.closing = true
+			f.expiration = now.Add(flowTimeWait)
+		}
+	}
+}
+
+// flowTable 基于tcpconntrack状态机的连接跟踪表
+// 已建立的连接一直保留，直到FIN/RST后经过TIME_WAIT才删除
+type flowTable struct {
+	mu sync.Mutex
+	mm map[flowKey]*flow
+}
+
+func newFlowTable() *flowTable {
+	return &flowTable{
+		mm: map[flowKey]*flow{},
+	}
+}
+
+// add 收到本地程序的SYN时创建连接，已存在时(SYN重传)保持原状态
+// 处于TIME_WAIT的四元组被复用时重新初始化
+func (t *flowTable) add(key flowKey, syn header.TCP, dataLen int, pid int32, iface flowIface) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if f, ok := t.mm[key]; ok && !f.closing {
+		return
+	}
+
+	f := &flow{expiration: time.Now().Add(flowConnectTimeout), pid: pid, iface: iface}
+	f.tcb.Init(syn, dataLen)
+	t.mm[key] = f
+}
+
+// updateOriginal 处理本地程序发出的数据包，返回该连接是否被代理
+func (t *flowTable) updateOriginal(key flowKey, tcpHdr header.TCP, dataLen int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.mm[key]
+	if !ok {
+		return false
+	}
+
+	f.update(f.tcb.UpdateStateOriginal(tcpHdr, dataLen), time.Now())
+	return true
+}
+
+// updateReply 处理协议栈回复给本地程序的数据包，key为original方向
+// 返回连接所在的网卡，未跟踪的连接返回false
+func (t *flowTable) updateReply(key flowKey, tcpHdr header.TCP, dataLen int) (flowIface, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.mm[key]
+	if !ok {
+		return flowIface{}, false
+	}
+
+	f.update(f.tcb.UpdateStateReply(tcpHdr, dataLen), time.Now())
+	return f.iface, true
+}
+
+// pid 返回发起连接的进程，未跟踪或未知时为0
+func (t *flowTable) pid(key flowKey) int32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if f, ok := t.mm[key]; ok {
+		return f.pid
+	}
+	return 0
+}
+
+// len 返回当前跟踪的连接数
+func (t *flowTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.mm)
+}
+
+// sweep 删除已过期的连接
+func (t *flowTable) sweep(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k, f := range t.mm {
+		if !f.expiration.IsZero() && !now.Before(f.expiration) {
+			delete(t.mm, k)
+		}
+	}
+}
+
+// run 定期清理过期连接，直到ctx取消
+func (t *flowTable) run(ctx context.Context) {
+	ticker := time.NewTicker(flowSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.sweep(now)
+		}
+	}
+}
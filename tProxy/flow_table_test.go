@@ -0,0 +1,164 @@
+package tProxy
+
+import (
+	"testing"
+	"time"
+
+	"transparent/gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// segment 构造不带数据的TCP头部
+func segment(flags header.TCPFlags, seq, ack uint32) header.TCP {
+	h := header.TCP(make([]byte, header.TCPMinimumSize))
+	h.Encode(&header.TCPFields{
+		SrcPort:    50000,
+		DstPort:    443,
+		SeqNum:     seq,
+		AckNum:     ack,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	return h
+}
+
+// flowStep 一个数据包，reply为协议栈回复给本地程序的方向
+type flowStep struct {
+	reply bool
+	h     header.TCP
+}
+
+// 本地程序的初始序号为100，协议栈的初始序号为500
+var handshake = []flowStep{
+	{true, segment(header.TCPFlagSyn|header.TCPFlagAck, 500, 101)},
+	{false, segment(header.TCPFlagAck, 101, 501)},
+}
+
+func TestFlowTableTransitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []flowStep
+		closing bool
+		idle    bool // 已建立，不会因空闲而过期
+	}{
+		{name: "syn", closing: false, idle: false},
+		{name: "syn-ack", steps: handshake[:1], closing: false, idle: true}, // 协议栈回复SYN-ACK后即视为已建立
+		{name: "established", steps: handshake, closing: false, idle: true},
+		{name: "half closed by originator", steps: append(handshake[:2:2],
+			flowStep{false, segment(header.TCPFlagFin|header.TCPFlagAck, 101, 501)},
+			flowStep{true, segment(header.TCPFlagAck, 501, 102)},
+		), closing: false, idle: true},
+		{name: "closed by originator", steps: append(handshake[:2:2],
+			flowStep{false, segment(header.TCPFlagFin|header.TCPFlagAck, 101, 501)},
+			flowStep{true, segment(header.TCPFlagFin|header.TCPFlagAck, 501, 102)},
+			flowStep{false, segment(header.TCPFlagAck, 102, 502)},
+		), closing: true},
+		{name: "closed by responder", steps: append(handshake[:2:2],
+			flowStep{true, segment(header.TCPFlagFin|header.TCPFlagAck, 501, 101)},
+			flowStep{false, segment(header.TCPFlagFin|header.TCPFlagAck, 101, 502)},
+			flowStep{true, segment(header.TCPFlagAck, 502, 102)},
+		), closing: true},
+		{name: "reset by responder", steps: append(handshake[:2:2],
+			flowStep{true, segment(header.TCPFlagRst|header.TCPFlagAck, 501, 101)},
+		), closing: true},
+		{name: "reset by originator", steps: append(handshake[:2:2],
+			flowStep{false, segment(header.TCPFlagRst, 101, 0)},
+		), closing: true},
+		{name: "refused", steps: []flowStep{
+			{true, segment(header.TCPFlagRst|header.TCPFlagAck, 0, 101)},
+		}, closing: true},
+	}
+
+	key := flowKey{srcAddr: [4]byte{192, 168, 1, 2}, dstAddr: [4]byte{1, 1, 1, 1}, srcPort: 50000, dstPort: 443}
+	for _, tt := range tests {
+		ft := newFlowTable()
+		ft.add(key, segment(header.TCPFlagSyn, 100, 0), 0, 7, flowIface{ifIdx: 3})
+
+		for _, s := range tt.steps {
+			if s.reply {
+				if iface, ok := ft.updateReply(key, s.h, 0); !ok || iface.ifIdx != 3 {
+					t.Fatalf("%s: updateReply = %v %v", tt.name, iface, ok)
+				}
+			} else if !ft.updateOriginal(key, s.h, 0) {
+				t.Fatalf("%s: updateOriginal: flow not tracked", tt.name)
+			}
+		}
+
+		f := ft.mm[key]
+		if f.closing != tt.closing || f.expiration.IsZero() != tt.idle {
+			t.Errorf("%s: closing=%v expiration=%v, want closing=%v idle=%v", tt.name, f.closing, f.expiration, tt.closing, tt.idle)
+		}
+		if ft.pid(key) != 7 {
+			t.Errorf("%s: pid = %d", tt.name, ft.pid(key))
+		}
+
+		// 经过TIME_WAIT后删除关闭的连接，已建立的连接一直保留
+		ft.sweep(time.Now().Add(flowTimeWait))
+		if kept := ft.len() == 1; kept != !tt.closing {
+			t.Errorf("%s: kept after TIME_WAIT = %v", tt.name, kept)
+		}
+	}
+}
+
+func TestFlowTableAdd(t *testing.T) {
+	key := flowKey{srcPort: 50000, dstPort: 443}
+	ft := newFlowTable()
+	ft.add(key, segment(header.TCPFlagSyn, 100, 0), 0, 1, flowIface{})
+	for _, s := range handshake {
+		if s.reply {
+			ft.updateReply(key, s.h, 0)
+		} else {
+			ft.updateOriginal(key, s.h, 0)
+		}
+	}
+
+	// SYN重传不改变已有连接
+	ft.add(key, segment(header.TCPFlagSyn, 100, 0), 0, 2, flowIface{})
+	if f := ft.mm[key]; !f.expiration.IsZero() || ft.pid(key) != 1 {
+		t.Fatalf("retransmitted SYN reset the flow: pid=%d", ft.pid(key))
+	}
+
+	// TIME_WAIT中的四元组被复用时重新初始化
+	ft.updateReply(key, segment(header.TCPFlagRst|header.TCPFlagAck, 501, 101), 0)
+	ft.add(key, segment(header.TCPFlagSyn, 9000, 0), 0, 3, flowIface{})
+	if f := ft.mm[key]; f.closing || ft.pid(key) != 3 {
+		t.Fatalf("reused flow: closing=%v pid=%d", f.closing, ft.pid(key))
+	}
+
+	// 未跟踪的连接
+	other := flowKey{srcPort: 50001, dstPort: 443}
+	if ft.updateOriginal(other, handshake[1].h, 0) {
+		t.Fatal("untracked flow updated")
+	}
+	if _, ok := ft.updateReply(other, handshake[0].h, 0); ok || ft.pid(other) != 0 {
+		t.Fatal("untracked flow updated")
+	}
+}
+
+func TestFlowTableSweep(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		expiration time.Time
+		keep       bool
+	}{
+		{time.Time{}, true}, // 已建立
+		{now.Add(time.Second), true},
+		{now, false},
+		{now.Add(-time.Second), false},
+	}
+
+	ft := newFlowTable()
+	for i, tt := range tests {
+		ft.mm[flowKey{srcPort: uint16(i)}] = &flow{expiration: tt.expiration}
+	}
+	ft.sweep(now)
+
+	for i, tt := range tests {
+		if _, ok := ft.mm[flowKey{srcPort: uint16(i)}]; ok != tt.keep {
+			t.Errorf("expiration %v: kept=%v, want %v", tt.expiration.Sub(now), ok, tt.keep)
+		}
+	}
+	if ft.len() != 2 {
+		t.Fatalf("len = %d", ft.len())
+	}
+}
@@ -0,0 +1,190 @@
+package tProxy
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/lysShub/divert-go"
+	"go.uber.org/zap"
+
+	"transparent/log"
+)
+
+// gatewayRules 网关模式的源地址规则
+type gatewayRules struct {
+	subnets []netip.Prefix // 需要代理的源网段
+	exclude []netip.Prefix // 不代理的源地址，优先于subnets
+}
+
+// newGatewayRules 解析网关模式配置，未配置网段时返回nil
+func newGatewayRules(subnets, exclude []string) (*gatewayRules, error) {
+	if len(subnets) == 0 {
+		return nil, nil
+	}
+
+	r := &gatewayRules{}
+	var err error
+	if r.subnets, err = parseGatewayPrefixes(subnets); err != nil {
+		return nil, err
+	}
+	if r.exclude, err = parseGatewayPrefixes(exclude); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// parseGatewayPrefixes 解析网关模式的源网段，只支持IPv4
+func parseGatewayPrefixes(ss []string) ([]netip.Prefix, error) {
+	ps, ipv6, err := parsePrefixes(ss)
+	if err != nil {
+		return nil, err
+	}
+	if len(ipv6) > 0 {
+		return nil, fmt.Errorf("网关模式仅支持IPv4 subnet:%s", strings.Join(ipv6, ","))
+	}
+	return ps, nil
+}
+
+// parsePrefixes 解析IPv4网段，单个地址按/32处理
+// WinDivert过滤条件只按IPv4地址匹配，IPv6网段不解析，原样返回在ipv6中由调用方决定报错或忽略
+func parsePrefixes(ss []string) (out []netip.Prefix, ipv6 []string, err error) {
+	out = make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		var prefix netip.Prefix
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("网段格式错误 subnet:%s error:%w", s, err)
+			}
+			prefix = p.Masked()
+		} else {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("地址格式错误 addr:%s error:%w", s, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		if !prefix.Addr().Is4() {
+			ipv6 = append(ipv6, s)
+			continue
+		}
+		out = append(out, prefix)
+	}
+	return out, ipv6, nil
+}
+
+// match 判断源地址是否需要代理
+func (r *gatewayRules) match(src [4]byte) bool {
+	addr := netip.AddrFrom4(src)
+	for _, p := range r.exclude {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	for _, p := range r.subnets {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter 生成只捕获配置网段转发流量的WinDivert过滤规则
+func (r *gatewayRules) filter() string {
+	return "ip and tcp and " + prefixFilter("ip.SrcAddr", r.subnets)
+}
+
+// udpFilter 生成匹配需要代理的源地址转发的UDP的WinDivert过滤规则
+func (r *gatewayRules) udpFilter() string {
+	f := "ip and udp and " + prefixFilter("ip.SrcAddr", r.subnets)
+	if len(r.exclude) > 0 {
+		f += " and not " + prefixFilter("ip.SrcAddr", r.exclude)
+	}
+	return f
+}
+
+// prefixRange 返回网段的第一个和最后一个地址
+func prefixRange(p netip.Prefix) (netip.Addr, netip.Addr) {
+	first := p.Masked().Addr().As4()
+	last := first
+	hostBits := 32 - p.Bits()
+	for i := 3; i >= 0 && hostBits > 0; i-- {
+		n := min(hostBits, 8)
+		last[i] |= byte(1<<n - 1)
+		hostBits -= n
+	}
+	return netip.AddrFrom4(first), netip.AddrFrom4(last)
+}
+
+// initGateway 网关模式下打开捕获转发数据包的WinDivert句柄
+func (m *manager) initGateway() error {
+	rules, err := newGatewayRules(m.proxyJson.Gateway.Subnets, m.proxyJson.Gateway.Exclude)
+	if err != nil || rules == nil {
+		return err
+	}
+
+	filter := rules.filter()
+	if f := m.bypass.filter(m.serverPrefixes()); f != "" {
+		filter += " and " + f
+	}
+	handle, err := divert.Open(filter, divert.NetworkForward, -1000, 0)
+	if err != nil {
+		if isDriverError(err) {
+			return fmt.Errorf("%w: 打开WinDivert转发句柄失败 error:%w", ErrDriverMissing, err)
+		}
+		return fmt.Errorf("打开WinDivert转发句柄失败 filter:%s error:%w", filter, err)
+	}
+
+	m.gateway = rules
+	m.fwdHandle = handle
+	log.Info("网关模式已开启", zap.Strings("subnets", m.proxyJson.Gateway.Subnets), zap.Strings("exclude", m.proxyJson.Gateway.Exclude))
+
+	// 转发的UDP不经过代理，开启BlockUDP时丢弃，直连列表中的目标(局域网等)照常转发
+	if !m.proxyJson.Gateway.BlockUDP {
+		log.Warn("网关模式只代理TCP，转发的UDP(包括DNS和QUIC)不经过代理直接发出，可开启 Gateway.BlockUDP 丢弃")
+		return nil
+	}
+	udpFilter := rules.udpFilter()
+	if f := m.bypass.filter(nil); f != "" {
+		udpFilter += " and " + f
+	}
+	if m.fwdUDPHandle, err = divert.Open(udpFilter, divert.NetworkForward, -1000, divert.Drop); err != nil {
+		m.closeForward()
+		return fmt.Errorf("打开WinDivert转发UDP丢弃句柄失败 filter:%s error:%w", udpFilter, err)
+	}
+	return nil
+}
+
+// runReadForward 读取网关模式捕获的转发数据包
+func (m *manager) runReadForward(ctx context.Context) error {
+	// 协议栈的回复需要从出口网卡的句柄注入，等待绑定出口网卡
+	select {
+	case <-m.bound:
+	case <-ctx.Done():
+		return nil
+	}
+
+	return m.readPackets(ctx, func() *divert.Handle { return m.fwdHandle })
+}
+
+// closeForward 关闭转发句柄
+func (m *manager) closeForward() {
+	if m.fwdHandle != nil {
+		m.fwdHandle.Shutdown(divert.Both)
+		m.fwdHandle.Close()
+	}
+	if m.fwdUDPHandle != nil {
+		m.fwdUDPHandle.Close()
+	}
+}
+
+// sendHandle 返回数据包所在层对应的句柄，转发层捕获的数据包只能由转发句柄放行
+func (m *manager) sendHandle(addr *divert.Address) *divert.Handle {
+	if addr.Layer == divert.NetworkForward {
+		return m.fwdHandle
+	}
+	return m.handle.Load()
+}
@@ -0,0 +1,121 @@
+package tProxy
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		in      []string
+		want    []string
+		ipv6    []string
+		wantErr bool
+	}{
+		{in: nil, want: []string{}},
+		{in: []string{"192.168.1.0/24"}, want: []string{"192.168.1.0/24"}},
+		{in: []string{"192.168.1.77/24"}, want: []string{"192.168.1.0/24"}}, // 主机位清零
+		{in: []string{"10.0.0.5"}, want: []string{"10.0.0.5/32"}},           // 单个地址
+		{in: []string{"10.0.0.5", "172.16.0.0/12"}, want: []string{"10.0.0.5/32", "172.16.0.0/12"}},
+		{in: []string{"fd00::/8", "10.0.0.0/8", "::1"}, want: []string{"10.0.0.0/8"}, ipv6: []string{"fd00::/8", "::1"}},
+		{in: []string{"192.168.1.0/33"}, wantErr: true},
+		{in: []string{"not-an-ip"}, wantErr: true},
+		{in: []string{"192.168.1.0/24", "bad"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		ps, ipv6, err := parsePrefixes(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsePrefixes(%q): expected error, got %v", tt.in, ps)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePrefixes(%q): %v", tt.in, err)
+			continue
+		}
+		got := make([]string, len(ps))
+		for i, p := range ps {
+			got[i] = p.String()
+		}
+		if !slices.Equal(got, tt.want) || !slices.Equal(ipv6, tt.ipv6) {
+			t.Errorf("parsePrefixes(%q) = %q %q, want %q %q", tt.in, got, ipv6, tt.want, tt.ipv6)
+		}
+	}
+}
+
+func TestNewGatewayRulesIPv6(t *testing.T) {
+	if _, err := newGatewayRules([]string{"fd00::/8"}, nil); err == nil {
+		t.Fatal("expected IPv6 subnet error")
+	}
+	if _, err := newGatewayRules([]string{"192.168.1.0/24"}, []string{"fd00::1"}); err == nil {
+		t.Fatal("expected IPv6 exclude error")
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	tests := []struct {
+		prefix      string
+		first, last string
+	}{
+		{"192.168.1.0/24", "192.168.1.0", "192.168.1.255"},
+		{"192.168.1.9/32", "192.168.1.9", "192.168.1.9"},
+		{"192.168.1.200/30", "192.168.1.200", "192.168.1.203"},
+		{"172.16.0.0/12", "172.16.0.0", "172.31.255.255"},
+		{"10.1.16.0/20", "10.1.16.0", "10.1.31.255"},
+		{"10.1.17.3/20", "10.1.16.0", "10.1.31.255"}, // 未清零主机位
+		{"0.0.0.0/0", "0.0.0.0", "255.255.255.255"},
+	}
+	for _, tt := range tests {
+		first, last := prefixRange(netip.MustParsePrefix(tt.prefix))
+		if first.String() != tt.first || last.String() != tt.last {
+			t.Errorf("prefixRange(%s) = %s-%s, want %s-%s", tt.prefix, first, last, tt.first, tt.last)
+		}
+	}
+}
+
+func TestGatewayRulesMatch(t *testing.T) {
+	r, err := newGatewayRules(
+		[]string{"192.168.1.0/24", "10.0.0.0/8"},
+		[]string{"192.168.1.1", "192.168.1.200/30"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"192.168.1.2", true},
+		{"192.168.1.255", true},
+		{"10.20.30.40", true},
+		{"192.168.1.1", false},   // 排除的地址
+		{"192.168.1.200", false}, // 排除的网段
+		{"192.168.1.203", false},
+		{"192.168.1.204", true},
+		{"192.168.2.1", false}, // 不在网段内
+		{"172.16.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := r.match(netip.MustParseAddr(tt.src).As4()); got != tt.want {
+			t.Errorf("match(%s) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestGatewayRulesUDPFilter(t *testing.T) {
+	r, err := newGatewayRules([]string{"192.168.1.0/24"}, []string{"192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ip and udp and ((ip.SrcAddr >= 192.168.1.0 and ip.SrcAddr <= 192.168.1.255)) and not (ip.SrcAddr = 192.168.1.1)"
+	if got := r.udpFilter(); got != want {
+		t.Fatalf("udpFilter() = %s", got)
+	}
+
+	if r, _ = newGatewayRules([]string{"10.0.0.1"}, nil); r.udpFilter() != "ip and udp and (ip.SrcAddr = 10.0.0.1)" {
+		t.Fatalf("udpFilter() = %s", r.udpFilter())
+	}
+}
@@ -0,0 +1,256 @@
+package tProxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"transparent/log"
+	"transparent/proto/dns"
+	"transparent/proto/mux"
+	"transparent/utils/breaker"
+	"transparent/utils/health"
+	"transparent/utils/warm"
+)
+
+// 上游分组的选择策略
+const (
+	groupFallback = "fallback" // 按顺序使用第一个可用的上游(默认)
+	groupURLTest  = "url-test" // 使用延迟最低的可用上游
+	groupSelect   = "select"   // 固定使用默认上游，不自动切换
+)
+
+// defaultUpstreamName 默认上游(ProxyType、ProxyUrl等字段)的名称
+const defaultUpstreamName = "default"
+
+// urlTestTolerance url-test策略下延迟比当前上游低超过该值(毫秒)才切换，避免频繁切换
+const urlTestTolerance = 50
+
+// UpstreamStatus 上游状态
+type UpstreamStatus struct {
+	Name    string
+	Type    string `json:",omitempty"` // 代理类型，直连时为空
+	Current bool   // 是否为当前使用的上游
+	Health  health.Stats
+	Breaker breaker.Stats  // 熔断状态，直连的上游不熔断
+	Mux     *mux.PoolStats `json:",omitempty"` // 多路复用连接池，未开启时为空
+	Warm    *warm.Stats    `json:",omitempty"` // 预连接池，未开启时为空
+}
+
+// groupStrategy 上游分组的选择策略
+func (m *manager) groupStrategy() string {
+	if m.proxyJson.Group == "" {
+		return groupFallback
+	}
+	return m.proxyJson.Group
+}
+
+// initUpstreams 创建默认上游和备选上游，并登记到健康检查
+func (m *manager) initUpstreams() error {
+	switch m.groupStrategy() {
+	case groupFallback, groupURLTest, groupSelect:
+	default:
+		return fmt.Errorf("不支持的上游分组策略: %s", m.proxyJson.Group)
+	}
+
+	// 1. 默认上游
+	up, err := m.newUpstream(m.proxyJson)
+	if err != nil {
+		return err
+	}
+	up.name = defaultUpstreamName
+	members := []*upstream{up}
+
+	// 2. 备选上游，使用与默认上游相同的DNS配置
+	names := map[string]bool{up.name: true}
+	for _, s := range m.proxyJson.Upstreams {
+		name, cfg, err := parseUpstreamURL(s, m.proxyJson.Dns)
+		if err != nil {
+			return err
+		}
+		if names[name] {
+			return fmt.Errorf("上游名称重复: %s", name)
+		}
+		names[name] = true
+
+		u, err := m.newUpstream(cfg)
+		if err != nil {
+			return fmt.Errorf("创建上游失败 name:%s error:%w", name, err)
+		}
+		u.name = name
+		members = append(members, u)
+	}
+
+	m.groupMu.Lock()
+	m.members = members
+	m.groupMu.Unlock()
+	m.upstream.Store(up)
+
+	// 3. 健康检查，每轮检查后按策略选择上游
+	m.health = health.NewChecker(m.proxyJson.HealthCheck)
+	for _, u := range members {
+		m.health.Set(u.name, m.probeDial(u))
+	}
+	m.health.OnRound = m.healthRound
+	return nil
+}
+
+// healthRound 每轮健康检查后选择上游，并按当前上游的探测结果和熔断状态更新阻断模式
+func (m *manager) healthRound() {
+	m.selectUpstream()
+	m.kill.setHealthy(m.available(m.currentUpstream()))
+}
+
+// parseUpstreamURL 解析备选上游地址，格式与界面输入相同
+// socks5://[用户:密码@]host:port、http://host:port、oks://...、bss://...、trojan://密码@host:port?sni=域名&allowInsecure=1
+// #之后为上游名称，为空时使用host:port
+func parseUpstreamURL(s string, dnsCfg *dns.Config) (string, *ProxyJson, error) {
+	raw, name, _ := strings.Cut(strings.TrimSpace(s), "#")
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "", nil, fmt.Errorf("上游地址格式错误: %s", s)
+	}
+	if name, err = url.PathUnescape(name); err != nil || name == "" {
+		name = u.Host
+	}
+
+	cfg := &ProxyJson{Dns: dnsCfg}
+	switch u.Scheme {
+	case "socks", "socks5":
+		cfg.ProxyType, cfg.ProxyUrl = "socks", raw
+	case "http", "oks", "bss":
+		cfg.ProxyType, cfg.ProxyUrl = u.Scheme, raw
+	case "trojan":
+		q := u.Query()
+		cfg.ProxyType = "trojan"
+		cfg.TrojanProxy.Server = u.Host
+		cfg.TrojanProxy.Password = u.User.Username()
+		cfg.TrojanProxy.Domain = q.Get("sni")
+		if cfg.TrojanProxy.Domain == "" {
+			cfg.TrojanProxy.Domain = u.Hostname()
+		}
+		cfg.TrojanProxy.InsecureSkipVerify = q.Get("allowInsecure") == "1" || q.Get("allowInsecure") == "true"
+	default:
+		return "", nil, fmt.Errorf("不支持的上游类型 %s: %s", u.Scheme, s)
+	}
+	return name, cfg, nil
+}
+
+// upstreams 返回分组中的所有上游，第一个为默认上游
+func (m *manager) upstreams() []*upstream {
+	m.groupMu.Lock()
+	defer m.groupMu.Unlock()
+	return append([]*upstream(nil), m.members...)
+}
+
+// findUpstream 按名称查找上游，名称为空时返回当前上游
+func (m *manager) findUpstream(name string) *upstream {
+	if name == "" {
+		return m.currentUpstream()
+	}
+	for _, u := range m.upstreams() {
+		if u.name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// probeDial 健康检查经过指定上游连接探测地址
+func (m *manager) probeDial(up *upstream) health.DialFunc {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		return m.getConn(ctx, up, addr)
+	}
+}
+
+// available 上游是否可以使用: 最近一次健康检查成功且未熔断
+func (m *manager) available(up *upstream) bool {
+	st, _ := m.health.Stats(up.name)
+	return st.Healthy() && up.breaker.State() != breaker.Open
+}
+
+// selectUpstream 按分组策略、健康检查结果和熔断状态选择当前上游，没有可用上游时保持不变
+func (m *manager) selectUpstream() {
+	members := m.upstreams()
+	if len(members) < 2 || m.groupStrategy() == groupSelect {
+		return
+	}
+
+	m.selectMu.Lock()
+	defer m.selectMu.Unlock()
+	cur := m.currentUpstream()
+
+	var best *upstream
+	var bestLatency int64
+	for _, u := range members {
+		if !m.available(u) {
+			continue
+		}
+		st, _ := m.health.Stats(u.name)
+		if m.groupStrategy() == groupFallback {
+			best = u
+			break
+		}
+
+		// url-test 只比较已有探测结果的上游
+		if st.Samples == 0 || st.Latency == 0 {
+			continue
+		}
+		if best == nil || st.Latency < bestLatency {
+			best, bestLatency = u, st.Latency
+		}
+	}
+	if best == nil || best == cur {
+		return
+	}
+
+	// url-test 当前上游可用且延迟相差不大时不切换
+	if m.groupStrategy() == groupURLTest {
+		if st, _ := m.health.Stats(cur.name); m.available(cur) && st.Latency > 0 && st.Latency-bestLatency <= urlTestTolerance {
+			return
+		}
+	}
+
+	// 已建立的连接继续使用原上游
+	m.upstream.Store(best)
+	m.kill.setHealthy(m.available(best))
+	log.Info("已切换上游", zap.String("from", cur.name), zap.String("to", best.name), zap.String("strategy", m.groupStrategy()))
+}
+
+// upstreamStatus 返回分组中各上游的状态
+func (m *manager) upstreamStatus() []UpstreamStatus {
+	if m.health == nil {
+		return nil
+	}
+	cur := m.currentUpstream()
+
+	var out []UpstreamStatus
+	for _, u := range m.upstreams() {
+		st := UpstreamStatus{Name: u.name, Type: u.cfg.ProxyType, Current: u == cur}
+		st.Health, _ = m.health.Stats(u.name)
+		st.Breaker = u.breaker.Stats()
+		if u.mux != nil {
+			ms := u.mux.Stats()
+			st.Mux = &ms
+		}
+		if u.warm != nil {
+			ws := u.warm.Stats()
+			st.Warm = &ws
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// TestUpstream 立即测试指定上游的延迟，名称为空时测试当前上游
+func (m *manager) TestUpstream(name string) (health.Result, error) {
+	up := m.findUpstream(name)
+	if up == nil || m.health == nil {
+		return health.Result{}, fmt.Errorf("未知的上游: %s", name)
+	}
+	return m.health.Check(m.tcm.Context(), up.name)
+}
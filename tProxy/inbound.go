@@ -0,0 +1,104 @@
+package tProxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+
+	"transparent/log"
+	"transparent/proto/mixed"
+)
+
+// listenInbound 监听本地混合(SOCKS5/HTTP)代理端口，未配置时返回nil
+func (m *manager) listenInbound() (net.Listener, error) {
+	cfg := m.proxyJson.Inbound
+	if cfg == nil || cfg.Listen == "" {
+		return nil, nil
+	}
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("本地代理监听失败 listen:%s error:%w", cfg.Listen, err)
+	}
+
+	log.Info("本地代理已监听", zap.String("listen", ln.Addr().String()))
+
+	return ln, nil
+}
+
+// serveInbound 启动本地代理接收连接任务
+func (m *manager) serveInbound(ln net.Listener) {
+	m.tcm.AddTask(1, func(ctx context.Context) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			m.runInbound(ln, m.proxyJson.Inbound) // 运行接收连接循环
+		}()
+
+		select {
+		case <-ctx.Done():
+			ln.Close()
+			<-done
+		case <-done:
+			return
+		}
+	})
+}
+
+// runInbound 接收本地代理连接
+func (m *manager) runInbound(ln net.Listener, cfg *mixed.Config) {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		// 优雅关闭期间不再接受新连接
+		if m.draining.Load() {
+			conn.Close()
+			continue
+		}
+
+		go m.handleInbound(conn, cfg)
+	}
+}
+
+// handleInbound 处理单个本地代理连接
+func (m *manager) handleInbound(conn net.Conn, cfg *mixed.Config) {
+	defer conn.Close()
+	defer m.track(func() { abortTCPConn(conn) })() // 优雅关闭超时时重置连接
+
+	// 1. 握手获取目标地址
+	req, err := mixed.Handshake(conn, cfg)
+	if err != nil {
+		log.Debug("本地代理握手失败", zap.Error(err), zap.String("client", conn.RemoteAddr().String()))
+		return
+	}
+
+	// 2. 按路由规则获取到目标地址的连接，与透明代理使用相同的上游
+	up := m.currentUpstream()
+	md := inboundMetadata(conn, req.Target)
+	rule := m.route(md)
+	target, up, err := m.dialRoute(up, rule, req.Target)
+	if err != nil {
+		log.Debug("本地代理连接目标失败", zap.Error(err), zap.String("target", req.Target))
+		req.Reject()
+		return
+	}
+	defer target.Close()
+
+	// 3. 通知客户端成功并开始转发
+	client, err := req.Accept()
+	if err != nil {
+		return
+	}
+
+	// 入站连接无法得知发起连接的进程，不做进程限速
+	m.relay(up.ctx, client, target, m.limiters(up, proxied(up, rule), "", ruleNames(rule)))
+}
@@ -1,11 +1,9 @@
 package tProxy
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"net"
-	"sync"
-	"time"
+	"strings"
 
 	"transparent/gvisor.dev/gvisor/pkg/tcpip"
 	"transparent/gvisor.dev/gvisor/pkg/tcpip/header"
@@ -13,49 +11,86 @@ import (
 	"transparent/gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"transparent/gvisor.dev/gvisor/pkg/tcpip/stack"
 	"transparent/gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
-	"transparent/log"
 
 	"github.com/lysShub/divert-go"
-	//"go.uber.org/zap"
+	"go.uber.org/zap"
+
+	"transparent/log"
 )
 
+// loadErr 加载WinDivert驱动失败的原因，启动时返回给调用方
+var loadErr error
+
 // init 初始化函数，加载WinDivert驱动
 func init() {
-	defer log.Recover("divert MustLoad")
-	divert.MustLoad(divert.DLL) // 确保WinDivert驱动加载
+	if err := divert.Load(divert.DLL); err != nil && !errors.Is(err, divert.ErrLoaded{}) {
+		loadErr = err
+	}
 }
 
 // initProxyServer 初始化代理服务器
 func (m *manager) initProxyServer() error {
-	// 1. 获取网络接口信息
-	IfIdx, SubIfIdx, mtu, err := GetInterfaceIndex()
+	if loadErr != nil {
+		return fmt.Errorf("%w: %w", ErrDriverMissing, loadErr)
+	}
+
+	m.bound = make(chan struct{})
+	m.mtu.Store(defaultMTU)
+
+	// 1. 网关模式下捕获其他设备经本机转发的数据包
+	if err := m.initGateway(); err != nil {
+		return err
+	}
+
+	// 2. 按配置选择需要捕获的网卡，暂时没有网络时等待网络变化后再绑定
+	ifaces, err := m.selectInterfaces()
 	if err != nil {
-		// log.Panic("获取网络接口索引失败", zap.Error(err))
-		return fmt.Errorf("获取网络接口索引失败 error:%w", err)
+		log.Warn("未找到出口网卡，等待网络可用", zap.Error(err))
+		return nil
 	}
 
-	// 3. 设置WinDivert过滤器
-	filter := fmt.Sprintf("ifIdx = %d and ip and tcp and outbound and not loopback  ", IfIdx)
+	// 3. 在选中的网卡上打开WinDivert句柄
+	if err := m.bind(ifaces); err != nil {
+		m.closeForward()
+		return err
+	}
+	return nil
+}
+
+// openCapture 打开捕获指定网卡出站TCP数据包的WinDivert句柄
+// 配置了上游端口范围时排除该范围内的源端口，直连目标和代理服务器在过滤规则中直接排除
+func (m *manager) openCapture(idxs []uint32) (*divert.Handle, error) {
+	conds := make([]string, len(idxs))
+	for i, idx := range idxs {
+		conds[i] = fmt.Sprintf("ifIdx = %d", idx)
+	}
+	filter := fmt.Sprintf("(%s) and ip and tcp and outbound and not loopback  ", strings.Join(conds, " or "))
+	if m.loop.ports != nil {
+		filter += " and " + m.loop.ports.filter()
+	}
+	if f := m.bypass.filter(m.serverPrefixes()); f != "" {
+		filter += " and " + f
+	}
 
 	handle, err := divert.Open(filter, divert.Network, -1000, 0)
 	if err != nil {
-		return fmt.Errorf("打开WinDivert句柄失败 filter:%s error:%w", filter, err)
+		if isDriverError(err) {
+			return nil, fmt.Errorf("%w: 打开WinDivert句柄失败 error:%w", ErrDriverMissing, err)
+		}
+		return nil, fmt.Errorf("打开WinDivert句柄失败 filter:%s error:%w", filter, err)
 	}
+	return handle, nil
+}
 
-	// 4. 保存网络配置
-	m.ifIdx = IfIdx
-	m.subIfIdx = SubIfIdx
-	m.handle = handle
-	m.mtu = mtu
-
-	// 5. 配置默认地址参数
+// newInjectAddress 创建向协议栈回复的数据包注入本地程序时使用的地址
+func newInjectAddress(ifIdx, subIfIdx uint32) *divert.Address {
 	addrrr := &divert.Address{}
 	addrrr.Layer = divert.Network
 	addrrr.Event = divert.NetworkPacket
 
 	nw := addrrr.Network()
-	nw.IfIdx = m.ifIdx
-	nw.SubIfIdx = m.subIfIdx
+	nw.IfIdx = ifIdx
+	nw.SubIfIdx = subIfIdx
 
 	addrrr.SetIPv6(false)        // 仅IPv4
 	addrrr.SetOutbound(false)    // 入站流量
@@ -65,15 +100,19 @@ func (m *manager) initProxyServer() error {
 	addrrr.SetImpostor(false)    // 非伪造包
 	addrrr.SetUDPChecksum(false) // 不校验UDP校验和
 
-	m.defaultAddrrr = addrrr
-
-	return nil
+	return addrrr
 }
 
 // createStack 创建网络协议栈
 func (m *manager) createStack() error {
 	const NICID = tcpip.NICID(1)
 
+	// 协议栈调优参数
+	opts, err := m.stackOptions()
+	if err != nil {
+		return err
+	}
+
 	// 1. 创建新协议栈
 	s := stack.New(stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
@@ -81,7 +120,7 @@ func (m *manager) createStack() error {
 	})
 
 	// 2. 创建通道端点
-	channelEp := channel.New(512, m.mtu, "")
+	channelEp := channel.New(opts.queueSize, m.mtu.Load(), "")
 	channelEp.LinkEPCapabilities |= stack.CapabilityRXChecksumOffload // 禁用校验和检查
 	ep := stack.LinkEndpoint(channelEp)
 
@@ -110,7 +149,14 @@ func (m *manager) createStack() error {
 		// log.Panic("设置欺骗模式失败", zap.Any("error", tcperr))
 	}
 
-	// 6. 设置路由表
+	// 6. 设置TCP参数和GRO
+	if err := opts.apply(s, NICID); err != nil {
+		channelEp.Close() // 关闭端点
+		s.Destroy()
+		return err
+	}
+
+	// 7. 设置路由表
 	s.SetRouteTable([]tcpip.Route{
 		{
 			Destination: header.IPv4EmptySubnet,
@@ -118,16 +164,16 @@ func (m *manager) createStack() error {
 		},
 	})
 
-	m.maxInFlight = 1 << 15
+	m.maxInFlight = opts.maxInFlight
 
 	m.tcpForwarder = tcp.NewForwarder(
 		s,
-		16<<10,                     // 16KB接收缓冲区
-		m.maxInFlight,              // 32KB最大段大小
+		opts.receiveWindow,         // 初始接收窗口
+		m.maxInFlight,              // 最大同时握手中的连接数
 		m.transportProtocolHandler, // 自定义处理函数
 	)
 
-	// 7. 设置TCP协议处理器
+	// 8. 设置TCP协议处理器
 	s.SetTransportProtocolHandler(
 		tcp.ProtocolNumber,
 		m.HandleTcpPacket,
@@ -141,93 +187,9 @@ func (m *manager) createStack() error {
 
 // closeDev 关闭网络设备
 func (m *manager) closeDev() (error, error) {
-	if m.handle == nil {
+	handle := m.handle.Load()
+	if handle == nil {
 		return nil, nil
 	}
-	return m.handle.Shutdown(divert.Both), m.handle.Close()
-}
-
-// GetInterfaceIndex 获取网络接口索引信息
-func GetInterfaceIndex() (uint32, uint32, uint32, error) {
-	// 1. 定义DNS查询过滤规则
-	const filter = "  not loopback and outbound and (ip.DstAddr = 8.8.8.8 or ipv6.DstAddr = 2001:4860:4860::8888) and tcp.DstPort = 53"
-
-	// 2. 打开WinDivert句柄
-	hd, err := divert.Open(filter, divert.Network, 0, divert.Sniff)
-	if err != nil {
-		return 0, 0, 0, fmt.Errorf("打开WinDivert失败: %w", err)
-	}
-	defer hd.Close()
-	defer hd.Shutdown(divert.Both)
-
-	// 3. 启动并发DNS查询
-	wg := &sync.WaitGroup{}
-	defer wg.Wait()
-
-	startConnection(wg, "tcp4", "8.8.8.8:53")                // IPv4查询
-	startConnection(wg, "tcp6", "[2001:4860:4860::8888]:53") // IPv6查询
-
-	// 4. 接收数据包
-	addr := divert.Address{}
-	buff := make([]byte, 1500)
-
-	errChan := make(chan error, 1)
-	defer func() {
-		hd.Close()
-		hd.Shutdown(divert.Both)
-		for range errChan {
-		}
-	}()
-	go func() {
-		defer close(errChan)
-		_, err = hd.Recv(buff, &addr)
-		errChan <- err
-	}()
-
-	// 5. 设置超时
-	ctxTimeOut, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-
-	select {
-	case <-ctxTimeOut.Done():
-		return 0, 0, 0, fmt.Errorf("操作超时")
-	case err := <-errChan:
-		if err != nil {
-			return 0, 0, 0, err
-		}
-	}
-
-	// 6. 获取MTU信息
-	nw := addr.Network()
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return 0, 0, 0, fmt.Errorf("获取网络接口失败: %w", err)
-	}
-
-	var mtu uint32
-	for _, iface := range interfaces {
-		if iface.Index == int(nw.IfIdx) {
-			mtu = uint32(iface.MTU)
-			break
-		}
-	}
-
-	if mtu == 0 {
-		return 0, 0, 0, fmt.Errorf("获取网络接口mtu失败")
-	}
-
-	return nw.IfIdx, nw.SubIfIdx, mtu, nil
-}
-
-// startConnection 启动网络连接
-func startConnection(wg *sync.WaitGroup, network, address string) {
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		conn, err := net.DialTimeout(network, address, time.Second)
-		if err != nil {
-			return
-		}
-		conn.Close()
-	}()
+	return handle.Shutdown(divert.Both), handle.Close()
 }
@@ -0,0 +1,189 @@
+package tProxy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/lysShub/divert-go"
+	"go.uber.org/zap"
+
+	"transparent/log"
+)
+
+// killSwitchPriority 阻断句柄的优先级，低于捕获句柄，捕获句柄放行(重新注入)的数据包也会经过阻断句柄
+const killSwitchPriority = -2000
+
+// killSwitchIPv6Allow 放行的IPv6本地网络: 链路本地和组播
+const killSwitchIPv6Allow = "(ipv6 and ipv6.DstAddr >= fe80:: and ipv6.DstAddr <= febf:ffff:ffff:ffff:ffff:ffff:ffff:ffff) or " +
+	"(ipv6 and ipv6.DstAddr >= ff00::)"
+
+// killSwitch 阻断模式
+// 没有可用上游或代理异常停止期间打开丢弃句柄，所有出站和转发的数据包被丢弃而不是放行，只放行允许列表
+// 由Supervisor持有，代理重启期间保持阻断
+type killSwitch struct {
+	allow []netip.Prefix // 本地网络和配置的允许列表
+
+	mu        sync.Mutex
+	down      bool           // 代理未运行
+	unhealthy bool           // 当前上游不可用
+	servers   []netip.Prefix // 代理服务器地址
+	handles   []*divert.Handle
+	filter    string // 当前丢弃句柄使用的过滤条件
+}
+
+// newKillSwitch 解析阻断模式配置，未开启时返回nil
+func newKillSwitch(cfg *ProxyJson) (*killSwitch, error) {
+	if !cfg.KillSwitch.Enable {
+		return nil, nil
+	}
+
+	allow, ipv6, err := parsePrefixes(append(slices.Clone(builtinBypass), cfg.KillSwitch.Allow...))
+	if err != nil {
+		return nil, fmt.Errorf("阻断模式允许列表错误 error:%w", err)
+	}
+	if len(ipv6) > 0 {
+		log.Warn("阻断模式允许列表只支持IPv4网段，已忽略IPv6网段，IPv6只放行链路本地和组播地址", zap.Strings("allow", ipv6))
+	}
+	return &killSwitch{allow: allow}, nil
+}
+
+// setDown 设置代理是否处于未运行状态
+func (k *killSwitch) setDown(down bool) {
+	if k == nil {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.down = down
+	k.update()
+}
+
+// setHealthy 设置当前上游是否可用
+func (k *killSwitch) setHealthy(healthy bool) {
+	if k == nil {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.unhealthy = !healthy
+	k.update()
+}
+
+// setServers 设置始终放行的代理服务器地址
+func (k *killSwitch) setServers(servers []netip.Prefix) {
+	if k == nil {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.servers = servers
+	k.update()
+}
+
+// active 是否正在阻断
+func (k *killSwitch) active() bool {
+	if k == nil {
+		return false
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.handles) > 0
+}
+
+// release 主动停止代理时解除阻断
+func (k *killSwitch) release() {
+	if k == nil {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.down, k.unhealthy = false, false
+	k.update()
+}
+
+// update 按当前状态打开或关闭丢弃句柄，调用方需持有k.mu
+// 放行地址变化时先打开新句柄再关闭旧句柄，切换期间不放行数据包
+func (k *killSwitch) update() {
+	if !k.down && !k.unhealthy {
+		if len(k.handles) > 0 {
+			k.close(k.handles)
+			k.handles, k.filter = nil, ""
+			log.Info("已解除阻断")
+		}
+		return
+	}
+
+	allow := k.allowFilter()
+	if len(k.handles) > 0 && k.filter == allow {
+		return
+	}
+
+	handles, err := openKillSwitch(allow)
+	if err != nil {
+		// 保留旧句柄继续阻断
+		log.Error("打开阻断句柄失败", zap.Error(err))
+		return
+	}
+
+	if len(k.handles) == 0 {
+		log.Warn("已开启阻断，只放行本地网络和代理服务器", zap.Bool("proxyDown", k.down), zap.Bool("upstreamUnhealthy", k.unhealthy))
+	}
+	k.close(k.handles)
+	k.handles, k.filter = handles, allow
+}
+
+// allowFilter 生成放行条件: 本地网络、允许列表、代理服务器以及IPv6链路本地和组播地址，调用方需持有k.mu
+func (k *killSwitch) allowFilter() string {
+	ps := append(slices.Clone(k.allow), k.servers...)
+	return "(ip and " + prefixFilter("ip.DstAddr", ps) + ") or " + killSwitchIPv6Allow
+}
+
+// close 关闭丢弃句柄
+func (k *killSwitch) close(handles []*divert.Handle) {
+	for _, h := range handles {
+		if err := h.Close(); err != nil {
+			log.Warn("关闭阻断句柄失败", zap.Error(err))
+		}
+	}
+}
+
+// killSwitchFilters 生成丢弃出站和转发数据包的过滤条件，allow为放行条件
+func killSwitchFilters(allow string) (outbound, forward string) {
+	return "outbound and not loopback and not (" + allow + ")", "not (" + allow + ")"
+}
+
+// openKillSwitch 打开丢弃出站和转发数据包的句柄，allow为放行条件
+func openKillSwitch(allow string) ([]*divert.Handle, error) {
+	if loadErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDriverMissing, loadErr)
+	}
+
+	outbound, forward := killSwitchFilters(allow)
+	filters := []struct {
+		layer  divert.Layer
+		filter string
+	}{
+		{divert.Network, outbound},
+		{divert.NetworkForward, forward},
+	}
+
+	var handles []*divert.Handle
+	for _, f := range filters {
+		h, err := divert.Open(f.filter, f.layer, killSwitchPriority, divert.Drop)
+		if err != nil {
+			for _, h := range handles {
+				h.Close()
+			}
+			return nil, fmt.Errorf("打开WinDivert句柄失败 filter:%s error:%w", f.filter, err)
+		}
+		handles = append(handles, h)
+	}
+	return handles, nil
+}
@@ -0,0 +1,118 @@
+package tProxy
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// builtinAllow 内置直连网段对应的过滤条件
+const builtinAllow = "(ip.DstAddr >= 10.0.0.0 and ip.DstAddr <= 10.255.255.255) or " +
+	"(ip.DstAddr >= 172.16.0.0 and ip.DstAddr <= 172.31.255.255) or " +
+	"(ip.DstAddr >= 192.168.0.0 and ip.DstAddr <= 192.168.255.255) or " +
+	"(ip.DstAddr >= 100.64.0.0 and ip.DstAddr <= 100.127.255.255) or " +
+	"(ip.DstAddr >= 169.254.0.0 and ip.DstAddr <= 169.254.255.255) or " +
+	"(ip.DstAddr >= 224.0.0.0 and ip.DstAddr <= 239.255.255.255) or " +
+	"ip.DstAddr = 255.255.255.255 or " +
+	"(ip.DstAddr >= 0.0.0.0 and ip.DstAddr <= 0.255.255.255)"
+
+func TestKillSwitchAllowFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		servers []string
+		want    string
+	}{
+		{
+			name: "builtin",
+			want: "(ip and (" + builtinAllow + ")) or " + killSwitchIPv6Allow,
+		},
+		{
+			name:  "allow list",
+			allow: []string{"203.0.113.0/24", "198.51.100.7"},
+			want: "(ip and (" + builtinAllow + " or (ip.DstAddr >= 203.0.113.0 and ip.DstAddr <= 203.0.113.255) or " +
+				"ip.DstAddr = 198.51.100.7)) or " + killSwitchIPv6Allow,
+		},
+		{
+			name:  "ipv6 allow ignored",
+			allow: []string{"2001:db8::/32", "198.51.100.7"},
+			want:  "(ip and (" + builtinAllow + " or ip.DstAddr = 198.51.100.7)) or " + killSwitchIPv6Allow,
+		},
+		{
+			name:    "servers",
+			allow:   []string{"198.51.100.7"},
+			servers: []string{"1.2.3.4/32", "5.6.7.8/32"},
+			want: "(ip and (" + builtinAllow + " or ip.DstAddr = 198.51.100.7 or ip.DstAddr = 1.2.3.4 or ip.DstAddr = 5.6.7.8)) or " +
+				killSwitchIPv6Allow,
+		},
+	}
+	for _, tt := range tests {
+		cfg := &ProxyJson{}
+		cfg.KillSwitch.Enable = true
+		cfg.KillSwitch.Allow = tt.allow
+		k, err := newKillSwitch(cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var servers []netip.Prefix
+		for _, s := range tt.servers {
+			servers = append(servers, netip.MustParsePrefix(s))
+		}
+		k.servers = servers
+
+		if got := k.allowFilter(); got != tt.want {
+			t.Errorf("%s: allowFilter() = %s\nwant %s", tt.name, got, tt.want)
+		}
+		// 生成放行条件不能修改允许列表
+		if got := k.allowFilter(); got != tt.want {
+			t.Errorf("%s: second allowFilter() = %s", tt.name, got)
+		}
+	}
+}
+
+func TestKillSwitchFilters(t *testing.T) {
+	outbound, forward := killSwitchFilters("ip.DstAddr = 1.2.3.4")
+	if outbound != "outbound and not loopback and not (ip.DstAddr = 1.2.3.4)" {
+		t.Errorf("outbound = %s", outbound)
+	}
+	if forward != "not (ip.DstAddr = 1.2.3.4)" {
+		t.Errorf("forward = %s", forward)
+	}
+}
+
+func TestNewKillSwitch(t *testing.T) {
+	tests := []struct {
+		enable  bool
+		allow   []string
+		wantNil bool
+		wantErr bool
+	}{
+		{enable: false, allow: []string{"bad"}, wantNil: true}, // 未开启时不解析
+		{enable: true, allow: nil},
+		{enable: true, allow: []string{"fd00::/8"}}, // 只有IPv6时忽略
+		{enable: true, allow: []string{"bad"}, wantErr: true},
+		{enable: true, allow: []string{"10.0.0.0/33"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		cfg := &ProxyJson{}
+		cfg.KillSwitch.Enable = tt.enable
+		cfg.KillSwitch.Allow = tt.allow
+		k, err := newKillSwitch(cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newKillSwitch(%v %q): err = %v", tt.enable, tt.allow, err)
+			continue
+		}
+		if !tt.wantErr && (k == nil) != tt.wantNil {
+			t.Errorf("newKillSwitch(%v %q) = %v", tt.enable, tt.allow, k)
+		}
+	}
+
+	// 未开启时所有方法为空操作
+	var k *killSwitch
+	k.setDown(true)
+	k.setHealthy(false)
+	k.setServers(nil)
+	k.release()
+	if k.active() {
+		t.Fatal("nil kill switch should not be active")
+	}
+}
@@ -0,0 +1,369 @@
+package tProxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/windows"
+
+	"transparent/proto/bss"
+	"transparent/proto/dns"
+	"transparent/proto/http"
+	"transparent/proto/oks"
+	"transparent/proto/socks"
+)
+
+// ErrSelfConnection 代理自身发出的连接被捕获，或上游指向本程序
+var ErrSelfConnection = errors.New("检测到代理自身的连接")
+
+// bindRetries 本地端口被占用时换用下一个端口的次数
+const bindRetries = 8
+
+// portRange 上游连接绑定的本地端口范围
+type portRange struct {
+	lo, hi uint16
+}
+
+// parsePortRange 解析 "起始-结束" 格式的端口范围，为空时返回nil
+func parsePortRange(s string) (*portRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("端口范围格式错误: %s", s)
+	}
+	l, err1 := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	h, err2 := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err1 != nil || err2 != nil || l == 0 || l > h {
+		return nil, fmt.Errorf("端口范围格式错误: %s", s)
+	}
+	return &portRange{lo: uint16(l), hi: uint16(h)}, nil
+}
+
+// contains 判断端口是否在范围内
+func (r *portRange) contains(port uint16) bool {
+	return r != nil && port >= r.lo && port <= r.hi
+}
+
+// filter 生成排除该端口范围的WinDivert过滤条件
+func (r *portRange) filter() string {
+	return fmt.Sprintf("(tcp.SrcPort < %d or tcp.SrcPort > %d)", r.lo, r.hi)
+}
+
+// loopGuard 防止代理捕获自身发出的连接，不依赖进程查找
+type loopGuard struct {
+	ports *portRange    // 上游连接绑定的本地端口范围，启动时设置，为nil时不绑定
+	next  atomic.Uint32 // 下一个尝试的端口偏移
+
+	mu      sync.Mutex
+	dialing map[dialKey]int             // 正在连接的本地端口和远端地址，SYN发出前记录
+	local   map[netip.AddrPort]struct{} // 已建立的上游连接的本地地址
+}
+
+// dialKey 正在进行的连接，本地端口在发出SYN前已绑定
+type dialKey struct {
+	port uint16
+	dst  netip.AddrPort
+}
+
+func newLoopGuard() *loopGuard {
+	return &loopGuard{
+		dialing: map[dialKey]int{},
+		local:   map[netip.AddrPort]struct{}{},
+	}
+}
+
+// guardedConn 记录了本地地址的上游连接，关闭时移除记录
+type guardedConn struct {
+	*net.TCPConn
+	release func()
+}
+
+func (c *guardedConn) Close() error {
+	c.release()
+	return c.TCPConn.Close()
+}
+
+// dial 连接IP地址，绑定本地端口后再连接，连接期间记录本地端口和远端地址
+// 配置了端口范围时使用范围内的端口，否则使用系统分配的空闲端口
+func (g *loopGuard) dial(ctx context.Context, base *net.Dialer, network, addr string) (net.Conn, error) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil || !strings.HasPrefix(network, "tcp") {
+		return base.DialContext(ctx, network, addr)
+	}
+	ap = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+
+	// 端口被占用或被系统保留时换用下一个端口
+	var conn net.Conn
+	for range bindRetries {
+		var port uint16
+		if g.ports != nil {
+			port = g.nextPort()
+		} else if port, err = freePort(); err != nil {
+			return nil, err
+		}
+		conn, err = g.dialFrom(ctx, base, network, addr, dialKey{port: port, dst: ap})
+		if err == nil || !isAddrInUse(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g.track(conn), nil
+}
+
+// dialFrom 绑定key中的本地端口连接远端地址，连接期间记录该连接
+func (g *loopGuard) dialFrom(ctx context.Context, base *net.Dialer, network, addr string, key dialKey) (net.Conn, error) {
+	g.mu.Lock()
+	g.dialing[key]++
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		if g.dialing[key]--; g.dialing[key] <= 0 {
+			delete(g.dialing, key)
+		}
+		g.mu.Unlock()
+	}()
+
+	d := *base
+	d.LocalAddr = &net.TCPAddr{Port: int(key.port)}
+	return d.DialContext(ctx, network, addr)
+}
+
+// freePort 返回系统分配的空闲端口，连接前绑定该端口以便识别发出的SYN
+func freePort() (uint16, error) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port), nil
+}
+
+// track 记录上游连接的本地地址，用于识别被捕获的自身连接
+func (g *loopGuard) track(conn net.Conn) net.Conn {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn
+	}
+	local := tc.LocalAddr().(*net.TCPAddr).AddrPort()
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+
+	g.mu.Lock()
+	g.local[local] = struct{}{}
+	g.mu.Unlock()
+
+	return &guardedConn{TCPConn: tc, release: sync.OnceFunc(func() {
+		g.mu.Lock()
+		delete(g.local, local)
+		g.mu.Unlock()
+	})}
+}
+
+// isOwnSource 判断连接的源地址是否属于本程序的上游连接
+func (g *loopGuard) isOwnSource(key flowKey) bool {
+	if g.ports.contains(key.srcPort) {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.local[netip.AddrPortFrom(netip.AddrFrom4(key.srcAddr), key.srcPort)]
+	return ok
+}
+
+// nextPort 轮流返回端口范围内的端口
+func (g *loopGuard) nextPort() uint16 {
+	n := uint32(g.ports.hi-g.ports.lo) + 1
+	return g.ports.lo + uint16((g.next.Add(1)-1)%n)
+}
+
+// isDialing 判断SYN是否属于正在进行的连接: 源端口和目标地址都与发起的连接相同
+func (g *loopGuard) isDialing(key flowKey) bool {
+	dst := netip.AddrPortFrom(netip.AddrFrom4(key.dstAddr), key.dstPort)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.dialing[dialKey{port: key.srcPort, dst: dst}] > 0
+}
+
+// isAddrInUse 判断连接失败是否因为本地端口不可用
+func isAddrInUse(err error) bool {
+	return errors.Is(err, windows.WSAEADDRINUSE) || errors.Is(err, windows.WSAEACCES)
+}
+
+// isOwnFlow 判断SYN是否由本程序发出: 源地址属于上游连接、源端口和目标与正在进行的连接相同或目标为分组中上游的代理服务器
+// 本地程序发往同一目标的连接使用不同的源端口，仍经过协议栈
+func (m *manager) isOwnFlow(key flowKey) bool {
+	if m.loop.isOwnSource(key) || m.loop.isDialing(key) {
+		return true
+	}
+
+	dst := netip.AddrPortFrom(netip.AddrFrom4(key.dstAddr), key.dstPort)
+	for _, up := range m.upstreams() {
+		if up.isServer(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamServer 返回上游代理服务器地址，直连时返回空
+func upstreamServer(cfg *ProxyJson) (string, error) {
+	var (
+		server string
+		err    error
+	)
+	switch cfg.ProxyType {
+	case "socks":
+		_, server, err = socks.ParseURL(cfg.ProxyUrl)
+	case "http":
+		_, server, _, _, err = http.ParseURL(cfg.ProxyUrl)
+	case "trojan":
+		server = cfg.TrojanProxy.Server
+	case "oks":
+		_, server, _, _, err = oks.ParseURL(cfg.ProxyUrl)
+	case "bss":
+		_, server, _, _, err = bss.ParseURL(cfg.ProxyUrl)
+	}
+	return server, err
+}
+
+// resolveServers 解析代理服务器地址，连接代理服务器的SYN据此直接放行
+// 解析失败时只记录拨号时实际连接的地址
+func (up *upstream) resolveServers(ctx context.Context) error {
+	server, err := upstreamServer(up.cfg)
+	if err != nil || server == "" {
+		return err
+	}
+
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return fmt.Errorf("代理服务器地址格式错误 server:%s error:%w", server, err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("代理服务器端口错误 server:%s error:%w", server, err)
+	}
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, addr)
+	} else {
+		r := up.dialer.Resolver
+		if r == nil {
+			r = dns.Default()
+		}
+		ips, err := r.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return fmt.Errorf("解析代理服务器域名失败 host:%s error:%w", host, err)
+		}
+		for _, ip := range ips {
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	for _, addr := range addrs {
+		up.addServer(netip.AddrPortFrom(addr.Unmap(), uint16(p)))
+	}
+	return nil
+}
+
+// addServer 记录代理服务器地址，返回是否为新地址
+func (up *upstream) addServer(ap netip.AddrPort) bool {
+	up.serverMu.Lock()
+	defer up.serverMu.Unlock()
+	if _, ok := up.servers[ap]; ok {
+		return false
+	}
+	up.servers[ap] = struct{}{}
+	return true
+}
+
+// isServer 判断地址是否为该上游的代理服务器
+func (up *upstream) isServer(ap netip.AddrPort) bool {
+	up.serverMu.Lock()
+	defer up.serverMu.Unlock()
+	_, ok := up.servers[ap]
+	return ok
+}
+
+// checkInbound 检查代理服务器是否指向本程序的本地代理入站，指向时连接会无限循环
+func (m *manager) checkInbound(up *upstream) error {
+	if m.proxyJson.Inbound == nil || m.proxyJson.Inbound.Listen == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(m.proxyJson.Inbound.Listen)
+	if err != nil {
+		return nil
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil
+	}
+
+	// 监听地址为空(如 ":1080")时按所有地址处理
+	ln := netip.IPv4Unspecified()
+	switch host {
+	case "":
+	case "localhost":
+		ln = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	default:
+		if ln, err = netip.ParseAddr(host); err != nil {
+			return nil
+		}
+		ln = ln.Unmap()
+	}
+
+	up.serverMu.Lock()
+	defer up.serverMu.Unlock()
+	for ap := range up.servers {
+		if ap.Port() != uint16(p) {
+			continue
+		}
+
+		same := ap.Addr() == ln
+		if ln.IsUnspecified() {
+			same = ap.Addr().IsLoopback() || isLocalAddr(ap.Addr())
+		}
+		if same {
+			return fmt.Errorf("%w: 上游代理 %s 指向本地代理入站 %s", ErrSelfConnection, ap, m.proxyJson.Inbound.Listen)
+		}
+	}
+	return nil
+}
+
+// isLocalAddr 判断地址是否为本机网卡地址
+func isLocalAddr(addr netip.Addr) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			if local, ok := netip.AddrFromSlice(ipNet.IP); ok && local.Unmap() == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isSelfConnected 判断连接的本地地址和远端地址是否相同(TCP自连接)
+func isSelfConnected(conn net.Conn) bool {
+	local, ok1 := conn.LocalAddr().(*net.TCPAddr)
+	remote, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	return ok1 && ok2 && local.Port == remote.Port && local.IP.Equal(remote.IP)
+}
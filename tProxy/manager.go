@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/lysShub/divert-go" // Windows 网络数据包捕获库
 
@@ -14,26 +14,51 @@ import (
 	"transparent/gvisor.dev/gvisor/pkg/tcpip/link/channel" // gVisor 的网络栈实现
 	//"transparent/log"
 
+	"transparent/utils/health"
+	"transparent/utils/netmon"
+	"transparent/utils/rules"
 	"transparent/utils/taskConsumerManager"
 )
 
 type Manager interface {
 	Start() (<-chan error, error)
 	Stop()
+
+	// UpdateProxy 在不重启捕获和协议栈的情况下切换上游代理
+	UpdateProxy(cfg *ProxyJson) error
+
+	// Drain 停止接管新连接，等待已有连接结束后停止
+	Drain()
+
+	// Status 返回当前运行状态
+	Status() Status
+
+	// TestUpstream 立即测试指定上游(为空时为当前上游)的延迟
+	TestUpstream(name string) (health.Result, error)
 }
 
 // manager 结构体管理整个代理服务的核心组件
 type manager struct {
-	tcm               *taskConsumerManager.Manager // 任务调度管理器
-	handle            *divert.Handle               // WinDivert 句柄，用于网络包捕获
-	channelEp         *channel.Endpoint            // gVisor 网络栈的端点
+	tcm               *taskConsumerManager.Manager  // 任务调度管理器
+	handle            atomic.Pointer[divert.Handle] // WinDivert 句柄，用于网络包捕获，切换网卡时替换
+	fwdHandle         *divert.Handle                // 网关模式下捕获转发数据包的句柄
+	fwdUDPHandle      *divert.Handle                // 网关模式下丢弃转发UDP的句柄，未开启时为nil
+	gateway           *gatewayRules                 // 网关模式的源地址规则
+	loop              *loopGuard                    // 防止捕获自身的上游连接
+	bypass            *bypassList                   // 不经过代理的目标
+	router            *rules.Engine                 // 路由规则，未配置时为nil
+	kill              *killSwitch                   // 阻断模式，由Supervisor设置，未开启时为nil
+	channelEp         *channel.Endpoint             // gVisor 网络栈的端点
 	tcpipStack        *stack.Stack
-	ifIdx             uint32 // 网络接口索引
-	subIfIdx          uint32 // 子接口索引
-	mtu               uint32 // 最大传输单元
-	defaultAddrrr     *divert.Address
+	ifaces            []netmon.Interface             // 已绑定的网卡，按索引排序
+	mtu               atomic.Uint32                  // 最大传输单元
+	injectAddr        atomic.Pointer[divert.Address] // 注入数据包使用的地址
+	bindMu            sync.Mutex
+	bound             chan struct{} // 第一次绑定网卡后关闭
 	exitChan          chan error
 	exitChanCloseFunc func()
+	exitMu            sync.Mutex
+	exitClosed        bool
 	tcpForwarder      *tcp.Forwarder
 	mu                sync.Mutex
 	inFlight          map[stack.TransportEndpointID]struct{}
@@ -41,7 +66,17 @@ type manager struct {
 	thwg              sync.WaitGroup
 	channelEpClose    func()
 	proxyJson         *ProxyJson
-	tTLMap            *TTLMap
+	upstream          atomic.Pointer[upstream] // 当前上游，切换时整体替换
+	groupMu           sync.Mutex
+	selectMu          sync.Mutex      // 串行选择上游
+	members           []*upstream     // 上游分组，第一个为默认上游
+	health            *health.Checker // 上游健康检查
+	flows             *flowTable      // 被代理连接的跟踪表
+	workers           []*packetWorker // 数据包处理协程
+	hashSeed          uint32          // 分发数据包使用的哈希种子
+	connMu            sync.Mutex
+	conns             map[*activeConn]struct{} // 正在转发的连接
+	draining          atomic.Bool              // 是否处于优雅关闭阶段
 	start             func() (<-chan error, error)
 	stop              sync.Once
 }
@@ -52,8 +87,13 @@ func NewManager(proxyJson *ProxyJson) *manager {
 		tcm:       taskConsumerManager.New(), // 任务消费者管理器
 		exitChan:  make(chan error, 1),
 		proxyJson: proxyJson,
+		conns:     map[*activeConn]struct{}{},
+		loop:      newLoopGuard(),
 	}
 	m.exitChanCloseFunc = sync.OnceFunc(func() {
+		m.exitMu.Lock()
+		defer m.exitMu.Unlock()
+		m.exitClosed = true
 		close(m.exitChan)
 	})
 
@@ -64,70 +104,65 @@ func NewManager(proxyJson *ProxyJson) *manager {
 		default:
 		}
 
-		// 初始化代理服务器
-		if err := m.initProxyServer(); err != nil {
+		if p := m.switchPolicy(); p != switchKeep && p != switchDrain {
+			return nil, fmt.Errorf("不支持的上游切换策略: %s", p)
+		}
+
+		// 防止捕获自身的上游连接
+		ports, err := parsePortRange(m.proxyJson.UpstreamPortRange)
+		if err != nil {
 			return nil, err
 		}
+		m.loop.ports = ports
 
-		// 创建网络协议栈
-		if err := m.createStack(); err != nil {
-			m.closeDev() // 关闭设备
+		// 直连目标
+		if m.bypass, err = m.newBypassList(); err != nil {
 			return nil, err
 		}
 
-		m.channelEpClose = sync.OnceFunc(func() {
-			if m.channelEp != nil {
-				m.channelEp.Close()
-			}
-		})
+		// 路由规则
+		if err := m.loadRules(); err != nil {
+			return nil, err
+		}
 
-		m.tTLMap = NewTTLMap(2 * 30 * time.Second)
-		m.tcm.AddTask(1, func(ctx context.Context) {
-			m.tTLMap.Start()
-			defer m.tTLMap.Stop()
-			<-ctx.Done()
-		})
+		// 上游代理和备选上游
+		if err := m.initUpstreams(); err != nil {
+			return nil, err
+		}
+		m.kill.setServers(m.serverPrefixes())
+		m.kill.setHealthy(true)
 
-		// 添加三个并行运行的守护任务：
-		m.tcm.AddTask(1, func(ctx context.Context) {
-			done := make(chan struct{})
-			go func() {
-				defer close(done)
-				m.runReadStack(ctx) // 运行协议栈读取循环
-			}()
-
-			select {
-			case <-ctx.Done(): // 收到停止信号
-				m.channelEpClose() // 关闭端点
-				if m.tcpipStack != nil {
-					m.tcpipStack.Destroy()
-				}
+		// 带宽限制
+		m.loadBandwidth()
+
+		if m.proxyJson.DisableCapture && (m.proxyJson.Inbound == nil || m.proxyJson.Inbound.Listen == "") {
+			return nil, fmt.Errorf("关闭数据包捕获时必须配置本地代理入站")
+		}
 
-				if m.tcpForwarder != nil {
-					m.tcpForwarder.Close()
+		// 本地代理入站
+		ln, err := m.listenInbound()
+		if err != nil {
+			return nil, err
+		}
+
+		// 数据包捕获
+		if !m.proxyJson.DisableCapture {
+			if err := m.startCapture(); err != nil {
+				if ln != nil {
+					ln.Close()
 				}
-				<-done // 等待任务完成
-			case <-done: // 任务自然结束
-				return
+				return nil, err
 			}
-		})
+		}
 
-		//  读取 WinDivert 捕获的数据包
-		m.tcm.AddTask(1, func(ctx context.Context) {
-			done := make(chan struct{})
-			go func() {
-				defer close(done)
-				m.runReadDivert(ctx) // 运行数据包捕获循环
-			}()
-
-			select {
-			case <-ctx.Done():
-				m.closeDev() // 关闭设备
-				<-done       // 等待任务完成
-			case <-done:
-				return
-			}
-		})
+		if ln != nil {
+			m.serveInbound(ln)
+		}
+
+		// 上游健康检查
+		if m.proxyJson.HealthCheck.Interval >= 0 {
+			m.tcm.AddTask(1, m.health.Run)
+		}
 
 		return m.exitChan, nil
 	})
@@ -135,6 +170,115 @@ func NewManager(proxyJson *ProxyJson) *manager {
 	return m
 }
 
+// startCapture 打开WinDivert句柄、创建协议栈并启动数据包处理任务
+func (m *manager) startCapture() error {
+	// 初始化代理服务器
+	if err := m.initProxyServer(); err != nil {
+		return err
+	}
+
+	// 创建网络协议栈
+	if err := m.createStack(); err != nil {
+		m.closeDev() // 关闭设备
+		m.closeForward()
+		return err
+	}
+
+	m.channelEpClose = sync.OnceFunc(func() {
+		if m.channelEp != nil {
+			m.channelEp.Close()
+		}
+	})
+
+	m.flows = newFlowTable()
+	m.tcm.AddTask(1, func(ctx context.Context) {
+		m.flows.run(ctx) // 定期清理已关闭的连接
+	})
+
+	// 添加三个并行运行的守护任务：
+	m.tcm.AddTask(1, func(ctx context.Context) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			m.runReadStack(ctx) // 运行协议栈读取循环
+		}()
+
+		select {
+		case <-ctx.Done(): // 收到停止信号
+			m.channelEpClose() // 关闭端点
+			if m.tcpipStack != nil {
+				m.tcpipStack.Destroy()
+			}
+
+			if m.tcpForwarder != nil {
+				m.tcpForwarder.Close()
+			}
+			<-done // 等待任务完成
+		case <-done: // 任务自然结束
+			return
+		}
+	})
+
+	// 定期解析直连域名
+	if len(m.bypass.domains) > 0 {
+		m.tcm.AddTask(1, m.runBypassResolve)
+	}
+
+	// 数据包处理协程
+	m.initWorkers()
+
+	// 监听网络变化，出口网卡变化时重新绑定
+	m.tcm.AddTask(1, m.runNetWatch)
+
+	//  读取 WinDivert 捕获的数据包
+	m.tcm.AddTask(1, func(ctx context.Context) {
+		m.runCapture(ctx, m.runReadDivert, func() { m.closeDev() })
+	})
+
+	// 网关模式下读取转发的数据包
+	if m.fwdHandle != nil {
+		m.tcm.AddTask(1, func(ctx context.Context) {
+			m.runCapture(ctx, m.runReadForward, m.closeForward)
+		})
+	}
+
+	return nil
+}
+
+// runCapture 运行数据包捕获循环，ctx取消时关闭句柄，句柄异常关闭时报告退出原因
+func (m *manager) runCapture(ctx context.Context, read func(context.Context) error, closeFn func()) {
+	done := make(chan error, 1)
+	go func() {
+		done <- read(ctx) // 运行数据包捕获循环
+	}()
+
+	select {
+	case <-ctx.Done():
+		closeFn() // 关闭设备
+		<-done    // 等待任务完成
+	case err := <-done:
+		// 句柄异常关闭，通知调用方并停止重试，避免在已关闭的句柄上空转
+		if ctx.Err() == nil {
+			m.fail(fmt.Errorf("%w: %w", ErrHandleClosed, err))
+		}
+		<-ctx.Done()
+	}
+}
+
+// fail 通过退出通道报告异常退出的原因
+func (m *manager) fail(err error) {
+	m.exitMu.Lock()
+	defer m.exitMu.Unlock()
+
+	if m.exitClosed {
+		return
+	}
+	select {
+	case m.exitChan <- err:
+	default:
+	}
+}
+
 // Start 启动代理服务的各个组件
 func (m *manager) Start() (<-chan error, error) {
 	m.mu.Lock()
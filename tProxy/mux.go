@@ -0,0 +1,55 @@
+package tProxy
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"go.uber.org/zap"
+
+	"transparent/log"
+	"transparent/proto/bss"
+	"transparent/proto/mux"
+	"transparent/proto/oks"
+)
+
+// newMuxPool 上游地址设置了mux参数时创建多路复用连接池，未设置时返回nil
+// 只有oks和bss有对应的服务端实现，连接池随上游一起关闭
+func (m *manager) newMuxPool(up *upstream) (*mux.Pool, error) {
+	cfg := up.cfg
+	var dial func(ctx context.Context) (net.Conn, error)
+	switch cfg.ProxyType {
+	case "oks":
+		dial = func(ctx context.Context) (net.Conn, error) { return oks.DialMux(ctx, up.dialer, cfg.ProxyUrl) }
+	case "bss":
+		dial = func(ctx context.Context) (net.Conn, error) { return bss.DialMux(ctx, up.dialer, cfg.ProxyUrl) }
+	default:
+		return nil, nil
+	}
+
+	pc, ok, err := mux.ParseURL(cfg.ProxyUrl)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return mux.NewPool(pc, dial), nil
+}
+
+// muxStream 上游开启多路复用时经过连接池打开到目标的流
+// 返回false表示需要改用独立连接: 未开启多路复用、服务端不支持、连接池已满或已随上游被替换
+func muxStream(ctx context.Context, up *upstream, addr string, open func(context.Context, *mux.Pool, string) (net.Conn, error)) (net.Conn, bool, error) {
+	if up.mux == nil {
+		return nil, false, nil
+	}
+
+	conn, err := open(ctx, up.mux, addr)
+	switch {
+	case errors.Is(err, mux.ErrUnsupported):
+		up.muxWarn.Do(func() {
+			log.Warn("代理服务器不支持多路复用，改用独立连接", zap.String("upstream", up.name), zap.Error(err))
+		})
+		return nil, false, nil
+	case errors.Is(err, mux.ErrPoolFull), errors.Is(err, mux.ErrClosed):
+		return nil, false, nil
+	}
+	return conn, true, err
+}
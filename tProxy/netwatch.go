@@ -0,0 +1,154 @@
+package tProxy
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lysShub/divert-go"
+	"go.uber.org/zap"
+
+	"transparent/log"
+	"transparent/utils/netmon"
+)
+
+// defaultMTU 尚未绑定网卡时使用的MTU
+const defaultMTU = 1500
+
+// selectInterfaces 按配置选择需要捕获的网卡
+// 未配置时使用默认路由所在的网卡，"*" 表示所有已启用的非回环网卡，其余按网卡名(不区分大小写)或索引匹配
+func (m *manager) selectInterfaces() ([]netmon.Interface, error) {
+	names := m.proxyJson.Interfaces
+	if len(names) == 0 {
+		iface, err := netmon.DefaultInterface()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInterfaceNotFound, err)
+		}
+		return []netmon.Interface{iface}, nil
+	}
+
+	all, err := netmon.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInterfaceNotFound, err)
+	}
+
+	var out []netmon.Interface
+	for _, iface := range all {
+		if slices.ContainsFunc(names, func(name string) bool {
+			return name == "*" || strings.EqualFold(name, iface.Name) || name == strconv.Itoa(int(iface.Index))
+		}) {
+			out = append(out, iface)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: 没有可用的网卡 interfaces:%v", ErrInterfaceNotFound, names)
+	}
+
+	slices.SortFunc(out, func(a, b netmon.Interface) int { return cmp.Compare(a.Index, b.Index) })
+	return out, nil
+}
+
+// sameIndexes 判断两组网卡的索引是否一致，两组都已按索引排序
+func sameIndexes(a, b []netmon.Interface) bool {
+	return slices.EqualFunc(a, b, func(x, y netmon.Interface) bool { return x.Index == y.Index })
+}
+
+// maxMTU 返回一组网卡中最大的MTU
+// 协议栈和读取缓冲区按最大MTU分配，每个连接的MSS由本地程序在原网卡上发出的SYN决定
+func maxMTU(ifaces []netmon.Interface) uint32 {
+	var mtu uint32
+	for _, iface := range ifaces {
+		mtu = max(mtu, iface.MTU)
+	}
+	return mtu
+}
+
+// bind 将数据包捕获绑定到指定的一组网卡
+// 网卡变化时替换WinDivert句柄，MTU变化时只更新MTU，协议栈和已跟踪的连接保持不变
+func (m *manager) bind(ifaces []netmon.Interface) error {
+	m.bindMu.Lock()
+	defer m.bindMu.Unlock()
+
+	old := m.handle.Load()
+	mtu := maxMTU(ifaces)
+	changed := old == nil || !sameIndexes(ifaces, m.ifaces)
+	if !changed && mtu == m.mtu.Load() {
+		return nil
+	}
+
+	if changed {
+		idxs := make([]uint32, len(ifaces))
+		for i, iface := range ifaces {
+			idxs[i] = iface.Index
+		}
+
+		handle, err := m.openCapture(idxs)
+		if err != nil {
+			return err
+		}
+
+		// 未跟踪连接的回复从第一个网卡注入，子接口索引在收到第一个数据包时更新
+		m.injectAddr.Store(newInjectAddress(idxs[0], 0))
+		m.handle.Store(handle)
+
+		// 关闭旧句柄使读取循环切换到新句柄
+		if old != nil {
+			old.Shutdown(divert.Both)
+			old.Close()
+		}
+	}
+	m.ifaces = ifaces
+
+	m.mtu.Store(mtu)
+	if m.channelEp != nil {
+		m.channelEp.SetMTU(mtu)
+	}
+
+	if old == nil {
+		close(m.bound)
+	}
+
+	for _, iface := range ifaces {
+		log.Info("数据包捕获已绑定网卡",
+			zap.String("name", iface.Name),
+			zap.Uint32("index", iface.Index),
+			zap.Uint32("mtu", iface.MTU),
+		)
+	}
+	return nil
+}
+
+// learnSubIfIdx 根据捕获的数据包更新注入地址的子接口索引
+func (m *manager) learnSubIfIdx(addr *divert.Address) {
+	nw := addr.Network()
+	cur := m.injectAddr.Load()
+	if cur == nil || cur.Network().IfIdx != nw.IfIdx || cur.Network().SubIfIdx == nw.SubIfIdx {
+		return
+	}
+	m.injectAddr.Store(newInjectAddress(nw.IfIdx, nw.SubIfIdx))
+}
+
+// runNetWatch 监听网络变化，捕获的网卡或MTU变化时重新绑定
+func (m *manager) runNetWatch(ctx context.Context) {
+	events, err := netmon.Watch(ctx)
+	if err != nil {
+		log.Error("监听网络变化失败", zap.Error(err))
+		<-ctx.Done()
+		return
+	}
+
+	for range events {
+		ifaces, err := m.selectInterfaces()
+		if err != nil {
+			log.Debug("出口网卡不可用", zap.Error(err))
+			continue
+		}
+
+		if err := m.bind(ifaces); err != nil {
+			log.Error("重新绑定网卡失败", zap.Error(err))
+		}
+	}
+}
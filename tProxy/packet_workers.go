@@ -0,0 +1,136 @@
+package tProxy
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/lysShub/divert-go"
+	"go.uber.org/zap"
+
+	"transparent/gvisor.dev/gvisor/pkg/buffer"
+	"transparent/gvisor.dev/gvisor/pkg/tcpip/header"
+	"transparent/gvisor.dev/gvisor/pkg/tcpip/network/hash"
+	"transparent/log"
+)
+
+const (
+	// defaultWorkerQueueSize 每个处理协程的默认队列长度
+	defaultWorkerQueueSize = 1024
+
+	// workerStatsInterval 输出丢包统计的间隔
+	workerStatsInterval = 30 * time.Second
+)
+
+// packetJob 待处理的捕获数据包
+type packetJob struct {
+	v    *buffer.View
+	addr divert.Address
+}
+
+// packetWorker 数据包处理协程，同一连接的数据包总是由同一个协程按顺序处理
+type packetWorker struct {
+	queue chan packetJob
+	drops atomic.Uint64 // 队列满时丢弃的数据包数
+}
+
+// initWorkers 创建数据包处理协程
+func (m *manager) initWorkers() {
+	n := m.proxyJson.Workers
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	size := m.proxyJson.WorkerQueueSize
+	if size <= 0 {
+		size = defaultWorkerQueueSize
+	}
+
+	m.hashSeed = hash.RandN32(1)[0]
+	m.workers = make([]*packetWorker, n)
+	for i := range m.workers {
+		w := &packetWorker{queue: make(chan packetJob, size)}
+		m.workers[i] = w
+
+		m.tcm.AddTask(1, func(ctx context.Context) {
+			m.runWorker(ctx, w)
+		})
+	}
+
+	m.tcm.AddTask(1, m.runWorkerStats)
+}
+
+// dispatchPacket 按四元组哈希把数据包分发给处理协程，队列满时丢弃
+func (m *manager) dispatchPacket(v *buffer.View, addr *divert.Address) {
+	w := m.workers[m.workerIndex(v.AsSlice())]
+
+	select {
+	case w.queue <- packetJob{v: v, addr: *addr}:
+	default:
+		w.drops.Add(1)
+		v.Release()
+	}
+}
+
+// workerIndex 计算数据包所属的处理协程，无法解析四元组的数据包交给第一个协程
+func (m *manager) workerIndex(packet []byte) int {
+	if len(m.workers) == 1 || len(packet) < header.IPv4MinimumSize {
+		return 0
+	}
+
+	ipv4 := header.IPv4(packet)
+	hdrLen := int(ipv4.HeaderLength())
+	if ipv4.Protocol() != uint8(header.TCPProtocolNumber) || len(packet) < hdrLen+header.TCPMinimumSize {
+		return 0
+	}
+
+	key := newFlowKey(ipv4, header.TCP(packet[hdrLen:]))
+	return int(key.hash(m.hashSeed) % uint32(len(m.workers)))
+}
+
+// runWorker 处理队列中的数据包，直到ctx取消
+func (m *manager) runWorker(ctx context.Context, w *packetWorker) {
+	for {
+		select {
+		case <-ctx.Done():
+			// 释放队列中剩余的数据包
+			for {
+				select {
+				case job := <-w.queue:
+					job.v.Release()
+				default:
+					return
+				}
+			}
+		case job := <-w.queue:
+			m.handlePacket(ctx, job.v, &job.addr)
+		}
+	}
+}
+
+// runWorkerStats 定期输出各处理协程的丢包数
+func (m *manager) runWorkerStats(ctx context.Context) {
+	ticker := time.NewTicker(workerStatsInterval)
+	defer ticker.Stop()
+
+	last := make([]uint64, len(m.workers))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for i, w := range m.workers {
+				drops := w.drops.Load()
+				if drops != last[i] {
+					log.Warn("数据包处理队列已满，丢弃数据包",
+						zap.Int("worker", i),
+						zap.Uint64("drops", drops-last[i]),
+						zap.Uint64("total", drops),
+						zap.Int("queued", len(w.queue)),
+					)
+					last[i] = drops
+				}
+			}
+		}
+	}
+}
@@ -1,27 +1,66 @@
 package tProxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"net"
-	"sync"
+	"time"
 
 	"go.uber.org/zap"
+
 	"transparent/gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"transparent/gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"transparent/gvisor.dev/gvisor/pkg/waiter"
-	//"time"
 	"transparent/log"
 	"transparent/proto/bss"
 	"transparent/proto/http"
 	"transparent/proto/oks"
+	"transparent/proto/sniff"
 	"transparent/proto/socks"
 	"transparent/proto/trojan"
+	"transparent/utils/rules"
 )
 
 // transportProtocolHandler 处理TCP转发请求
 // 参数r是TCP转发请求对象
 func (m *manager) transportProtocolHandler(r *tcp.ForwarderRequest) {
+	id := r.ID()
+
+	addr := fmt.Sprintf("%s:%d", id.LocalAddress.String(), id.LocalPort)
+
+	// 本程序的上游连接被捕获时拒绝，避免连接循环
+	if m.loop.isOwnSource(newStackFlowKey(id)) {
+		log.Error("拒绝代理自身的连接", zap.Error(ErrSelfConnection), zap.String("addr", addr))
+		r.Complete(true)
+		return
+	}
+
+	// 连接建立期间切换上游不影响本连接
+	up := m.currentUpstream()
+	md := m.stackMetadata(id)
+
+	// 延迟握手模式：先连接上游，成功后才与本地程序完成TCP握手
+	// 拨号期间请求一直占用转发器的in-flight名额，重传的SYN会被转发器忽略
+	// 握手前无法嗅探域名，只按地址、端口和进程匹配规则
+	var target net.Conn
+	var rule *rules.Rule
+	if m.proxyJson.DelayHandshake {
+		rule = m.route(md)
+		t, used, err := m.dialRoute(up, rule, addr)
+		if errors.Is(err, ErrRejected) {
+			r.Complete(true)
+			return
+		}
+		if err != nil {
+			m.rejectRequest(r)
+			return
+		}
+		target, up = t, used
+		defer target.Close() // 确保函数退出时关闭目标连接
+	}
+
 	// 创建等待队列，用于TCP端点的异步操作
 	wq := waiter.Queue{}
 
@@ -35,92 +74,135 @@ func (m *manager) transportProtocolHandler(r *tcp.ForwarderRequest) {
 	defer ep.Close()        // 确保函数退出时关闭端点
 	defer r.Complete(false) // 标记请求成功完成
 
-	id := r.ID()
-
-	addr := fmt.Sprintf("%s:%d", id.LocalAddress.String(), id.LocalPort)
+	defer m.track(ep.Abort)() // 优雅关闭超时时重置连接
 
-	// 获取到目标地址的连接
-	target, err := m.getConn(addr)
-	if err != nil {
-		return
+	m.setEndpointKeepAlive(ep)
+	if m.proxyJson.Stack.DelayedAck {
+		ep.SocketOptions().SetQuickAck(false) // 开启延迟ACK
 	}
-	defer target.Close() // 确保函数退出时关闭目标连接
 
 	// 将gVisor的TCP端点包装为Go标准的net.Conn接口
 	cep := gonet.NewTCPConn(&wq, ep)
 	defer cep.Close() // 确保函数退出时关闭连接
 
-	// 创建错误通道，用于协程间通信
-	errChan := make(chan error, 2)
-	defer close(errChan) // 确保函数退出时关闭通道
+	// 获取到目标地址的连接
+	if target == nil {
+		// 有域名规则时从本地程序发送的第一段数据(TLS SNI或HTTP Host)中获取域名
+		var peeked []byte
+		if m.needHost() {
+			var err error
+			md.Host, peeked, err = sniff.Host(cep, sniffTimeout)
+			if err != nil {
+				// 读取出错(如本地程序发完请求后半关闭)时按目标IP路由，已读取的数据仍需发给目标
+				log.Debug("嗅探域名失败", zap.String("addr", addr), zap.Error(err))
+				md.Host = ""
+			}
+		}
 
-	// 使用WaitGroup等待两个协程完成
-	wg := &sync.WaitGroup{}
-	// 等待所有协程完成
-	defer wg.Wait()
+		// 本地程序的数据(除已嗅探的部分)还未发出，连接失败时可以换用其他上游
+		rule = m.route(md)
+		t, used, err := m.dialRoute(up, rule, addr)
+		if err != nil {
+			if errors.Is(err, ErrRejected) {
+				ep.Abort() // 回复RST
+			}
+			return
+		}
+		target, up = t, used
+		defer target.Close() // 确保函数退出时关闭目标连接
+
+		// 嗅探时读取的数据原样发给目标
+		if len(peeked) > 0 {
+			if _, err := target.Write(peeked); err != nil {
+				return
+			}
+		}
+	}
 
-	wg.Add(2) // 需要等待2个协程
+	m.relay(up.ctx, cep, target, m.limiters(up, proxied(up, rule), md.Process, ruleNames(rule)))
+}
 
-	// 启动协程1：从目标连接读取数据并写入客户端端点
-	go func() {
-		defer wg.Done()
-		_, err := io.Copy(cep, target)
-		errChan <- err // 发送可能发生的错误
-	}()
+// rejectRequest 延迟握手模式下上游连接失败时拒绝本地程序的连接请求
+// 未配置丢弃时长时立即回复RST，否则在该时长内不做回应(本地程序表现为连接超时)，期间重传的SYN同样被忽略
+func (m *manager) rejectRequest(r *tcp.ForwarderRequest) {
+	timeout := time.Duration(m.proxyJson.DelayHandshakeDropTimeout) * time.Second
+	if timeout <= 0 {
+		r.Complete(true)
+		return
+	}
 
-	// 启动协程2：从客户端端点读取数据并写入目标连接
-	go func() {
-		defer wg.Done()
-		_, err = io.Copy(target, cep)
-		errChan <- err // 发送可能发生的错误
-	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-	// 等待以下两种情况之一发生：
 	select {
-	case err := <-errChan: // 1. 任一协程发生错误
-		if err != nil {
-			log.Error("数据传输错误", zap.Any("error", err))
-		}
-	case <-m.tcm.Context().Done(): // 2. 上下文被取消
-
+	case <-timer.C:
+	case <-m.tcm.Context().Done():
 	}
 
-	// 关闭连接
-	cep.Close()
-	target.Close()
-
-	fmt.Println("连接代理结束")
+	r.Complete(false)
 }
 
-// getConn 根据配置获取到目标地址的连接
+// getConn 通过指定上游获取到目标地址的连接
+// 单次拨号受拨号超时限制，拨号和代理握手的总时长不超过 拨号超时+握手超时，ctx或上游被取消时中止
+// 上游熔断时直接返回 ErrBreakerOpen，连接结果(包括建立后立即被重置)计入熔断器
 // 返回net.Conn连接对象和可能的错误
-func (m *manager) getConn(addr string) (net.Conn, error) {
-	switch m.proxyJson.ProxyType {
+func (m *manager) getConn(ctx context.Context, up *upstream, addr string) (net.Conn, error) {
+	token, allowed := up.breaker.Allow()
+	if !allowed {
+		return nil, fmt.Errorf("%w: %s", ErrBreakerOpen, up.name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.dialTimeout()+m.proxyHandshakeTimeout())
+	defer cancel()
+	defer context.AfterFunc(up.ctx, cancel)()
+
+	cfg := up.cfg
+	var conn net.Conn
+	var ok bool
+	var err error
+	switch cfg.ProxyType {
 	case "socks": // SOCKS代理
-		return socks.GetConn(m.tcm.Context(), m.proxyJson.ProxyUrl, addr)
+		conn, err = socks.GetConn(ctx, up.dialer, cfg.ProxyUrl, addr)
 	case "http": // HTTP代理
-		return http.GetConn(m.tcm.Context(), m.proxyJson.ProxyUrl, addr)
+		conn, err = http.GetConn(ctx, up.dialer, cfg.ProxyUrl, addr)
 	// Trojan代理支持，
-	case "trojan":
-		return trojan.GetConn(
-			m.tcm.Context(),
-			m.proxyJson.TrojanProxy.Server,
-			m.proxyJson.TrojanProxy.Password,
-			addr,
-			m.proxyJson.TrojanProxy.Domain,
-			m.proxyJson.TrojanProxy.InsecureSkipVerify,
-		)
-	case "oks":
-		return oks.GetConn(m.tcm.Context(), m.proxyJson.ProxyUrl, addr)
+	case "trojan": // 有预先完成TLS握手的连接时只需写入头部
+		if tc, ok := up.warm.Get().(*tls.Conn); ok {
+			conn, err = trojan.Open(tc, cfg.TrojanProxy.Password, addr)
+		} else {
+			conn, err = trojan.GetConn(
+				ctx,
+				up.dialer,
+				cfg.TrojanProxy.Server,
+				cfg.TrojanProxy.Password,
+				addr,
+				cfg.TrojanProxy.Domain,
+				cfg.TrojanProxy.InsecureSkipVerify,
+			)
+		}
+	case "oks": // 开启多路复用时优先使用连接池中的流，否则优先使用预先建立的连接
+		if conn, ok, err = muxStream(ctx, up, addr, oks.OpenStream); !ok {
+			if pc := up.warm.Get(); pc != nil {
+				conn, err = oks.Open(ctx, pc, addr)
+			} else {
+				conn, err = oks.GetConn(ctx, up.dialer, cfg.ProxyUrl, addr)
+			}
+		}
 	case "bss":
-		return bss.GetConn(m.tcm.Context(), m.proxyJson.ProxyUrl, addr)
-	default: // 不支持的代理类型
-
+		if conn, ok, err = muxStream(ctx, up, addr, bss.OpenStream); !ok {
+			if pc := up.warm.Get(); pc != nil {
+				conn, err = bss.Open(ctx, pc, addr)
+			} else {
+				conn, err = bss.GetConn(ctx, up.dialer, cfg.ProxyUrl, addr)
+			}
+		}
+	default: // 未配置代理时直连
+		return m.dialDirect(up, addr)
 	}
 
-	// 创建 Dialer 实例
-	dialer := &net.Dialer{}
-
-	// 使用上下文进行连接
-	return dialer.DialContext(m.tcm.Context(), "tcp", addr)
+	if err != nil {
+		m.reportUpstream(up, token, err)
+		return nil, err
+	}
+	return watchConn(conn, func(err error) { m.reportUpstream(up, token, err) }), nil
 }
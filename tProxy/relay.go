@@ -0,0 +1,147 @@
+package tProxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"transparent/log"
+	"transparent/utils/bandwidth"
+)
+
+// defaultHalfCloseTimeout 一个方向结束后等待另一方向结束的默认时长
+const defaultHalfCloseTimeout = 60 * time.Second
+
+// relay 在客户端连接和目标连接之间双向转发数据
+// 一个方向读到EOF时对另一端执行CloseWrite(半关闭)，两个方向都结束或等待超时后才完全关闭
+// ctx: 取消时关闭两端，manager停止或所用上游被切换回收时取消
+// limiters: 连接经过的限速器，上传和下载分别限速
+func (m *manager) relay(ctx context.Context, client, target net.Conn, limiters []*bandwidth.Limiter) {
+	// 连接最长存活时间，到期后关闭两端使两个方向的转发结束
+	if lifetime := seconds(m.proxyJson.MaxLifetime, 0); lifetime > 0 {
+		t := time.AfterFunc(lifetime, func() {
+			client.Close()
+			target.Close()
+		})
+		defer t.Stop()
+	}
+
+	// 创建错误通道，用于协程间通信
+	errChan := make(chan error, 2)
+	defer close(errChan) // 确保函数退出时关闭通道
+
+	// 使用WaitGroup等待两个协程完成
+	wg := &sync.WaitGroup{}
+	// 等待所有协程完成
+	defer wg.Wait()
+
+	wg.Add(2) // 需要等待2个协程
+
+	// 空闲超时: 两个方向都超过各自的空闲超时未读到数据时关闭两端
+	idle := newIdleWatch(seconds(m.proxyJson.UploadIdleTimeout, 0), seconds(m.proxyJson.DownloadIdleTimeout, 0))
+	var uploadLast, downloadLast *atomic.Int64
+	if idle != nil {
+		uploadLast, downloadLast = &idle.uploadLast, &idle.downloadLast
+		stop := make(chan struct{})
+		defer close(stop)
+		go idle.run(stop, func() {
+			client.Close()
+			target.Close()
+		})
+	}
+
+	// 启动协程1：从目标连接读取数据并写入客户端
+	go func() {
+		defer wg.Done()
+		src := newIdleReader(target, seconds(m.proxyJson.FirstByteTimeout, 0), downloadLast)
+		src = bandwidth.NewReader(ctx, src, bandwidth.Download, limiters...)
+		errChan <- copyHalf(client, src) // 发送可能发生的错误
+	}()
+
+	// 启动协程2：从客户端读取数据并写入目标连接
+	go func() {
+		defer wg.Done()
+		src := newIdleReader(client, 0, uploadLast)
+		src = bandwidth.NewReader(ctx, src, bandwidth.Upload, limiters...)
+		errChan <- copyHalf(target, src) // 发送可能发生的错误
+	}()
+
+	// 等待第一个方向结束
+	select {
+	case err := <-errChan:
+		if err != nil {
+			// 出错时直接关闭两端
+			logRelayError(err, idle)
+		} else {
+			// 正常半关闭，等待另一方向结束或超时
+			m.waitHalfClose(ctx, errChan, idle)
+		}
+	case <-ctx.Done(): // 上下文被取消
+	}
+
+	// 关闭连接
+	client.Close()
+	target.Close()
+
+	fmt.Println("连接代理结束")
+}
+
+// waitHalfClose 等待另一方向结束、半关闭超时或上下文取消
+func (m *manager) waitHalfClose(ctx context.Context, errChan <-chan error, idle *idleWatch) {
+	timer := time.NewTimer(m.halfCloseTimeout())
+	defer timer.Stop()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			logRelayError(err, idle)
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// halfCloseTimeout 半关闭后等待另一方向结束的时长
+func (m *manager) halfCloseTimeout() time.Duration {
+	if m.proxyJson.HalfCloseTimeout > 0 {
+		return time.Duration(m.proxyJson.HalfCloseTimeout) * time.Second
+	}
+	return defaultHalfCloseTimeout
+}
+
+// logRelayError 记录转发错误，超时(包括空闲超时关闭连接导致的错误)属于正常回收，只记录调试日志
+func logRelayError(err error, idle *idleWatch) {
+	if idle.isExpired() {
+		return
+	}
+	if isTimeout(err) {
+		log.Debug("连接超时关闭", zap.Error(err))
+		return
+	}
+	log.Error("数据传输错误", zap.Any("error", err))
+}
+
+// copyHalf 从src复制数据到dst，src读到EOF后关闭dst的写方向
+// dst不支持半关闭时返回错误，由调用方关闭两端
+func copyHalf(dst net.Conn, src io.Reader) error {
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	return closeWrite(dst)
+}
+
+// closeWrite 关闭连接的写方向
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,145 @@
+package tProxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair 返回一对已连接的本机TCP连接
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// app 本地程序一侧，server 目标服务器一侧，返回读到的全部数据
+		app, server func(c net.Conn) string
+		wantApp     string
+		wantServer  string
+		cancel      bool // 半关闭后取消ctx
+		minDuration time.Duration
+		maxDuration time.Duration
+	}{
+		{
+			// 本地程序发完请求后半关闭，目标读到EOF后回复并关闭
+			name: "client closes write first",
+			app: func(c net.Conn) string {
+				c.Write([]byte("request"))
+				closeWrite(c)
+				b, _ := io.ReadAll(c)
+				return string(b)
+			},
+			server: func(c net.Conn) string {
+				b, _ := io.ReadAll(c)
+				c.Write([]byte("response"))
+				c.Close()
+				return string(b)
+			},
+			wantApp: "response", wantServer: "request", maxDuration: 500 * time.Millisecond,
+		},
+		{
+			// 目标先发完数据并半关闭，本地程序读到EOF后仍可发送
+			name: "server closes write first",
+			app: func(c net.Conn) string {
+				b, _ := io.ReadAll(c)
+				c.Write([]byte("bye"))
+				c.Close()
+				return string(b)
+			},
+			server: func(c net.Conn) string {
+				c.Write([]byte("banner"))
+				closeWrite(c)
+				b, _ := io.ReadAll(c)
+				return string(b)
+			},
+			wantApp: "banner", wantServer: "bye", maxDuration: 500 * time.Millisecond,
+		},
+		{
+			// 目标一直不关闭，半关闭超时后关闭两端
+			name: "half close timeout",
+			app: func(c net.Conn) string {
+				closeWrite(c)
+				b, _ := io.ReadAll(c)
+				return string(b)
+			},
+			server: func(c net.Conn) string {
+				b, _ := io.ReadAll(c)
+				c.Write([]byte("late"))
+				return string(b)
+			},
+			wantApp: "late", minDuration: time.Second, maxDuration: 2 * time.Second,
+		},
+		{
+			// 半关闭期间上游被回收
+			name: "cancel while half closed",
+			app: func(c net.Conn) string {
+				closeWrite(c)
+				b, _ := io.ReadAll(c)
+				return string(b)
+			},
+			server: func(c net.Conn) string {
+				b, _ := io.ReadAll(c)
+				return string(b)
+			},
+			cancel: true, maxDuration: 500 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, client := tcpPair(t)
+			target, server := tcpPair(t)
+			m := &manager{proxyJson: &ProxyJson{HalfCloseTimeout: 1}}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(100*time.Millisecond, cancel)
+			}
+
+			appGot, serverGot := make(chan string, 1), make(chan string, 1)
+			go func() { appGot <- tt.app(app) }()
+			go func() { serverGot <- tt.server(server) }()
+
+			start := time.Now()
+			m.relay(ctx, client, target, nil)
+			if d := time.Since(start); d < tt.minDuration || d > tt.maxDuration {
+				t.Fatalf("relay took %v, want %v-%v", d, tt.minDuration, tt.maxDuration)
+			}
+
+			if got := <-appGot; got != tt.wantApp {
+				t.Errorf("app read %q, want %q", got, tt.wantApp)
+			}
+			if got := <-serverGot; got != tt.wantServer {
+				t.Errorf("server read %q, want %q", got, tt.wantServer)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package tProxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+
+	"transparent/log"
+)
+
+const (
+	// defaultRetryAttempts 经过代理连接目标时默认最多尝试的上游数(包括第一次)
+	defaultRetryAttempts = 3
+
+	// defaultRetryBudget 所有尝试的默认总时长
+	defaultRetryBudget = 30 * time.Second
+)
+
+// retryAttempts 最多尝试的上游数
+func (m *manager) retryAttempts() int {
+	if m.proxyJson.Retry.Attempts > 0 {
+		return m.proxyJson.Retry.Attempts
+	}
+	return defaultRetryAttempts
+}
+
+// candidates 连接目标时依次尝试的上游: 连接开始时的上游，之后是分组中其他可用的上游
+func (m *manager) candidates(first *upstream) []*upstream {
+	out := []*upstream{first}
+	for _, u := range m.upstreams() {
+		if u != first && m.available(u) {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// dialRetry 经过上游连接目标，失败时依次换用下一个候选上游，直到成功、达到尝试次数或用完总时长
+// 只在连接代理服务器和代理握手阶段重试，此时本地程序的数据还未发给任何上游
+// 发生过失败时每次尝试的错误记录在同一条日志中，返回实际使用的上游
+func (m *manager) dialRetry(first *upstream, addr string) (net.Conn, *upstream, error) {
+	ctx, cancel := context.WithTimeout(m.tcm.Context(), seconds(m.proxyJson.Retry.Budget, defaultRetryBudget))
+	defer cancel()
+
+	var attempts []string
+	var lastErr error
+	for i, up := range m.candidates(first) {
+		if i >= m.retryAttempts() || ctx.Err() != nil {
+			break
+		}
+
+		conn, err := m.getConn(ctx, up, addr)
+		if err == nil {
+			if len(attempts) > 0 {
+				log.Info("换用上游连接成功", zap.String("addr", addr), zap.String("upstream", up.name), zap.Strings("attempts", attempts))
+			}
+			return conn, up, nil
+		}
+		attempts = append(attempts, up.name+": "+err.Error())
+		lastErr = err
+
+		// 连接循环换用上游也无法解决
+		if errors.Is(err, ErrSelfConnection) {
+			break
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	log.Warn("连接目标失败", zap.String("addr", addr), zap.Strings("attempts", attempts))
+	return nil, first, lastErr
+}
@@ -0,0 +1,145 @@
+package tProxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"transparent/gvisor.dev/gvisor/pkg/tcpip/stack"
+	"transparent/log"
+	"transparent/utils/bandwidth"
+	"transparent/utils/rules"
+)
+
+// ErrRejected 连接命中了REJECT规则
+var ErrRejected = errors.New("连接被路由规则拒绝")
+
+// sniffTimeout 嗅探目标域名时等待客户端数据的最长时间
+const sniffTimeout = 300 * time.Millisecond
+
+// loadRules 加载路由规则，未配置时所有连接经过上游
+func (m *manager) loadRules() error {
+	rules.DefaultGeo().Configure(m.proxyJson.Geo)
+	if len(m.proxyJson.Rules) == 0 {
+		return nil
+	}
+
+	// 配置了限速的规则不合并，避免限速按合并后的规则共享
+	keep := make([]string, 0, len(m.proxyJson.RuleBandwidth))
+	for name := range m.proxyJson.RuleBandwidth {
+		keep = append(keep, name)
+	}
+	router, err := rules.New(m.proxyJson.Rules, nil, keep...)
+	if err != nil {
+		return fmt.Errorf("加载路由规则失败 error:%w", err)
+	}
+	m.router = router
+
+	log.Info("已加载路由规则", zap.Int("rules", router.Len()))
+	return nil
+}
+
+// route 返回连接命中的规则，未配置规则或未命中时返回nil(经过上游)
+func (m *manager) route(md *rules.Metadata) *rules.Rule {
+	if m.router == nil {
+		return nil
+	}
+
+	rule := m.router.Match(md)
+	if rule != nil {
+		log.Debug("命中路由规则", zap.String("rule", rule.String()), zap.String("host", md.Host),
+			zap.Stringer("dst", netip.AddrPortFrom(md.DstIP, md.DstPort)))
+	}
+	return rule
+}
+
+// needHost 是否需要嗅探目标域名
+func (m *manager) needHost() bool {
+	return m.router != nil && m.router.NeedHost()
+}
+
+// needProcess 是否需要查询发起连接的进程名(进程规则或进程限速)
+func (m *manager) needProcess() bool {
+	return (m.router != nil && m.router.NeedProcess()) || bandwidth.Default().HasProcess()
+}
+
+// stackMetadata 根据协议栈连接构造匹配规则的信息
+func (m *manager) stackMetadata(id stack.TransportEndpointID) *rules.Metadata {
+	md := &rules.Metadata{
+		DstIP:   netip.AddrFrom4(id.LocalAddress.As4()),
+		DstPort: id.LocalPort,
+		SrcIP:   netip.AddrFrom4(id.RemoteAddress.As4()),
+	}
+	if m.needProcess() {
+		if pid := m.flows.pid(newStackFlowKey(id)); pid != 0 {
+			md.Process = processName(pid)
+		}
+	}
+	return md
+}
+
+// inboundMetadata 根据本地代理入站请求构造匹配规则的信息，目标为域名时不解析
+func inboundMetadata(conn net.Conn, target string) *rules.Metadata {
+	md := &rules.Metadata{}
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			md.DstIP = addr.Unmap()
+		} else {
+			md.Host = host
+		}
+		if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+			md.DstPort = uint16(p)
+		}
+	}
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		md.SrcIP = remote.AddrPort().Addr().Unmap()
+	}
+	return md
+}
+
+// dialRoute 按命中规则的动作连接目标，REJECT时返回ErrRejected
+// 经过代理时连接失败会换用分组中的其他上游重试，返回实际使用的上游
+func (m *manager) dialRoute(up *upstream, rule *rules.Rule, addr string) (net.Conn, *upstream, error) {
+	if rule != nil {
+		switch rule.Action() {
+		case rules.ActionReject:
+			return nil, up, ErrRejected
+		case rules.ActionDirect:
+			conn, err := m.dialDirect(up, addr)
+			return conn, up, err
+		}
+	}
+	return m.dialRetry(up, addr)
+}
+
+// dialDirect 不经过代理服务器直接连接目标
+func (m *manager) dialDirect(up *upstream, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(up.ctx, m.dialTimeout())
+	defer cancel()
+
+	conn, err := up.dialer.DialContext(ctx, "tcp", addr)
+	if err == nil && isSelfConnected(conn) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: 连接 %s 连到了自身", ErrSelfConnection, addr)
+	}
+	return conn, err
+}
+
+// proxied 连接是否经过代理服务器
+func proxied(up *upstream, rule *rules.Rule) bool {
+	return up.usesProxy() && (rule == nil || rule.Action() == rules.ActionProxy)
+}
+
+// ruleNames 规则限速使用的名称，合并的规则包含每条原始规则，未命中规则时为空
+func ruleNames(rule *rules.Rule) []string {
+	if rule == nil {
+		return nil
+	}
+	return rule.Names()
+}
@@ -2,7 +2,7 @@ package tProxy
 
 import (
 	"context"
-	"fmt"
+	"net/netip"
 	"os"
 
 	"github.com/lysShub/divert-go"
@@ -17,108 +17,185 @@ import (
 
 // runReadDivert 从Windows Divert驱动读取并处理网络数据包
 // ctx: 上下文对象，用于控制协程生命周期和取消信号
-func (m *manager) runReadDivert(ctx context.Context) {
-	var addr divert.Address        // 存储数据包的目标地址信息
-	tempBuf := make([]byte, m.mtu) // 创建临时缓冲区，大小为MTU
+// 返回读取失败的原因
+func (m *manager) runReadDivert(ctx context.Context) error {
+	// 等待绑定出口网卡
+	select {
+	case <-m.bound:
+	case <-ctx.Done():
+		return nil
+	}
+
+	return m.readPackets(ctx, m.handle.Load)
+}
+
+// readPackets 从句柄读取数据包并分发给处理协程
+// load: 返回当前句柄，句柄被替换时从新句柄继续读取
+func (m *manager) readPackets(ctx context.Context, load func() *divert.Handle) error {
+	var addr divert.Address // 存储数据包的目标地址信息
 
 Loop: // 主循环标签
 	for {
+		// 从缓冲池获取数据包缓冲区，所有权随数据包交给协议栈或在转发后释放
+		v := buffer.NewViewSize(int(m.mtu.Load()))
+
 		// 从Divert驱动读取数据包
-		n, err := m.handle.Recv(tempBuf, &addr)
+		handle := load()
+		n, err := handle.Recv(v.AsSlice(), &addr)
 		if err != nil {
+			v.Release()
 			if errors.Is(err, windows.ERROR_INSUFFICIENT_BUFFER) {
 				// 缓冲区不足，跳过当前数据包继续循环
 				goto Loop
+			} else if load() != handle {
+				// 网卡变化，句柄已被替换，从新句柄继续读取
+				goto Loop
 			} else {
 				// 其他错误直接返回
-				return
+				return err
 			}
 		} else if n == 0 {
 			// 读取到空数据包，继续循环
+			v.Release()
 			goto Loop
 		}
+		v.CapLength(n)
+		if addr.Layer == divert.Network {
+			m.learnSubIfIdx(&addr)
+		}
 
-		// 创建数据包副本以供goroutine安全使用
-		packetCopy := make([]byte, n)
-		copy(packetCopy, tempBuf[:n])
-		addrCopy := addr // 复制地址结构体
+		// 按连接分发给处理协程，分类和注入在处理协程中并行执行
+		m.dispatchPacket(v, &addr)
+	}
+}
 
-		// 将数据包处理任务提交到任务管理器异步执行
-		m.handlePacket(ctx, packetCopy, &addrCopy)
+// 数据包处理结果
+const (
+	packetPass  = iota // 原样转发
+	packetProxy        // 交给协议栈代理
+	packetDrop         // 丢弃
+)
 
+// handlePacket 处理单个网络数据包，并负责释放v
+// v: 数据包缓冲区
+// addr: 数据包的目标地址信息
+func (m *manager) handlePacket(ctx context.Context, v *buffer.View, addr *divert.Address) {
+	switch m.classifyPacket(ctx, v.AsSlice(), addr) {
+	case packetProxy:
+		m.handleProxyConnection(v)
+	case packetPass:
+		m.sendHandle(addr).Send(v.AsSlice(), addr)
+		v.Release()
+	default:
+		v.Release()
 	}
 }
 
-// handlePacket 处理单个网络数据包
+// classifyPacket 判断数据包应转发、代理还是丢弃
 // packet: 数据包字节切片
-// addr: 数据包的目标地址信息
-func (m *manager) handlePacket(ctx context.Context, packet []byte, addr *divert.Address) {
+// addr: 数据包的地址信息，用于记录连接所在的网卡
+func (m *manager) classifyPacket(ctx context.Context, packet []byte, addr *divert.Address) int {
 	// 1. 基本长度检查
 	if len(packet) < header.IPv4MinimumSize {
-		return
+		return packetDrop
 	}
 
 	// 2. IPv4头部验证
 	ipv4 := header.IPv4(packet)
 	if !ipv4.IsValid(len(packet)) {
 		// 无效IP包，直接原样转发
-		m.handle.Send(packet, addr)
-		return
+		return packetPass
 	}
 
 	// 5. TCP头部验证
 	tcpHdr := header.TCP(ipv4.Payload())
+	if len(tcpHdr) < header.TCPMinimumSize || len(tcpHdr) < int(tcpHdr.DataOffset()) {
+		return packetPass
+	}
+
+	// 提取连接四元组信息
+	key := newFlowKey(ipv4, tcpHdr)
+	dataLen := len(tcpHdr) - int(tcpHdr.DataOffset())
 
 	if tcpHdr.Flags().Contains(header.TCPFlagSyn) && !tcpHdr.Flags().Contains(header.TCPFlagAck) {
+		// 本程序发出的连接(如连接代理服务器)直接转发，不依赖进程查找
+		if m.isOwnFlow(key) {
+			return packetPass
+		}
+
+		// 直连目标(私有网段、用户配置的网段和域名)不经过代理
+		if m.bypass.match(key.dstAddr) {
+			return packetPass
+		}
+
+		// 优雅关闭期间新连接不再代理，原样转发
+		if m.draining.Load() {
+			return packetPass
+		}
+
+		// 网关模式转发的连接来自其他设备，不查找进程，按源地址规则决定是否代理
+		if addr.Layer == divert.NetworkForward {
+			if !m.gateway.match(key.srcAddr) {
+				return packetPass
+			}
+			m.flows.add(key, tcpHdr, dataLen, 0, flowIface{forward: true})
+			return packetProxy
+		}
+
 		if conns, err := net2.ConnectionsWithContext(ctx, "tcp4"); err == nil && len(conns) > 0 {
-			// 提取连接四元组信息
-			srcAddr := ipv4.SourceAddress().String()
-			srcPort := tcpHdr.SourcePort()
-			dstAddr := ipv4.DestinationAddress().String()
-			dstPort := tcpHdr.DestinationPort()
-			// 存储源地址
-
-			connKey := fmt.Sprintf("%s:%d:%s:%d", srcAddr, srcPort, dstAddr, dstPort)
 			ppid := int32(os.Getpid())
 
+			// 进程查找作为兜底，本程序发出的连接直接转发，其余记录发起连接的进程
+			var pid int32
 			for _, conn := range conns {
-				if connKey == fmt.Sprintf("%s:%d:%s:%d",
-					conn.Laddr.IP, conn.Laddr.Port, conn.Raddr.IP, conn.Raddr.Port) {
-					if ppid == conn.Pid {
-						m.handle.Send(packet, addr)
-						return
+				if matchConnection(key, conn) {
+					if conn.Pid == ppid {
+						return packetPass
 					}
+					pid = conn.Pid
 				}
 			}
 
-			m.tTLMap.Set(connKey)
-			m.handleProxyConnection(packet)
+			nw := addr.Network()
+			m.flows.add(key, tcpHdr, dataLen, pid, flowIface{ifIdx: nw.IfIdx, subIfIdx: nw.SubIfIdx})
+			return packetProxy
 		}
 
-		return
+		return packetDrop
 	}
 
-	// 提取连接四元组信息
-	srcAddr := ipv4.SourceAddress().String()
-	srcPort := tcpHdr.SourcePort()
-	dstAddr := ipv4.DestinationAddress().String()
-	dstPort := tcpHdr.DestinationPort()
-	// 存储源地址
-	connKey := fmt.Sprintf("%s:%d:%s:%d", srcAddr, srcPort, dstAddr, dstPort)
-	if m.tTLMap.Get(connKey) {
-		m.handleProxyConnection(packet)
-		// m.handle.Send(packet, addr)
-		return
+	// 已被代理的连接交给协议栈处理，其余原样转发
+	if m.flows.updateOriginal(key, tcpHdr, dataLen) {
+		return packetProxy
+	}
+	return packetPass
+}
+
+// matchConnection 判断系统连接表中的连接是否与四元组一致
+func matchConnection(key flowKey, conn net2.ConnectionStat) bool {
+	if uint32(key.srcPort) != conn.Laddr.Port || uint32(key.dstPort) != conn.Raddr.Port {
+		return false
+	}
+
+	return matchIPv4(conn.Laddr.IP, key.srcAddr) && matchIPv4(conn.Raddr.IP, key.dstAddr)
+}
+
+// matchIPv4 判断字符串形式的IP是否等于指定IPv4地址
+func matchIPv4(s string, ip [4]byte) bool {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return false
 	}
-	m.handle.Send(packet, addr)
+	addr = addr.Unmap()
+	return addr.Is4() && addr.As4() == ip
 }
 
 // handleProxyConnection 处理代理连接的数据包
-// packet: 已验证的TCP数据包
-func (m *manager) handleProxyConnection(packet []byte) {
-	// 将原始数据包转换为gVisor的PacketBuffer格式
+// v: 已验证的TCP数据包，所有权转移给协议栈，不产生额外拷贝
+func (m *manager) handleProxyConnection(v *buffer.View) {
+	// 将数据包缓冲区转换为gVisor的PacketBuffer格式
 	pktBuffer := stack.NewPacketBuffer(stack.PacketBufferOptions{
-		Payload: buffer.MakeWithData(packet),
+		Payload: buffer.MakeWithView(v),
 	})
 
 	// 将数据包注入到gVisor网络栈中
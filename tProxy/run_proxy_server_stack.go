@@ -3,6 +3,7 @@ package tProxy
 import (
 	"context"
 
+	"github.com/lysShub/divert-go"
 	//"go.uber.org/zap"
 	"transparent/gvisor.dev/gvisor/pkg/tcpip/header"
 	"transparent/gvisor.dev/gvisor/pkg/tcpip/stack"
@@ -12,45 +13,51 @@ import (
 // runReadStack 持续从网络栈读取数据包并进行处理
 // ctx: 上下文对象，用于控制协程生命周期和取消信号
 func (m *manager) runReadStack(ctx context.Context) {
+	// 发送缓冲区在整个循环中复用
+	w := &packetWriter{buf: make([]byte, 0, m.mtu.Load())}
+
 	// 无限循环读取数据包，直到上下文取消或读取失败
 	for {
 		// 带上下文的读取操作，允许被取消
 		pkt := m.channelEp.ReadContext(ctx)
 		// 也可以使用不带上下文的读取: pkt := m.channelEp.Read()
 
-		// 检查数据包有效性
-		if pkt != nil && pkt.Size() > 0 {
-			// 将数据包处理任务提交到任务管理器异步执行
-			m.processPkt(pkt)
-		}
-
 		// 如果读取到nil，表示连接已关闭或出错，退出循环
 		if pkt == nil {
 			return
 		}
+
+		// 检查数据包有效性
+		if pkt.Size() > 0 {
+			m.processPkt(pkt, w)
+		}
+
+		// 释放队列持有的引用，数据包缓冲区归还缓冲池
+		pkt.DecRef()
 	}
 }
 
 // processPkt 处理单个网络数据包
 // pkt: 待处理的数据包指针
-func (m *manager) processPkt(pkt *stack.PacketBuffer) {
+// w: 可复用的发送缓冲区
+func (m *manager) processPkt(pkt *stack.PacketBuffer, w *packetWriter) {
 	// 只处理TCP协议的数据包
 	if pkt.TransportProtocolNumber == header.TCPProtocolNumber {
-		// 创建缓冲区，大小为数据包总大小
-		buf := make([]byte, pkt.Size(), pkt.Size())
-
-		// 将数据包各部分拷贝到缓冲区:
-		// 1. 拷贝网络层头部(如IP头)
-		copy(buf[:], pkt.NetworkHeader().Slice())
-		// 2. 拷贝传输层头部(如TCP头)
-		copy(buf[len(pkt.NetworkHeader().Slice()):], pkt.TransportHeader().Slice())
-		// 3. 拷贝实际负载数据
-		copy(buf[len(pkt.NetworkHeader().Slice())+len(pkt.TransportHeader().Slice()):],
-			pkt.Data().AsRange().ToSlice())
+		// 更新连接跟踪状态(回复方向)
+		iface, ok := m.flows.updateReply(
+			newReplyFlowKey(header.IPv4(pkt.NetworkHeader().Slice()), header.TCP(pkt.TransportHeader().Slice())),
+			header.TCP(pkt.TransportHeader().Slice()),
+			pkt.Data().Size(),
+		)
+
+		// 从连接所在的网卡注入，未跟踪的连接(如对未知连接回复的RST)使用默认地址
+		addr := m.injectAddr.Load()
+		if ok {
+			addr = w.address(addr, iface)
+		}
 
 		// 通过handle发送处理后的数据
-		m.handle.Send(buf, m.defaultAddrrr)
-		// _, err := m.handle.Send(buf, m.defaultAddrrr)
+		m.handle.Load().Send(w.gather(pkt), addr)
 		// if err != nil {
 		// 	log.Error("发送处理后的数据包失败",
 		// 		zap.Any("error", err),
@@ -58,3 +65,38 @@ func (m *manager) processPkt(pkt *stack.PacketBuffer) {
 		// }
 	}
 }
+
+// packetWriter 将数据包的网络层头部、传输层头部和负载拼接到可复用的缓冲区
+// divert-go 的 Send 不支持分散/聚集写，因此在同一缓冲区中聚集后一次发送
+type packetWriter struct {
+	buf  []byte
+	addr divert.Address // 可复用的注入地址
+}
+
+// address 以def为模板生成指定网卡的注入地址，返回的指针在下次调用前有效
+func (w *packetWriter) address(def *divert.Address, iface flowIface) *divert.Address {
+	w.addr = *def
+	if iface.forward {
+		// 回复给局域网设备的数据包以出站方向注入，由系统路由到对应网卡
+		w.addr.SetOutbound(true)
+		return &w.addr
+	}
+
+	nw := w.addr.Network()
+	nw.IfIdx = iface.ifIdx
+	nw.SubIfIdx = iface.subIfIdx
+	return &w.addr
+}
+
+func (w *packetWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// gather 聚集数据包各部分，返回的切片在下次调用前有效
+func (w *packetWriter) gather(pkt *stack.PacketBuffer) []byte {
+	w.buf = append(w.buf[:0], pkt.NetworkHeader().Slice()...)
+	w.buf = append(w.buf, pkt.TransportHeader().Slice()...)
+	pkt.Data().ReadTo(w, true)
+	return w.buf
+}
@@ -0,0 +1,111 @@
+package tProxy
+
+import (
+	"fmt"
+	"time"
+
+	"transparent/gvisor.dev/gvisor/pkg/tcpip"
+	"transparent/gvisor.dev/gvisor/pkg/tcpip/stack"
+	"transparent/gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+const (
+	// defaultQueueSize 通道端点默认队列长度
+	defaultQueueSize = 512
+
+	// defaultMaxInFlight 默认最大同时握手中的连接数
+	defaultMaxInFlight = 1 << 15
+
+	// defaultReceiveWindow 转发器默认初始接收窗口
+	defaultReceiveWindow = 16 << 10
+)
+
+// stackOptions 已填充默认值并校验过的协议栈参数
+type stackOptions struct {
+	queueSize     int
+	maxInFlight   int
+	receiveWindow int
+	receiveBuffer tcpip.TCPReceiveBufferSizeRangeOption
+	sendBuffer    tcpip.TCPSendBufferSizeRangeOption
+	sack          tcpip.TCPSACKEnabled
+	cc            tcpip.CongestionControlOption
+	moderate      tcpip.TCPModerateReceiveBufferOption
+	groTimeout    time.Duration
+}
+
+// stackOptions 根据配置生成协议栈参数，未配置的项使用默认值
+func (m *manager) stackOptions() (*stackOptions, error) {
+	cfg := &m.proxyJson.Stack
+
+	o := &stackOptions{
+		queueSize:     orDefault(cfg.QueueSize, defaultQueueSize),
+		maxInFlight:   orDefault(cfg.MaxInFlight, defaultMaxInFlight),
+		receiveWindow: orDefault(cfg.ReceiveWindow, defaultReceiveWindow),
+		receiveBuffer: tcpip.TCPReceiveBufferSizeRangeOption{
+			Min:     orDefault(cfg.ReceiveBufferMin, tcp.MinBufferSize),
+			Default: orDefault(cfg.ReceiveBufferDefault, tcp.DefaultReceiveBufferSize),
+			Max:     orDefault(cfg.ReceiveBufferMax, tcp.MaxBufferSize),
+		},
+		sendBuffer: tcpip.TCPSendBufferSizeRangeOption{
+			Min:     orDefault(cfg.SendBufferMin, tcp.MinBufferSize),
+			Default: orDefault(cfg.SendBufferDefault, tcp.DefaultSendBufferSize),
+			Max:     orDefault(cfg.SendBufferMax, tcp.MaxBufferSize),
+		},
+		sack:       tcpip.TCPSACKEnabled(cfg.SACK),
+		cc:         tcpip.CongestionControlOption(cfg.CongestionControl),
+		moderate:   tcpip.TCPModerateReceiveBufferOption(!cfg.DisableModerateReceiveBuffer),
+		groTimeout: time.Duration(cfg.GROTimeout) * time.Microsecond,
+	}
+
+	// 校验
+	if cfg.QueueSize < 0 || cfg.MaxInFlight < 0 || cfg.ReceiveWindow < 0 || cfg.GROTimeout < 0 {
+		return nil, fmt.Errorf("协议栈参数不能为负数")
+	}
+	if r := o.receiveBuffer; r.Min < tcp.MinBufferSize || r.Default < r.Min || r.Default > r.Max {
+		return nil, fmt.Errorf("接收缓冲区范围无效 min:%d default:%d max:%d", r.Min, r.Default, r.Max)
+	}
+	if r := o.sendBuffer; r.Min < tcp.MinBufferSize || r.Default < r.Min || r.Default > r.Max {
+		return nil, fmt.Errorf("发送缓冲区范围无效 min:%d default:%d max:%d", r.Min, r.Default, r.Max)
+	}
+	switch o.cc {
+	case "":
+		o.cc = "reno"
+	case "reno", "cubic":
+	default:
+		return nil, fmt.Errorf("不支持的拥塞控制算法: %s", o.cc)
+	}
+
+	return o, nil
+}
+
+// apply 将参数设置到协议栈和网卡
+func (o *stackOptions) apply(s *stack.Stack, nicID tcpip.NICID) error {
+	opts := []tcpip.SettableTransportProtocolOption{
+		&o.receiveBuffer,
+		&o.sendBuffer,
+		&o.sack,
+		&o.cc,
+		&o.moderate,
+	}
+	for _, opt := range opts {
+		if tcperr := s.SetTransportProtocolOption(tcp.ProtocolNumber, opt); tcperr != nil {
+			return fmt.Errorf("设置TCP参数失败 option:%T error:%+v", opt, tcperr)
+		}
+	}
+
+	if o.groTimeout > 0 {
+		if tcperr := s.SetGROTimeout(nicID, o.groTimeout); tcperr != nil {
+			return fmt.Errorf("设置GRO超时失败 error:%+v", tcperr)
+		}
+	}
+
+	return nil
+}
+
+// orDefault 配置值为0时返回默认值
+func orDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
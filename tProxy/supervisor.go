@@ -0,0 +1,310 @@
+package tProxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"transparent/log"
+	"transparent/utils/health"
+)
+
+const (
+	// defaultRestartBackoff 第一次重启前的默认等待时长
+	defaultRestartBackoff = time.Second
+
+	// defaultRestartMaxBackoff 重启等待时长的默认上限
+	defaultRestartMaxBackoff = time.Minute
+
+	// restartStableDuration 运行超过该时长后视为稳定，重新从最短等待时长开始计算
+	restartStableDuration = time.Minute
+)
+
+// 代理健康状态
+const (
+	HealthStarting   = "starting"   // 正在启动
+	HealthRunning    = "running"    // 正常运行
+	HealthRestarting = "restarting" // 异常退出，等待重启
+	HealthFailed     = "failed"     // 超过最大重启次数，已放弃
+	HealthStopped    = "stopped"    // 已停止
+)
+
+// Health 代理健康状态
+type Health struct {
+	State     string    // 见 Health* 常量
+	Reason    string    `json:",omitempty"` // 最近一次异常的原因标识，见 Reason* 常量
+	Error     string    `json:",omitempty"` // 最近一次异常的错误信息
+	Attempts  int       // 连续失败次数
+	NextRetry time.Time // 下次重启的时间，仅 restarting 状态有效
+}
+
+// Supervisor 监督代理运行，启动失败或异常退出时按指数退避重启
+// 实现 Manager 接口，可代替 manager 使用
+type Supervisor struct {
+	mu     sync.Mutex
+	cfg    *ProxyJson // 重启时使用的配置，切换上游后同步更新
+	cur    Manager    // 当前运行的代理，未运行时为nil
+	health Health
+	kill   *killSwitch // 阻断模式，重启期间保持阻断，未开启时为nil
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	drain    atomic.Bool // 停止时是否优雅关闭
+	done     chan error  // 监督循环结束时关闭
+	startErr error
+	start    sync.Once
+
+	// 创建每次运行的代理，测试中替换以脱离WinDivert运行监督循环
+	newManager func(cfg *ProxyJson, kill *killSwitch) Manager
+
+	// 重启等待时长及其上限，运行超过 stable 后重新从最短等待时长开始计算
+	backoff    time.Duration
+	maxBackoff time.Duration
+	stable     time.Duration
+}
+
+var _ Manager = (*Supervisor)(nil)
+
+// NewSupervisor 创建监督者
+func NewSupervisor(proxyJson *ProxyJson) *Supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Supervisor{
+		cfg:        proxyJson,
+		health:     Health{State: HealthStarting},
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan error),
+		newManager: newSupervisedManager,
+		backoff:    seconds(proxyJson.RestartBackoff, defaultRestartBackoff),
+		maxBackoff: seconds(proxyJson.RestartMaxBackoff, defaultRestartMaxBackoff),
+		stable:     restartStableDuration,
+	}
+}
+
+// newSupervisedManager 创建由监督者运行的代理，与监督者共用阻断模式
+func newSupervisedManager(cfg *ProxyJson, kill *killSwitch) Manager {
+	t := NewManager(cfg)
+	t.kill = kill
+	return t
+}
+
+// Start 启动监督循环，返回的通道在放弃重启或停止后关闭
+// 阻断模式配置错误时返回错误，健康状态为 failed
+func (s *Supervisor) Start() (<-chan error, error) {
+	s.start.Do(func() {
+		if s.kill, s.startErr = newKillSwitch(s.cfg); s.startErr != nil {
+			s.setHealth(Health{State: HealthFailed, Reason: Reason(s.startErr), Error: s.startErr.Error()})
+			close(s.done)
+			return
+		}
+		go s.run()
+	})
+	if s.startErr != nil {
+		return nil, s.startErr
+	}
+	return s.done, nil
+}
+
+// run 监督循环
+// 开启阻断模式时，从启动到代理运行之前以及异常退出到重启成功之间一直阻断
+// 放弃重启后继续阻断，直到调用 Stop 或 Drain 主动停止时解除
+func (s *Supervisor) run() {
+	defer close(s.done)
+	s.kill.setDown(true)
+
+	attempts := 0
+
+	for {
+		// 1. 启动并等待退出
+		started := time.Now()
+		err := s.runOnce()
+		if s.ctx.Err() != nil {
+			s.setHealth(Health{State: HealthStopped})
+			return
+		}
+
+		// 2. 稳定运行一段时间后重新计算退避
+		if time.Since(started) > s.stable {
+			attempts = 0
+		}
+		attempts++
+
+		reason := Reason(err)
+		if max := s.cfg.RestartMaxAttempts; max > 0 && attempts > max {
+			log.Error("代理异常退出，超过最大重启次数", zap.String("reason", reason), zap.Error(err), zap.Int("attempts", attempts))
+			s.setHealth(Health{State: HealthFailed, Reason: reason, Error: errString(err), Attempts: attempts})
+			return
+		}
+
+		// 3. 指数退避
+		delay := restartDelay(s.backoff, s.maxBackoff, attempts)
+		log.Warn("代理异常退出，等待重启",
+			zap.String("reason", reason),
+			zap.Error(err),
+			zap.Int("attempts", attempts),
+			zap.Duration("delay", delay),
+		)
+		s.setHealth(Health{
+			State:     HealthRestarting,
+			Reason:    reason,
+			Error:     errString(err),
+			Attempts:  attempts,
+			NextRetry: time.Now().Add(delay),
+		})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+			timer.Stop()
+			s.setHealth(Health{State: HealthStopped})
+			return
+		}
+	}
+}
+
+// restartDelay 第attempts次连续失败后的重启等待时长，从backoff开始每次翻倍，不超过maxBackoff
+func restartDelay(backoff, maxBackoff time.Duration, attempts int) time.Duration {
+	delay := backoff << min(attempts-1, 30)
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// runOnce 启动一次代理并等待其退出，返回退出原因
+// 启动期间切换的上游在启动后补充应用
+func (s *Supervisor) runOnce() error {
+	s.mu.Lock()
+	cfg := s.cfg
+	t := s.newManager(cfg, s.kill)
+	s.mu.Unlock()
+
+	eCh, err := t.Start()
+	if err != nil {
+		t.Stop()
+		return err
+	}
+
+	s.mu.Lock()
+	s.cur = t
+	s.health = Health{State: HealthRunning}
+	latest := s.cfg
+	s.mu.Unlock()
+	log.Info("代理已启动")
+	if latest != cfg {
+		if err := t.UpdateProxy(latest); err != nil {
+			log.Error("启动期间切换的上游应用失败", zap.Error(err))
+		}
+	}
+	s.kill.setDown(false)
+
+	defer func() {
+		if s.ctx.Err() == nil {
+			s.kill.setDown(true) // 异常退出时先阻断再停止，停止期间不放行
+		}
+		s.mu.Lock()
+		s.cur = nil
+		s.mu.Unlock()
+		t.Stop()
+	}()
+
+	select {
+	case <-s.ctx.Done():
+		if s.drain.Load() {
+			t.Drain()
+		}
+		return nil
+	case err := <-eCh:
+		if err == nil {
+			err = ErrHandleClosed
+		}
+		return err
+	}
+}
+
+// setHealth 更新健康状态
+func (s *Supervisor) setHealth(h Health) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health = h
+}
+
+// Health 返回当前健康状态
+func (s *Supervisor) Health() Health {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.health
+}
+
+// UpdateProxy 切换上游，同时更新之后重启使用的配置
+func (s *Supervisor) UpdateProxy(cfg *ProxyJson) error {
+	s.mu.Lock()
+	next := *s.cfg
+	next.ProxyUrl = cfg.ProxyUrl
+	next.ProxyType = cfg.ProxyType
+	next.TrojanProxy = cfg.TrojanProxy
+	next.Dns = cfg.Dns
+	s.cfg = &next
+	cur := s.cur
+	s.mu.Unlock()
+
+	if cur == nil {
+		return nil
+	}
+	return cur.UpdateProxy(cfg)
+}
+
+// Status 返回当前代理的运行状态和健康状态
+func (s *Supervisor) Status() Status {
+	s.mu.Lock()
+	cur := s.cur
+	health := s.health
+	s.mu.Unlock()
+
+	var st Status
+	if cur != nil {
+		st = cur.Status()
+	}
+	st.Health = &health
+	st.KillSwitch = s.kill.active()
+	return st
+}
+
+// TestUpstream 立即测试当前代理中指定上游的延迟
+func (s *Supervisor) TestUpstream(name string) (health.Result, error) {
+	s.mu.Lock()
+	cur := s.cur
+	s.mu.Unlock()
+
+	if cur == nil {
+		return health.Result{}, errors.New("代理未运行")
+	}
+	return cur.TestUpstream(name)
+}
+
+// Drain 优雅关闭当前代理并停止监督
+func (s *Supervisor) Drain() {
+	s.drain.Store(true)
+	s.Stop()
+}
+
+// Stop 立即停止当前代理并停止监督，解除阻断
+func (s *Supervisor) Stop() {
+	s.cancel()
+	s.start.Do(func() { close(s.done) }) // 未启动时直接结束
+	<-s.done
+	s.kill.release()
+}
+
+// errString 返回错误信息，err为nil时返回空字符串
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
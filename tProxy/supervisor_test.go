@@ -0,0 +1,231 @@
+package tProxy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"transparent/utils/health"
+)
+
+// fakeManager 按脚本启动失败或运行一段时间后退出的代理
+type fakeManager struct {
+	startErr error         // 启动失败的错误
+	run      time.Duration // 启动成功后运行的时长
+	exitErr  error         // 运行结束时的退出原因
+	gate     chan struct{} // 不为nil时启动阻塞到关闭
+
+	mu      sync.Mutex
+	updates []string // 切换过的上游地址
+
+	stop sync.Once
+	done chan struct{}
+}
+
+func (f *fakeManager) Start() (<-chan error, error) {
+	if f.gate != nil {
+		<-f.gate
+	}
+	if f.startErr != nil {
+		return nil, f.startErr
+	}
+
+	eCh := make(chan error, 1)
+	go func() {
+		select {
+		case <-time.After(f.run):
+			eCh <- f.exitErr
+		case <-f.done:
+		}
+	}()
+	return eCh, nil
+}
+
+func (f *fakeManager) Stop()          { f.stop.Do(func() { close(f.done) }) }
+func (f *fakeManager) Drain()         { f.Stop() }
+func (f *fakeManager) Status() Status { return Status{} }
+func (f *fakeManager) UpdateProxy(cfg *ProxyJson) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updates = append(f.updates, cfg.ProxyUrl)
+	return nil
+}
+func (f *fakeManager) TestUpstream(string) (health.Result, error) {
+	return health.Result{}, nil
+}
+
+// startLog 记录每次创建代理的时间
+type startLog struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (l *startLog) get() []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]time.Time(nil), l.times...)
+}
+
+// newFakeSupervisor 创建按script依次创建代理的监督者
+func newFakeSupervisor(cfg *ProxyJson, script func(n int) *fakeManager) (*Supervisor, *startLog) {
+	s := NewSupervisor(cfg)
+	s.backoff = 20 * time.Millisecond
+	s.maxBackoff = 50 * time.Millisecond
+	s.stable = time.Hour
+
+	l := &startLog{}
+	s.newManager = func(*ProxyJson, *killSwitch) Manager {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.times = append(l.times, time.Now())
+		f := script(len(l.times))
+		f.done = make(chan struct{})
+		return f
+	}
+	return s, l
+}
+
+func TestReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("打开WinDivert失败: %w", ErrDriverMissing), ReasonDriverMissing},
+		{ErrInterfaceNotFound, ReasonInterfaceNotFound},
+		{fmt.Errorf("接收数据包失败: %w", ErrHandleClosed), ReasonHandleClosed},
+		{errors.New("其他错误"), ReasonUnknown},
+		{nil, ReasonUnknown},
+	}
+	for _, tt := range tests {
+		if got := Reason(tt.err); got != tt.want {
+			t.Errorf("Reason(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{7, time.Minute}, // 64秒超过上限
+		{100, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := restartDelay(time.Second, time.Minute, tt.attempts); got != tt.want {
+			t.Errorf("attempts=%d: delay = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestSupervisorMaxAttempts(t *testing.T) {
+	s, starts := newFakeSupervisor(&ProxyJson{RestartMaxAttempts: 3}, func(int) *fakeManager {
+		return &fakeManager{startErr: fmt.Errorf("打开WinDivert失败: %w", ErrDriverMissing)}
+	})
+
+	done, err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("supervisor did not give up")
+	}
+
+	// 首次启动加3次重启
+	st := starts.get()
+	h := s.Health()
+	if h.State != HealthFailed || h.Reason != ReasonDriverMissing || h.Attempts != 4 || len(st) != 4 {
+		t.Fatalf("unexpected health: %+v starts=%d", h, len(st))
+	}
+
+	// 等待时长逐次翻倍直到上限: 20ms、40ms、50ms
+	for i, want := range []time.Duration{20, 40, 50} {
+		if d := st[i+1].Sub(st[i]); d < want*time.Millisecond {
+			t.Fatalf("delay %d = %s", i+1, d)
+		}
+	}
+}
+
+func TestSupervisorStableReset(t *testing.T) {
+	// 每次运行超过稳定时长后退出，连续失败次数不累计，不会达到最大重启次数
+	s, starts := newFakeSupervisor(&ProxyJson{RestartMaxAttempts: 1}, func(int) *fakeManager {
+		return &fakeManager{run: 30 * time.Millisecond}
+	})
+	s.stable = 10 * time.Millisecond
+
+	if _, err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for len(starts.get()) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("restarts = %d, health = %+v", len(starts.get()), s.Health())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	h := s.Health()
+	if h.State == HealthFailed || h.Attempts > 1 {
+		t.Fatalf("unexpected health: %+v", h)
+	}
+	if h.State == HealthRestarting && h.Reason != ReasonHandleClosed {
+		t.Fatalf("exit without error should be handle_closed: %+v", h)
+	}
+
+	s.Stop()
+	if h := s.Health(); h.State != HealthStopped {
+		t.Fatalf("unexpected health after stop: %+v", h)
+	}
+}
+
+func TestSupervisorUpdateDuringStart(t *testing.T) {
+	gate := make(chan struct{})
+	created := make(chan *fakeManager, 1)
+	s, _ := newFakeSupervisor(&ProxyJson{ProxyUrl: "socks5://old:1080"}, func(int) *fakeManager {
+		f := &fakeManager{run: time.Hour, gate: gate}
+		created <- f
+		return f
+	})
+	defer s.Stop()
+
+	if _, err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 代理创建后、启动完成前切换上游
+	var fake *fakeManager
+	select {
+	case fake = <-created:
+	case <-time.After(3 * time.Second):
+		t.Fatal("manager not created")
+	}
+	if err := s.UpdateProxy(&ProxyJson{ProxyUrl: "socks5://new:1080"}); err != nil {
+		t.Fatal(err)
+	}
+	close(gate)
+
+	// 启动后补充应用切换的上游
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		fake.mu.Lock()
+		updates := append([]string(nil), fake.updates...)
+		fake.mu.Unlock()
+		if len(updates) > 0 {
+			if len(updates) != 1 || updates[0] != "socks5://new:1080" {
+				t.Fatalf("updates = %q", updates)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("update not applied, health = %+v", s.Health())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
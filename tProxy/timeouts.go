@@ -0,0 +1,180 @@
+package tProxy
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"transparent/gvisor.dev/gvisor/pkg/tcpip"
+	"transparent/log"
+)
+
+const (
+	// defaultDialTimeout 连接代理服务器或直连目标的默认超时
+	defaultDialTimeout = 10 * time.Second
+
+	// defaultProxyHandshakeTimeout 与代理服务器握手的默认超时
+	defaultProxyHandshakeTimeout = 10 * time.Second
+
+	// TCP保活默认值，与Go标准库一致
+	defaultKeepAliveIdle     = 15 * time.Second
+	defaultKeepAliveInterval = 15 * time.Second
+	defaultKeepAliveCount    = 9
+)
+
+// seconds 将秒数配置转换为时长，不大于0时返回默认值
+func seconds(v int, def time.Duration) time.Duration {
+	if v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return def
+}
+
+// dialTimeout 单次拨号的超时
+func (m *manager) dialTimeout() time.Duration {
+	return seconds(m.proxyJson.DialTimeout, defaultDialTimeout)
+}
+
+// proxyHandshakeTimeout 拨号完成后与代理服务器握手的超时
+func (m *manager) proxyHandshakeTimeout() time.Duration {
+	return seconds(m.proxyJson.ProxyHandshakeTimeout, defaultProxyHandshakeTimeout)
+}
+
+// keepAliveConfig 上游连接的TCP保活配置
+func (m *manager) keepAliveConfig() net.KeepAliveConfig {
+	if m.proxyJson.DisableKeepAlive {
+		return net.KeepAliveConfig{}
+	}
+
+	count := m.proxyJson.KeepAliveCount
+	if count <= 0 {
+		count = defaultKeepAliveCount
+	}
+
+	return net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     seconds(m.proxyJson.KeepAliveIdle, defaultKeepAliveIdle),
+		Interval: seconds(m.proxyJson.KeepAliveInterval, defaultKeepAliveInterval),
+		Count:    count,
+	}
+}
+
+// setEndpointKeepAlive 为协议栈中与本地程序的连接开启TCP保活，本地程序退出或断网时及时回收连接
+func (m *manager) setEndpointKeepAlive(ep tcpip.Endpoint) {
+	cfg := m.keepAliveConfig()
+	if !cfg.Enable {
+		return
+	}
+
+	idle := tcpip.KeepaliveIdleOption(cfg.Idle)
+	interval := tcpip.KeepaliveIntervalOption(cfg.Interval)
+	ep.SetSockOpt(&idle)
+	ep.SetSockOpt(&interval)
+	ep.SetSockOptInt(tcpip.KeepaliveCountOption, cfg.Count)
+	ep.SocketOptions().SetKeepAlive(true)
+}
+
+// idleReader 首次读取前设置读超时实现首字节超时，并记录最近读到数据的时间供空闲检查
+type idleReader struct {
+	conn      net.Conn
+	first     time.Duration // 首次读取的超时，为0时不限制
+	last      *atomic.Int64 // 最近读到数据的时间，为nil时不记录
+	afterRead bool
+}
+
+// newIdleReader 返回带首字节超时的Reader，未配置超时且不需要记录读取时间时直接返回conn
+func newIdleReader(conn net.Conn, first time.Duration, last *atomic.Int64) io.Reader {
+	if first <= 0 && last == nil {
+		return conn
+	}
+	return &idleReader{conn: conn, first: first, last: last}
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	waitFirst := !r.afterRead && r.first > 0
+	if waitFirst {
+		r.conn.SetReadDeadline(time.Now().Add(r.first))
+	}
+
+	n, err := r.conn.Read(b)
+	if n > 0 {
+		if waitFirst {
+			r.conn.SetReadDeadline(time.Time{})
+		}
+		r.afterRead = true
+		if r.last != nil {
+			r.last.Store(time.Now().UnixNano())
+		}
+	}
+	return n, err
+}
+
+// idleWatch 记录两个方向最近读到数据的时间，两个方向都超过各自的空闲超时才关闭连接
+// 一个方向空闲而另一方向仍有数据(如只下载不上传的长连接)时不关闭
+type idleWatch struct {
+	upload, download         time.Duration
+	uploadLast, downloadLast atomic.Int64
+	expired                  atomic.Bool
+}
+
+// newIdleWatch 创建空闲检查，只配置了一个方向时另一方向使用相同的时长，都未配置时返回nil
+func newIdleWatch(upload, download time.Duration) *idleWatch {
+	if upload <= 0 && download <= 0 {
+		return nil
+	}
+	if upload <= 0 {
+		upload = download
+	}
+	if download <= 0 {
+		download = upload
+	}
+
+	w := &idleWatch{upload: upload, download: download}
+	now := time.Now().UnixNano()
+	w.uploadLast.Store(now)
+	w.downloadLast.Store(now)
+	return w
+}
+
+// remaining 距离两个方向都空闲超时的时长，不大于0表示已超时
+func (w *idleWatch) remaining() time.Duration {
+	now := time.Now()
+	up := w.upload - now.Sub(time.Unix(0, w.uploadLast.Load()))
+	down := w.download - now.Sub(time.Unix(0, w.downloadLast.Load()))
+	return max(up, down)
+}
+
+// run 等待两个方向都空闲超时后调用onIdle，stop关闭时返回
+func (w *idleWatch) run(stop <-chan struct{}, onIdle func()) {
+	timer := time.NewTimer(w.remaining())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		if d := w.remaining(); d > 0 {
+			timer.Reset(d)
+			continue
+		}
+		w.expired.Store(true)
+		log.Debug("连接空闲超时关闭")
+		onIdle()
+		return
+	}
+}
+
+// isExpired 是否因空闲超时关闭，为nil时返回false
+func (w *idleWatch) isExpired() bool {
+	return w != nil && w.expired.Load()
+}
+
+// isTimeout 判断错误是否为读写超时
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
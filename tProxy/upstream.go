@@ -0,0 +1,191 @@
+package tProxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"transparent/log"
+	"transparent/proto/dns"
+	"transparent/proto/mux"
+	"transparent/utils/breaker"
+	"transparent/utils/warm"
+)
+
+// 切换上游时已建立连接的处理策略
+const (
+	switchKeep  = "keep"  // 继续使用旧上游直到连接自然结束(默认)
+	switchDrain = "drain" // 等待 SwitchDrainTimeout 后关闭
+)
+
+// upstream 上游配置快照，切换上游时整体替换
+// 连接建立时取得当前快照，之后一直使用该快照，不受后续切换影响
+type upstream struct {
+	name   string      // 上游名称，默认上游为default
+	cfg    *ProxyJson  // 只使用其中的上游相关字段(ProxyType、ProxyUrl、TrojanProxy、Dns)
+	dialer *dns.Dialer // 连接代理服务器及直连目标使用的拨号器
+
+	// 使用该上游的连接在ctx取消时关闭
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// 代理服务器地址，连接代理服务器的SYN据此直接放行
+	serverMu sync.Mutex
+	servers  map[netip.AddrPort]struct{}
+
+	// 根据实际连接的结果熔断，直连时为nil
+	breaker *breaker.Breaker
+
+	// 多路复用连接池，未开启时为nil
+	mux     *mux.Pool
+	muxWarn sync.Once
+
+	// 预先建立的代理服务器连接，未开启时为nil
+	warm *warm.Pool
+}
+
+// newUpstream 根据配置创建上游快照
+func (m *manager) newUpstream(cfg *ProxyJson) (*upstream, error) {
+	resolver, err := newResolver(cfg.Dns)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := dns.NewDialer(resolver)
+	dialer.Base.Timeout = m.dialTimeout()
+	dialer.Base.KeepAliveConfig = m.keepAliveConfig()
+
+	up := &upstream{
+		cfg:     cfg,
+		dialer:  dialer,
+		servers: map[netip.AddrPort]struct{}{},
+	}
+	up.breaker = m.newBreaker(up)
+
+	// 连接期间记录远端地址，经过代理时同时记录实际连接的代理服务器地址
+	dialer.DialIP = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := m.loop.dial(ctx, &dialer.Base, network, addr)
+		if err == nil && up.usesProxy() {
+			if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				ap := remote.AddrPort()
+				if up.addServer(netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())) {
+					m.kill.setServers(m.serverPrefixes())
+				}
+			}
+		}
+		return conn, err
+	}
+
+	// 预先解析代理服务器地址，域名解析失败时不影响启动
+	ctx, cancel := context.WithTimeout(m.tcm.Context(), m.dialTimeout())
+	err = up.resolveServers(ctx)
+	cancel()
+	if err != nil {
+		log.Warn("解析代理服务器地址失败", zap.Error(err))
+	}
+	if err := m.checkInbound(up); err != nil {
+		return nil, err
+	}
+
+	// 多路复用连接池随上游一起关闭
+	if up.mux, err = m.newMuxPool(up); err != nil {
+		return nil, err
+	}
+	up.ctx, up.cancel = context.WithCancel(m.tcm.Context())
+	if up.mux != nil {
+		context.AfterFunc(up.ctx, up.mux.Close)
+	}
+	up.warm = m.newWarmPool(up)
+	return up, nil
+}
+
+// newResolver 创建代理服务器域名解析器，未单独配置时返回nil以使用全局解析器
+func newResolver(cfg *dns.Config) (dns.Resolver, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	resolver, err := dns.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("创建DNS解析器失败 error:%w", err)
+	}
+	return resolver, nil
+}
+
+// UpdateProxy 替换默认上游并切换到该上游，WinDivert句柄和协议栈保持运行，新连接立即使用新上游
+// 只使用cfg中的上游相关字段，经过原默认上游的连接按 SwitchPolicy 处理
+func (m *manager) UpdateProxy(cfg *ProxyJson) error {
+	if len(m.upstreams()) == 0 {
+		return errors.New("代理未运行") // 未启动时还没有默认上游
+	}
+
+	up, err := m.newUpstream(cfg)
+	if err != nil {
+		return err
+	}
+	up.name = defaultUpstreamName
+
+	m.groupMu.Lock()
+	old := m.members[0]
+	m.members[0] = up
+	m.groupMu.Unlock()
+
+	m.upstream.Store(up)
+	m.retire(old)
+	m.health.Set(up.name, m.probeDial(up))
+
+	// 阻断模式下放行新的代理服务器地址，探测新上游成功后才解除阻断，之后由健康检查和熔断状态更新
+	m.kill.setServers(m.serverPrefixes())
+	if m.kill != nil {
+		m.kill.setHealthy(false)
+		r, err := m.health.Check(m.tcm.Context(), up.name)
+		m.kill.setHealthy(err == nil && r.OK())
+	}
+
+	log.Info("已切换上游代理", zap.String("type", cfg.ProxyType), zap.String("policy", m.switchPolicy()))
+	return nil
+}
+
+// currentUpstream 返回当前上游
+func (m *manager) currentUpstream() *upstream {
+	return m.upstream.Load()
+}
+
+// switchPolicy 切换上游时已建立连接的处理策略
+func (m *manager) switchPolicy() string {
+	if m.proxyJson.SwitchPolicy == "" {
+		return switchKeep
+	}
+	return m.proxyJson.SwitchPolicy
+}
+
+// retire 按策略处理旧上游上的连接
+// 无论哪种策略，预连接池都立即关闭，多路复用连接池不再建立新连接，已有的连接在最后一个流结束后关闭
+func (m *manager) retire(old *upstream) {
+	old.warm.Close()
+	if old.mux != nil {
+		old.mux.Drain()
+	}
+
+	switch m.switchPolicy() {
+	case switchDrain:
+		time.AfterFunc(seconds(m.proxyJson.SwitchDrainTimeout, 0), old.cancel)
+	default:
+		// 旧连接继续转发，manager停止时随父ctx一起取消
+	}
+}
+
+// usesProxy 是否经过代理服务器转发，未配置代理类型时直连
+func (up *upstream) usesProxy() bool {
+	switch up.cfg.ProxyType {
+	case "socks", "http", "trojan", "oks", "bss":
+		return true
+	}
+	return false
+}
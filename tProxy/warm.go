@@ -0,0 +1,44 @@
+package tProxy
+
+import (
+	"context"
+	"net"
+
+	"transparent/proto/bss"
+	"transparent/proto/oks"
+	"transparent/proto/trojan"
+	"transparent/utils/warm"
+)
+
+// newWarmPool 开启预连接时为trojan、oks和bss上游创建预连接池，其他类型和开启多路复用的上游返回nil
+// 连接池随上游一起关闭，预先建立的连接同样经过上游的拨号器
+func (m *manager) newWarmPool(up *upstream) *warm.Pool {
+	if up.mux != nil {
+		return nil
+	}
+
+	cfg := up.cfg
+	var dial func(ctx context.Context) (net.Conn, error)
+	switch cfg.ProxyType {
+	case "trojan":
+		dial = func(ctx context.Context) (net.Conn, error) {
+			conn, err := trojan.DialTLS(ctx, up.dialer, cfg.TrojanProxy.Server, cfg.TrojanProxy.Domain, cfg.TrojanProxy.InsecureSkipVerify)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	case "oks":
+		dial = func(ctx context.Context) (net.Conn, error) { return oks.Dial(ctx, up.dialer, cfg.ProxyUrl) }
+	case "bss":
+		dial = func(ctx context.Context) (net.Conn, error) { return bss.Dial(ctx, up.dialer, cfg.ProxyUrl) }
+	default:
+		return nil
+	}
+
+	return warm.New(up.ctx, m.proxyJson.Warm, func(ctx context.Context) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, m.dialTimeout()+m.proxyHandshakeTimeout())
+		defer cancel()
+		return dial(ctx)
+	})
+}
@@ -0,0 +1,74 @@
+package bandwidth
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReaderLimit(t *testing.T) {
+	// 突发量小于单次读取的数据量，需要分块申请令牌
+	l := NewLimiter(Config{Upload: 1 << 20, UploadBurst: 16 << 10})
+	data := make([]byte, 512<<10)
+
+	start := time.Now()
+	r := NewReader(context.Background(), bytes.NewReader(data), Upload, l)
+	n, err := io.Copy(io.Discard, r)
+	if err != nil || n != int64(len(data)) {
+		t.Fatal(n, err)
+	}
+
+	// 512KB @ 1MB/s 约0.5秒
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("unexpected duration: %s", d)
+	}
+
+	// 下载方向未限速
+	start = time.Now()
+	r = NewReader(context.Background(), bytes.NewReader(data), Download, l)
+	io.Copy(io.Discard, r)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("download limited: %s", d)
+	}
+}
+
+func TestRegistrySet(t *testing.T) {
+	r := NewRegistry()
+	if r.Get(ScopeProcess, "a.exe") != nil || r.NewConn() != nil || r.HasProcess() {
+		t.Fatal("expected empty registry")
+	}
+
+	r.Set(ScopeProcess, "A.exe", Config{Download: 100})
+	l := r.Get(ScopeProcess, "a.exe")
+	if l == nil || !r.HasProcess() {
+		t.Fatal("process limiter not found")
+	}
+
+	// 调整已存在的限速器时原地修改，正在使用的连接立即生效
+	r.Set(ScopeProcess, "a.exe", Config{Download: 200})
+	if r.Get(ScopeProcess, "a.exe") != l || l.Config().Download != 200 {
+		t.Fatal("limiter not updated in place")
+	}
+
+	r.Set(ScopeConn, "", Config{Upload: 10})
+	if a, b := r.NewConn(), r.NewConn(); a == b || a.Config().Upload != 10 {
+		t.Fatal("conn limiter should be created per connection")
+	}
+
+	if len(r.Entries()) != 2 {
+		t.Fatalf("unexpected entries: %v", r.Entries())
+	}
+
+	// 已设置的限速不被配置覆盖
+	if r.SetDefault(ScopeProcess, "A.EXE", Config{Download: 1}) || l.Config().Download != 200 {
+		t.Fatal("existing limiter overwritten")
+	}
+	if r.SetDefault(ScopeConn, "", Config{Upload: 1}) || r.NewConn().Config().Upload != 10 {
+		t.Fatal("existing conn limit overwritten")
+	}
+	if !r.SetDefault(ScopeRule, "MATCH,DIRECT", Config{Upload: 1}) || r.Get(ScopeRule, "MATCH,DIRECT") == nil {
+		t.Fatal("unset limiter not seeded")
+	}
+}
@@ -0,0 +1,44 @@
+package bandwidth
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handler 带宽限制控制接口
+// GET 返回所有限速配置，PUT/POST 提交一个或多个Entry调整限速
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var entries []Entry
+			if err := json.NewDecoder(req.Body).Decode(&entries); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, e := range entries {
+				switch e.Scope {
+				case ScopeGlobal, ScopeConn:
+				case ScopeProxy, ScopeProcess, ScopeRule:
+					if e.Name == "" {
+						http.Error(w, "缺少名称: "+e.Scope, http.StatusBadRequest)
+						return
+					}
+				default:
+					http.Error(w, "未知的限速范围: "+e.Scope, http.StatusBadRequest)
+					return
+				}
+			}
+			for _, e := range entries {
+				r.Set(e.Scope, e.Name, e.Config)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Entries())
+	})
+}
@@ -0,0 +1,135 @@
+package bandwidth
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Config 带宽限制配置，速率单位为字节/秒，为0表示不限速
+type Config struct {
+	// 上传(本地程序 -> 目标)速率
+	Upload int
+
+	// 上传突发量(字节)，为0时等于速率
+	UploadBurst int
+
+	// 下载(目标 -> 本地程序)速率
+	Download int
+
+	// 下载突发量(字节)，为0时等于速率
+	DownloadBurst int
+}
+
+// Direction 转发方向
+type Direction int
+
+const (
+	Upload   Direction = iota // 本地程序 -> 目标
+	Download                  // 目标 -> 本地程序
+)
+
+// Limiter 上传和下载相互独立的令牌桶限速器，可在使用中调整速率
+type Limiter struct {
+	mu  sync.Mutex
+	cfg Config
+
+	up   *rate.Limiter
+	down *rate.Limiter
+}
+
+// NewLimiter 根据配置创建限速器
+func NewLimiter(cfg Config) *Limiter {
+	l := &Limiter{
+		up:   rate.NewLimiter(rate.Inf, 0),
+		down: rate.NewLimiter(rate.Inf, 0),
+	}
+	l.Set(cfg)
+	return l
+}
+
+// Set 调整速率和突发量，对正在转发的连接立即生效
+func (l *Limiter) Set(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cfg = cfg
+	setLimit(l.up, cfg.Upload, cfg.UploadBurst)
+	setLimit(l.down, cfg.Download, cfg.DownloadBurst)
+}
+
+// Config 返回当前配置
+func (l *Limiter) Config() Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg
+}
+
+// setLimit 设置令牌桶，速率不大于0时不限速
+func setLimit(rl *rate.Limiter, r, burst int) {
+	if r <= 0 {
+		rl.SetLimit(rate.Inf)
+		return
+	}
+	if burst <= 0 {
+		burst = r
+	}
+	rl.SetBurst(burst)
+	rl.SetLimit(rate.Limit(r))
+}
+
+// wait 等待n字节的令牌
+// 令牌按突发量分块申请，突发量小于单次读取的数据量时也能正常限速
+func (l *Limiter) wait(ctx context.Context, dir Direction, n int) error {
+	rl := l.up
+	if dir == Download {
+		rl = l.down
+	}
+
+	for n > 0 {
+		if rl.Limit() == rate.Inf {
+			return nil
+		}
+
+		chunk := min(n, rl.Burst())
+		if chunk <= 0 {
+			chunk = n
+		}
+		if err := rl.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+
+	return nil
+}
+
+// reader 读取后依次等待各限速器的令牌
+type reader struct {
+	ctx      context.Context
+	r        io.Reader
+	dir      Direction
+	limiters []*Limiter
+}
+
+// NewReader 返回按指定方向限速的Reader，limiters为空时直接返回r
+func NewReader(ctx context.Context, r io.Reader, dir Direction, limiters ...*Limiter) io.Reader {
+	if len(limiters) == 0 {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, dir: dir, limiters: limiters}
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		for _, l := range r.limiters {
+			if werr := l.wait(r.ctx, r.dir, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,131 @@
+package bandwidth
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 限速作用范围
+const (
+	ScopeGlobal  = "global"  // 所有被代理的连接共享
+	ScopeProxy   = "proxy"   // 经过同一上游代理服务器的连接共享，名称为上游名称
+	ScopeProcess = "process" // 同一进程(按可执行文件名)的连接共享
+	ScopeRule    = "rule"    // 命中同一路由规则的连接共享
+	ScopeConn    = "conn"    // 每个连接单独限速，修改只对新连接生效
+)
+
+// Entry 限速配置项
+type Entry struct {
+	Scope string
+	Name  string `json:",omitempty"`
+	Config
+}
+
+// Registry 按作用范围和名称管理共享的限速器
+type Registry struct {
+	mu       sync.RWMutex
+	limiters map[string]*Limiter
+	conn     *Config
+	process  atomic.Bool // 是否配置了进程限速，未配置时不必查询进程名
+}
+
+// NewRegistry 创建空的限速器集合
+func NewRegistry() *Registry {
+	return &Registry{
+		limiters: map[string]*Limiter{},
+	}
+}
+
+var defaultRegistry = NewRegistry()
+
+// Default 返回全局限速器集合，控制接口修改的也是该集合
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// registryKey 进程名不区分大小写
+func registryKey(scope, name string) string {
+	if scope == ScopeProcess {
+		name = strings.ToLower(name)
+	}
+	return scope + "/" + name
+}
+
+// Set 设置指定范围的限速，已存在的限速器原地调整，正在转发的连接立即生效
+func (r *Registry) Set(scope, name string, cfg Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.set(scope, name, cfg)
+}
+
+// SetDefault 指定范围未设置过限速时设置，已设置(包括通过控制接口调整)的保持不变
+// 返回是否设置
+func (r *Registry) SetDefault(scope, name string, cfg Config) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if scope == ScopeConn && r.conn != nil || scope != ScopeConn && r.limiters[registryKey(scope, name)] != nil {
+		return false
+	}
+	r.set(scope, name, cfg)
+	return true
+}
+
+// set 设置限速，调用方持有锁
+func (r *Registry) set(scope, name string, cfg Config) {
+	if scope == ScopeConn {
+		r.conn = &cfg
+		return
+	}
+
+	key := registryKey(scope, name)
+	if l, ok := r.limiters[key]; ok {
+		l.Set(cfg)
+		return
+	}
+	r.limiters[key] = NewLimiter(cfg)
+
+	if scope == ScopeProcess {
+		r.process.Store(true)
+	}
+}
+
+// Get 返回指定范围的共享限速器，未配置时返回nil
+func (r *Registry) Get(scope, name string) *Limiter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.limiters[registryKey(scope, name)]
+}
+
+// NewConn 为新连接创建单独的限速器，未配置时返回nil
+func (r *Registry) NewConn() *Limiter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.conn == nil {
+		return nil
+	}
+	return NewLimiter(*r.conn)
+}
+
+// HasProcess 是否配置了进程限速
+func (r *Registry) HasProcess() bool {
+	return r.process.Load()
+}
+
+// Entries 返回所有限速配置
+func (r *Registry) Entries() []Entry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entries := make([]Entry, 0, len(r.limiters)+1)
+	for key, l := range r.limiters {
+		scope, name, _ := strings.Cut(key, "/")
+		entries = append(entries, Entry{Scope: scope, Name: name, Config: l.Config()})
+	}
+	if r.conn != nil {
+		entries = append(entries, Entry{Scope: ScopeConn, Config: *r.conn})
+	}
+	return entries
+}
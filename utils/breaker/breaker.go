@@ -0,0 +1,271 @@
+package breaker
+
+import (
+	"cmp"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultFailures 默认的连续失败次数阈值
+	DefaultFailures = 3
+
+	// DefaultCooldown 默认的熔断冷却时长(秒)
+	DefaultCooldown = 30
+
+	// DefaultTrials 默认的半开状态试探连接数
+	DefaultTrials = 1
+)
+
+// Config 熔断器配置
+type Config struct {
+	// 连续失败达到该次数时熔断，为0时使用默认值3，为负数时不熔断
+	Failures int
+
+	// 熔断后的冷却时长(秒)，冷却结束后进入半开状态，为0时使用默认值30
+	Cooldown int
+
+	// 半开状态同时允许的试探连接数，全部成功后恢复，为0时使用默认值1
+	Trials int
+}
+
+// State 熔断器状态
+type State int32
+
+const (
+	Closed   State = iota // 正常，允许所有连接
+	Open                  // 熔断，拒绝所有连接直到冷却结束
+	HalfOpen              // 半开，只允许有限的试探连接
+)
+
+// String 状态名称
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// MarshalText 按状态名称序列化
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Token 允许连接时熔断器所处的状态周期，每次状态变化后递增
+// 连接的结果只计入同一周期，之前状态下放行的连接的结果在状态变化后忽略
+type Token uint64
+
+// Stats 熔断器统计
+type Stats struct {
+	State    State
+	Failures int       // 当前连续失败次数
+	Trips    uint64    // 累计熔断次数
+	Rejected uint64    // 熔断期间拒绝的连接数
+	Until    time.Time `json:",omitempty"` // 熔断时冷却结束的时间
+}
+
+// Breaker 连续失败达到阈值时熔断，冷却后半开试探，试探成功则恢复、失败则重新熔断
+// 为nil时不熔断
+type Breaker struct {
+	failures int           // 熔断阈值
+	cooldown time.Duration // 冷却时长
+	trials   int           // 半开状态的试探连接数
+
+	mu        sync.Mutex
+	state     State
+	gen       Token // 当前状态周期
+	count     int   // 连续失败次数
+	inflight  int   // 半开状态正在进行的试探连接数
+	successes int   // 半开状态成功的试探连接数
+	trips     uint64
+	rejected  uint64
+	until     time.Time
+	timer     *time.Timer
+
+	// 状态变化时调用，不持有锁
+	OnChange func(from, to State)
+}
+
+// New 创建熔断器，Failures为负数时返回nil
+func New(cfg Config) *Breaker {
+	if cfg.Failures < 0 {
+		return nil
+	}
+	return &Breaker{
+		failures: cmp.Or(cfg.Failures, DefaultFailures),
+		cooldown: time.Duration(cmp.Or(cfg.Cooldown, DefaultCooldown)) * time.Second,
+		trials:   max(cmp.Or(cfg.Trials, DefaultTrials), 1),
+	}
+}
+
+// Allow 判断是否允许新连接，允许时连接结束后必须以返回的Token调用 Success、Failure 或 Release 之一
+func (b *Breaker) Allow() (Token, bool) {
+	if b == nil {
+		return 0, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		b.rejected++
+		return 0, false
+	case HalfOpen:
+		if b.inflight >= b.trials {
+			b.rejected++
+			return 0, false
+		}
+		b.inflight++
+	}
+	return b.gen, true
+}
+
+// Success 记录一次成功，半开状态下试探连接全部成功时恢复
+func (b *Breaker) Success(t Token) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	if t != b.gen {
+		b.mu.Unlock()
+		return
+	}
+	from := b.state
+	b.count = 0
+	if b.state == HalfOpen {
+		b.inflight = max(b.inflight-1, 0)
+		if b.successes++; b.successes >= b.trials {
+			b.setState(Closed)
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+
+	b.notify(from, to)
+}
+
+// Failure 记录一次失败，连续失败达到阈值或半开状态下试探失败时熔断
+func (b *Breaker) Failure(t Token) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	if t != b.gen {
+		b.mu.Unlock()
+		return
+	}
+	from := b.state
+	switch b.state {
+	case Closed:
+		if b.count++; b.count >= b.failures {
+			b.trip()
+		}
+	case HalfOpen:
+		b.count++
+		b.trip()
+	}
+	to := b.state
+	b.mu.Unlock()
+
+	b.notify(from, to)
+}
+
+// Release 连接结束但无法判断成败(如被主动关闭)，只归还半开状态的试探名额
+func (b *Breaker) Release(t Token) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t == b.gen && b.state == HalfOpen {
+		b.inflight = max(b.inflight-1, 0)
+	}
+}
+
+// State 返回当前状态，为nil时始终为 Closed
+func (b *Breaker) State() State {
+	if b == nil {
+		return Closed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Stats 返回统计
+func (b *Breaker) Stats() Stats {
+	if b == nil {
+		return Stats{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := Stats{State: b.state, Failures: b.count, Trips: b.trips, Rejected: b.rejected}
+	if b.state == Open {
+		s.Until = b.until
+	}
+	return s
+}
+
+// Stop 停止冷却计时，之后不再自动进入半开状态
+func (b *Breaker) Stop() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+// trip 熔断并开始冷却计时，调用方持有锁
+func (b *Breaker) trip() {
+	b.setState(Open)
+	b.trips++
+	b.until = time.Now().Add(b.cooldown)
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.timer = time.AfterFunc(b.cooldown, b.halfOpen)
+}
+
+// halfOpen 冷却结束，进入半开状态
+func (b *Breaker) halfOpen() {
+	b.mu.Lock()
+	from := b.state
+	if b.state == Open && !time.Now().Before(b.until) {
+		b.setState(HalfOpen)
+	}
+	to := b.state
+	b.mu.Unlock()
+
+	b.notify(from, to)
+}
+
+// setState 切换状态并开始新的状态周期，重置半开计数，调用方持有锁
+func (b *Breaker) setState(s State) {
+	b.state = s
+	b.gen++
+	b.inflight = 0
+	b.successes = 0
+}
+
+// notify 状态变化时调用 OnChange
+func (b *Breaker) notify(from, to State) {
+	if from != to && b.OnChange != nil {
+		b.OnChange(from, to)
+	}
+}
@@ -0,0 +1,154 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+// recorder 记录状态变化
+type recorder struct {
+	ch chan State
+}
+
+func newBreaker(t *testing.T, cfg Config, cooldown time.Duration) (*Breaker, *recorder) {
+	b := New(cfg)
+	b.cooldown = cooldown
+	t.Cleanup(b.Stop)
+
+	r := &recorder{ch: make(chan State, 16)}
+	b.OnChange = func(from, to State) {
+		r.ch <- to
+	}
+	return b, r
+}
+
+// allow 调用Allow并返回是否允许，允许的连接记录在tokens中
+func allow(b *Breaker, tokens *[]Token) bool {
+	t, ok := b.Allow()
+	if ok {
+		*tokens = append(*tokens, t)
+	}
+	return ok
+}
+
+// wait 等待切换到指定状态
+func (r *recorder) wait(t *testing.T, want State) {
+	t.Helper()
+	select {
+	case s := <-r.ch:
+		if s != want {
+			t.Fatalf("state = %s, want %s", s, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for %s", want)
+	}
+}
+
+func TestTrip(t *testing.T) {
+	b, r := newBreaker(t, Config{Failures: 3}, 20*time.Millisecond)
+
+	// 成功会清零连续失败次数
+	tok, _ := b.Allow()
+	b.Failure(tok)
+	b.Failure(tok)
+	b.Success(tok)
+	b.Failure(tok)
+	b.Failure(tok)
+	if b.State() != Closed || b.Stats().Failures != 2 {
+		t.Fatalf("unexpected stats: %+v", b.Stats())
+	}
+
+	b.Failure(tok)
+	r.wait(t, Open)
+	if _, ok := b.Allow(); ok {
+		t.Fatal("open breaker allowed a connection")
+	}
+	if s := b.Stats(); s.Trips != 1 || s.Rejected != 1 || s.Until.IsZero() {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	// 冷却结束后半开，只允许一个试探连接
+	r.wait(t, HalfOpen)
+	var trials []Token
+	if !allow(b, &trials) || allow(b, &trials) {
+		t.Fatal("half-open breaker should allow exactly one trial")
+	}
+	b.Success(trials[0])
+	r.wait(t, Closed)
+	if !allow(b, &trials) || !allow(b, &trials) {
+		t.Fatal("closed breaker rejected a connection")
+	}
+}
+
+func TestTrialFailure(t *testing.T) {
+	b, r := newBreaker(t, Config{Failures: 1, Trials: 2}, 20*time.Millisecond)
+
+	tok, _ := b.Allow()
+	b.Failure(tok)
+	r.wait(t, Open)
+	r.wait(t, HalfOpen)
+
+	// 无法判断成败的连接归还名额
+	var trials []Token
+	if !allow(b, &trials) || !allow(b, &trials) || allow(b, &trials) {
+		t.Fatal("half-open breaker should allow two trials")
+	}
+	b.Release(trials[0])
+	if !allow(b, &trials) {
+		t.Fatal("released trial was not returned")
+	}
+
+	// 任一试探失败重新熔断
+	b.Success(trials[1])
+	b.Failure(trials[2])
+	r.wait(t, Open)
+	if s := b.Stats(); s.Trips != 2 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	b := New(Config{Failures: -1})
+	if b != nil {
+		t.Fatal("expected nil breaker")
+	}
+	for range 10 {
+		b.Failure(0)
+	}
+	if _, ok := b.Allow(); !ok || b.State() != Closed {
+		t.Fatal("nil breaker should never trip")
+	}
+}
+
+func TestStaleResult(t *testing.T) {
+	b, r := newBreaker(t, Config{Failures: 1}, 20*time.Millisecond)
+
+	// 熔断前放行的连接在半开期间才结束
+	stale, _ := b.Allow()
+	tok, _ := b.Allow()
+	b.Failure(tok)
+	r.wait(t, Open)
+	r.wait(t, HalfOpen)
+
+	// 之前放行的连接的结果不计入，也不占用试探名额
+	b.Success(stale)
+	b.Release(stale)
+	if b.State() != HalfOpen {
+		t.Fatalf("stale success closed the breaker: %s", b.State())
+	}
+	trial, ok := b.Allow()
+	if !ok {
+		t.Fatal("half-open breaker rejected the trial")
+	}
+	if _, ok := b.Allow(); ok {
+		t.Fatal("stale release returned a trial slot")
+	}
+	b.Failure(stale)
+	if b.State() != HalfOpen {
+		t.Fatalf("stale failure tripped the breaker: %s", b.State())
+	}
+
+	// 试探连接的结果正常计入
+	b.Success(trial)
+	r.wait(t, Closed)
+}
@@ -0,0 +1,127 @@
+package health
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// target 被检查的上游
+type target struct {
+	dial   DialFunc
+	window *Window
+}
+
+// Checker 定期探测一组上游，记录每个上游的探测结果
+type Checker struct {
+	cfg Config
+
+	mu      sync.Mutex
+	targets map[string]*target
+	order   []string // 添加顺序
+
+	// 每轮检查结束后调用，用于按检查结果选择上游
+	OnRound func()
+}
+
+// NewChecker 创建检查器
+func NewChecker(cfg Config) *Checker {
+	cfg.URL = cmp.Or(cfg.URL, DefaultURL)
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultInterval
+	}
+	cfg.Timeout = cmp.Or(cfg.Timeout, DefaultTimeout)
+	cfg.Window = cmp.Or(cfg.Window, DefaultWindow)
+
+	return &Checker{
+		cfg:     cfg,
+		targets: map[string]*target{},
+	}
+}
+
+// Set 添加或替换上游，替换时清空之前的探测结果
+func (c *Checker) Set(name string, dial DialFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.targets[name]; !ok {
+		c.order = append(c.order, name)
+	}
+	c.targets[name] = &target{dial: dial, window: NewWindow(c.cfg.Window)}
+}
+
+// Check 立即探测指定上游，结果计入滑动窗口
+func (c *Checker) Check(ctx context.Context, name string) (Result, error) {
+	c.mu.Lock()
+	t := c.targets[name]
+	c.mu.Unlock()
+	if t == nil {
+		return Result{}, fmt.Errorf("未知的上游: %s", name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.cfg.Timeout)*time.Second)
+	defer cancel()
+	r := Probe(ctx, t.dial, c.cfg.URL)
+
+	c.mu.Lock()
+	// 探测期间被替换的上游不记录结果
+	if c.targets[name] == t {
+		t.window.Add(r)
+	}
+	c.mu.Unlock()
+	return r, nil
+}
+
+// CheckAll 并发探测所有上游
+func (c *Checker) CheckAll(ctx context.Context) {
+	c.mu.Lock()
+	names := append([]string(nil), c.order...)
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(ctx, name)
+		}()
+	}
+	wg.Wait()
+}
+
+// Run 按间隔定期探测所有上游，直到ctx取消，间隔为负数时直接返回
+func (c *Checker) Run(ctx context.Context) {
+	if c.cfg.Interval < 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(c.cfg.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		c.CheckAll(ctx)
+		if c.OnRound != nil && ctx.Err() == nil {
+			c.OnRound()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stats 返回指定上游的统计，未知的上游返回false
+func (c *Checker) Stats(name string) (Stats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.targets[name]
+	if t == nil {
+		return Stats{}, false
+	}
+	return t.window.Stats(), true
+}
@@ -0,0 +1,210 @@
+package health
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// DefaultURL 默认的探测地址，返回204且响应很小
+	DefaultURL = "http://www.gstatic.com/generate_204"
+
+	// DefaultInterval 默认的检查间隔(秒)
+	DefaultInterval = 60
+
+	// DefaultTimeout 默认的单次探测超时(秒)
+	DefaultTimeout = 5
+
+	// DefaultWindow 默认的滑动窗口样本数
+	DefaultWindow = 10
+)
+
+// Config 健康检查配置
+type Config struct {
+	// 探测地址，支持http和https，为空时使用 DefaultURL
+	URL string
+
+	// 检查间隔(秒)，为0时使用默认值60，为负数时不定期检查(仍可手动测试)
+	Interval int
+
+	// 单次探测超时(秒)，为0时使用默认值5
+	Timeout int
+
+	// 统计延迟、抖动和成功率的样本数，为0时使用默认值10
+	Window int
+}
+
+// DialFunc 通过上游连接目标地址(host:port)
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// Result 单次探测结果
+type Result struct {
+	Time    time.Time // 探测开始时间
+	Connect int64     // 经过上游建立到探测地址的TCP连接的耗时(毫秒)
+	Latency int64     // 从开始连接到收到HTTP响应头的耗时(毫秒)，失败时为0
+	Status  int       `json:",omitempty"` // HTTP状态码
+	Error   string    `json:",omitempty"` // 失败原因，成功时为空
+}
+
+// OK 探测是否成功
+func (r Result) OK() bool {
+	return r.Error == ""
+}
+
+// Probe 经过dial连接探测地址并发送HTTP(S) GET请求，测量连接和响应耗时
+// 收到任意HTTP响应即视为成功
+func Probe(ctx context.Context, dial DialFunc, rawURL string) Result {
+	start := time.Now()
+	r := Result{Time: start}
+
+	fail := func(format string, args ...any) Result {
+		r.Error = fmt.Sprintf(format, args...)
+		return r
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fail("探测地址格式错误: %s", rawURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	// 1. 经过上游建立TCP连接
+	conn, err := dial(ctx, addr)
+	if err != nil {
+		return fail("连接失败: %v", err)
+	}
+	defer conn.Close()
+	r.Connect = time.Since(start).Milliseconds()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// 2. https时完成TLS握手
+	if u.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return fail("TLS握手失败: %v", err)
+		}
+		conn = tc
+	}
+
+	// 3. 发送GET请求并读取响应头
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return fail("创建请求失败: %v", err)
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return fail("发送请求失败: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fail("读取响应失败: %v", err)
+	}
+	resp.Body.Close()
+
+	r.Status = resp.StatusCode
+	r.Latency = max(time.Since(start).Milliseconds(), 1)
+	return r
+}
+
+// Stats 滑动窗口内的统计
+type Stats struct {
+	Samples     int     // 样本数
+	SuccessRate float64 // 成功率(0-1)
+	Latency     int64   // 成功样本的平均延迟(毫秒)
+	Jitter      int64   // 相邻成功样本延迟差的平均值(毫秒)
+	Last        *Result `json:",omitempty"` // 最近一次探测结果
+}
+
+// Healthy 最近一次探测是否成功，没有样本时视为可用
+func (s Stats) Healthy() bool {
+	return s.Last == nil || s.Last.OK()
+}
+
+// Window 保存最近若干次探测结果的滑动窗口，非并发安全
+type Window struct {
+	results []Result
+	next    int
+	full    bool
+}
+
+// NewWindow 创建指定大小的滑动窗口
+func NewWindow(size int) *Window {
+	if size <= 0 {
+		size = DefaultWindow
+	}
+	return &Window{results: make([]Result, size)}
+}
+
+// Add 添加探测结果，窗口已满时覆盖最早的结果
+func (w *Window) Add(r Result) {
+	w.results[w.next] = r
+	w.next = (w.next + 1) % len(w.results)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// Stats 计算窗口内的统计
+func (w *Window) Stats() Stats {
+	// 按时间顺序排列
+	var rs []Result
+	if w.full {
+		rs = append(rs, w.results[w.next:]...)
+	}
+	rs = append(rs, w.results[:w.next]...)
+
+	s := Stats{Samples: len(rs)}
+	if len(rs) == 0 {
+		return s
+	}
+	last := rs[len(rs)-1]
+	s.Last = &last
+
+	var ok, sum, diffs, diffSum int64
+	prev := int64(-1)
+	for _, r := range rs {
+		if !r.OK() {
+			continue
+		}
+		ok++
+		sum += r.Latency
+		if prev >= 0 {
+			diffs++
+			diffSum += abs(r.Latency - prev)
+		}
+		prev = r.Latency
+	}
+
+	s.SuccessRate = float64(ok) / float64(len(rs))
+	if ok > 0 {
+		s.Latency = sum / ok
+	}
+	if diffs > 0 {
+		s.Jitter = diffSum / diffs
+	}
+	return s
+}
+
+// abs 返回绝对值
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
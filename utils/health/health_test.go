@@ -0,0 +1,183 @@
+package health
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"transparent/proto/dns"
+	"transparent/proto/mixed"
+	"transparent/proto/socks"
+)
+
+// standInProxy 本地SOCKS5代理，delay为转发前的延迟，关闭后拒绝连接
+func standInProxy(t *testing.T, delay time.Duration) (string, *atomic.Bool) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var down atomic.Bool
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := mixed.Handshake(conn, &mixed.Config{})
+				if err != nil {
+					return
+				}
+				if down.Load() {
+					req.Reject()
+					return
+				}
+				time.Sleep(delay)
+
+				target, err := net.Dial("tcp", req.Target)
+				if err != nil {
+					req.Reject()
+					return
+				}
+				defer target.Close()
+				client, err := req.Accept()
+				if err != nil {
+					return
+				}
+				go io.Copy(target, client)
+				io.Copy(client, target)
+			}()
+		}
+	}()
+	return "socks5://" + ln.Addr().String(), &down
+}
+
+// socksDial 经过SOCKS5代理连接
+func socksDial(proxyURL string) DialFunc {
+	dialer := dns.NewDialer(nil)
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		return socks.GetConn(ctx, dialer, proxyURL, addr)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	proxyURL, down := standInProxy(t, 20*time.Millisecond)
+
+	r := Probe(context.Background(), socksDial(proxyURL), srv.URL+"/generate_204")
+	if !r.OK() || r.Status != http.StatusNoContent {
+		t.Fatalf("unexpected result: %+v", r)
+	}
+	if r.Connect < 20 || r.Latency < r.Connect {
+		t.Fatalf("unexpected latency: %+v", r)
+	}
+
+	down.Store(true)
+	if r := Probe(context.Background(), socksDial(proxyURL), srv.URL); r.OK() || r.Latency != 0 {
+		t.Fatalf("expected failure: %+v", r)
+	}
+
+	if r := Probe(context.Background(), socksDial(proxyURL), "ftp://example.com"); r.OK() {
+		t.Fatal("expected invalid url")
+	}
+}
+
+func TestProbeHTTPS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	proxyURL, _ := standInProxy(t, 0)
+
+	// 测试服务器使用自签名证书，握手失败说明TLS经过代理到达了服务器
+	r := Probe(context.Background(), socksDial(proxyURL), srv.URL)
+	if r.OK() || !strings.HasPrefix(r.Error, "TLS") {
+		t.Fatalf("expected certificate error: %+v", r)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	w := NewWindow(4)
+	if s := w.Stats(); s.Samples != 0 || !s.Healthy() {
+		t.Fatalf("unexpected empty stats: %+v", s)
+	}
+
+	for _, r := range []Result{
+		{Latency: 500}, // 窗口满后被覆盖
+		{Latency: 100},
+		{Latency: 140},
+		{Error: "timeout"},
+		{Latency: 120},
+	} {
+		w.Add(r)
+	}
+
+	s := w.Stats()
+	if s.Samples != 4 || s.SuccessRate != 0.75 || s.Latency != 120 || s.Jitter != 30 || !s.Healthy() {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	w.Add(Result{Error: "refused"})
+	if s := w.Stats(); s.Healthy() || s.Last.Error != "refused" {
+		t.Fatalf("expected unhealthy: %+v", s)
+	}
+}
+
+func TestChecker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	fast, _ := standInProxy(t, 0)
+	slow, down := standInProxy(t, 50*time.Millisecond)
+
+	c := NewChecker(Config{URL: srv.URL, Interval: 1})
+	c.Set("fast", socksDial(fast))
+	c.Set("slow", socksDial(slow))
+
+	rounds := make(chan struct{}, 1)
+	c.OnRound = func() {
+		select {
+		case rounds <- struct{}{}:
+		default:
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	<-rounds
+
+	f, _ := c.Stats("fast")
+	s, _ := c.Stats("slow")
+	if f.Samples != 1 || s.Samples != 1 || f.Latency >= s.Latency {
+		t.Fatalf("unexpected stats: fast=%+v slow=%+v", f, s)
+	}
+
+	// 手动测试立即计入统计
+	down.Store(true)
+	if r, err := c.Check(context.Background(), "slow"); err != nil || r.OK() {
+		t.Fatal(r, err)
+	}
+	if s, _ := c.Stats("slow"); s.Healthy() {
+		t.Fatalf("expected unhealthy: %+v", s)
+	}
+
+	if _, err := c.Check(context.Background(), "missing"); err == nil {
+		t.Fatal("expected unknown upstream")
+	}
+}
@@ -0,0 +1,108 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// debounceDelay 合并短时间内连续发生的变化，切换网络时地址和路由通常会连续变化多次
+	debounceDelay = 500 * time.Millisecond
+
+	// pollInterval 系统通知之外的兜底检查间隔
+	pollInterval = 10 * time.Second
+)
+
+// Interface 出口网卡信息
+type Interface struct {
+	Index uint32
+	Name  string
+	MTU   uint32
+}
+
+// DefaultInterface 根据路由表返回IPv4默认路由所在的网卡，不发送任何探测数据包
+func DefaultInterface() (Interface, error) {
+	idx, err := defaultRouteIndex()
+	if err != nil {
+		return Interface{}, err
+	}
+
+	iface, err := net.InterfaceByIndex(int(idx))
+	if err != nil {
+		return Interface{}, fmt.Errorf("获取网卡信息失败 index:%d error:%w", idx, err)
+	}
+	if iface.MTU <= 0 {
+		return Interface{}, fmt.Errorf("获取网卡mtu失败 name:%s", iface.Name)
+	}
+
+	return Interface{
+		Index: idx,
+		Name:  iface.Name,
+		MTU:   uint32(iface.MTU),
+	}, nil
+}
+
+// Interfaces 返回所有已启用的非回环网卡
+func Interfaces() ([]Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("获取网卡列表失败 error:%w", err)
+	}
+
+	var out []Interface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.MTU <= 0 {
+			continue
+		}
+		out = append(out, Interface{
+			Index: uint32(iface.Index),
+			Name:  iface.Name,
+			MTU:   uint32(iface.MTU),
+		})
+	}
+	return out, nil
+}
+
+// Watch 监听网卡、地址和路由变化
+// 变化合并后向返回的通道发送通知，另外每隔 pollInterval 发送一次用于兜底检查，ctx取消时关闭通道
+func Watch(ctx context.Context) (<-chan struct{}, error) {
+	events := make(chan struct{}, 1)
+	if err := subscribe(ctx, events); err != nil {
+		return nil, err
+	}
+
+	out := make(chan struct{}, 1)
+	go func() {
+		defer close(out)
+
+		poll := time.NewTicker(pollInterval)
+		defer poll.Stop()
+
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-events:
+				debounce = time.After(debounceDelay)
+			case <-debounce:
+				debounce = nil
+				notify(out)
+			case <-poll.C:
+				notify(out)
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// notify 非阻塞通知，通道中已有未处理的通知时丢弃
+func notify(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
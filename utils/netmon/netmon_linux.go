@@ -0,0 +1,117 @@
+package netmon
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaultRouteIndex 从 /proc/net/route 中选出度量值最小的IPv4默认路由
+func defaultRouteIndex() (uint32, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return 0, fmt.Errorf("读取路由表失败: %w", err)
+	}
+	defer f.Close()
+
+	return parseRoute(bufio.NewScanner(f))
+}
+
+// parseRoute 解析 /proc/net/route 格式的路由表
+// 格式: Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+func parseRoute(s *bufio.Scanner) (uint32, error) {
+	const rtfUp = 0x1
+
+	var (
+		name   string
+		metric = -1
+	)
+	s.Scan() // 跳过表头
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&rtfUp == 0 {
+			continue
+		}
+		m, err := strconv.Atoi(fields[6])
+		if err != nil {
+			continue
+		}
+
+		if metric < 0 || m < metric {
+			name, metric = fields[0], m
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, fmt.Errorf("读取路由表失败: %w", err)
+	}
+	if name == "" {
+		return 0, fmt.Errorf("没有默认路由")
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("获取网卡信息失败 name:%s error:%w", name, err)
+	}
+	return uint32(iface.Index), nil
+}
+
+// subscribe 通过netlink订阅网卡、IPv4地址和路由变化
+func subscribe(ctx context.Context, events chan<- struct{}) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("创建netlink套接字失败: %w", err)
+	}
+
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV4_ROUTE,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("绑定netlink套接字失败: %w", err)
+	}
+
+	// 关闭套接字使阻塞的读取返回
+	f := os.NewFile(uintptr(fd), "netlink")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, os.Getpagesize())
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, msg := range msgs {
+				switch msg.Header.Type {
+				case unix.RTM_NEWLINK, unix.RTM_DELLINK,
+					unix.RTM_NEWADDR, unix.RTM_DELADDR,
+					unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+					notify(events)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package netmon
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+
+	// 默认路由中选择度量值最小且处于UP状态的一条
+	table := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+missing0	00000000	0101A8C0	0003	0	0	600	00000000	0	0	0
+lo	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+down0	00000000	0101A8C0	0002	0	0	50	00000000	0	0	0
+missing1	0001A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+`
+	idx, err := parseRoute(bufio.NewScanner(strings.NewReader(table)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != uint32(lo.Index) {
+		t.Fatalf("unexpected index: %d", idx)
+	}
+
+	if _, err := parseRoute(bufio.NewScanner(strings.NewReader("Iface\n"))); err == nil {
+		t.Fatal("expected error without default route")
+	}
+}
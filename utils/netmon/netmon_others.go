@@ -0,0 +1,18 @@
+//go:build !windows && !linux
+
+package netmon
+
+import (
+	"context"
+	"errors"
+)
+
+// defaultRouteIndex 当前平台不支持查询路由表
+func defaultRouteIndex() (uint32, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// subscribe 当前平台没有变化通知，只依赖定期检查
+func subscribe(ctx context.Context, events chan<- struct{}) error {
+	return nil
+}
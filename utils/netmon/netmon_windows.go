@@ -0,0 +1,64 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+// defaultRouteIndex 查询路由表中到公网地址的最佳网卡，只查询路由不发送数据包
+func defaultRouteIndex() (uint32, error) {
+	var idx uint32
+	if err := windows.GetBestInterfaceEx(&windows.SockaddrInet4{Addr: [4]byte{8, 8, 8, 8}}, &idx); err != nil {
+		return 0, fmt.Errorf("查询默认路由失败: %w", err)
+	}
+	return idx, nil
+}
+
+// 系统回调只能创建有限个，全局只注册一次，再分发给各订阅者
+var (
+	subMu       sync.Mutex
+	subscribers = map[chan<- struct{}]struct{}{}
+	callback    = sync.OnceValue(func() uintptr {
+		return windows.NewCallback(func(callerContext, row, notificationType uintptr) uintptr {
+			subMu.Lock()
+			defer subMu.Unlock()
+			for ch := range subscribers {
+				notify(ch)
+			}
+			return 0
+		})
+	})
+)
+
+// subscribe 订阅网卡和单播地址变化(网卡切换、VPN连接时默认路由随之变化)
+func subscribe(ctx context.Context, events chan<- struct{}) error {
+	cb := callback()
+
+	var ifHandle, addrHandle windows.Handle
+	if err := windows.NotifyIpInterfaceChange(windows.AF_INET, cb, nil, false, &ifHandle); err != nil {
+		return fmt.Errorf("订阅网卡变化失败: %w", err)
+	}
+	if err := windows.NotifyUnicastIpAddressChange(windows.AF_INET, cb, nil, false, &addrHandle); err != nil {
+		windows.CancelMibChangeNotify2(ifHandle)
+		return fmt.Errorf("订阅地址变化失败: %w", err)
+	}
+
+	subMu.Lock()
+	subscribers[events] = struct{}{}
+	subMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		windows.CancelMibChangeNotify2(ifHandle)
+		windows.CancelMibChangeNotify2(addrHandle)
+
+		subMu.Lock()
+		delete(subscribers, events)
+		subMu.Unlock()
+	}()
+
+	return nil
+}
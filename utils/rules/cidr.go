@@ -0,0 +1,109 @@
+package rules
+
+import (
+	"net/netip"
+
+	"github.com/google/btree"
+)
+
+// ipRange 闭区间地址范围，同一集合中的范围互不重叠
+type ipRange struct {
+	first, last netip.Addr
+}
+
+func lessRange(a, b ipRange) bool {
+	return a.first.Less(b.first)
+}
+
+// CIDRSet 网段集合，重叠和相邻的网段合并为一个范围，查询为O(log n)
+type CIDRSet struct {
+	tree *btree.BTreeG[ipRange]
+}
+
+// NewCIDRSet 创建空的网段集合
+func NewCIDRSet() *CIDRSet {
+	return &CIDRSet{tree: btree.NewG(8, lessRange)}
+}
+
+// Add 添加网段，IPv4映射的IPv6地址按IPv4处理
+func (s *CIDRSet) Add(p netip.Prefix) {
+	p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-unmapBits(p)).Masked()
+	r := ipRange{first: p.Addr(), last: lastAddr(p)}
+
+	// 与前一个范围重叠或相邻时合并
+	s.tree.DescendLessOrEqual(r, func(prev ipRange) bool {
+		if adjacent(prev.last, r.first) {
+			r.first = prev.first
+			r.last = maxAddr(prev.last, r.last)
+			s.tree.Delete(prev)
+		}
+		return false
+	})
+
+	// 合并被覆盖或相邻的后续范围
+	var merged []ipRange
+	s.tree.AscendGreaterOrEqual(r, func(next ipRange) bool {
+		if !adjacent(r.last, next.first) {
+			return false
+		}
+		merged = append(merged, next)
+		r.last = maxAddr(r.last, next.last)
+		return true
+	})
+	for _, next := range merged {
+		s.tree.Delete(next)
+	}
+
+	s.tree.ReplaceOrInsert(r)
+}
+
+// Contains 判断地址是否在集合中
+func (s *CIDRSet) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	var ok bool
+	s.tree.DescendLessOrEqual(ipRange{first: addr}, func(r ipRange) bool {
+		ok = r.first.BitLen() == addr.BitLen() && !r.last.Less(addr)
+		return false
+	})
+	return ok
+}
+
+// Len 返回合并后的范围数
+func (s *CIDRSet) Len() int {
+	return s.tree.Len()
+}
+
+// unmapBits IPv4映射地址需要去掉的前缀位数
+func unmapBits(p netip.Prefix) int {
+	if p.Addr().Is4In6() {
+		return 96
+	}
+	return 0
+}
+
+// lastAddr 返回网段的最后一个地址
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// adjacent 判断b是否紧接在a之后或不晚于a(两个范围可以合并)
+func adjacent(a, b netip.Addr) bool {
+	if a.BitLen() != b.BitLen() {
+		return false
+	}
+	next := a.Next()
+	return !a.Less(b) || next == b
+}
+
+func maxAddr(a, b netip.Addr) netip.Addr {
+	if a.Less(b) {
+		return b
+	}
+	return a
+}
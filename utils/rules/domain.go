@@ -0,0 +1,131 @@
+package rules
+
+import (
+	"regexp"
+	"strings"
+)
+
+// domainNode 域名后缀树节点，按标签从右到左逐级向下
+type domainNode struct {
+	children map[string]*domainNode
+	suffix   bool // 匹配该域名及其所有子域名
+	full     bool // 只匹配该域名本身
+}
+
+// DomainSet 域名集合，支持后缀、完整域名、关键字和正则匹配
+type DomainSet struct {
+	root     domainNode
+	keywords []string
+	regexps  []*regexp.Regexp
+	size     int
+}
+
+// NewDomainSet 创建空的域名集合
+func NewDomainSet() *DomainSet {
+	return &DomainSet{}
+}
+
+// normalizeDomain 统一为小写并去掉首尾的点
+func normalizeDomain(d string) string {
+	return strings.Trim(strings.ToLower(strings.TrimSpace(d)), ".")
+}
+
+// insert 按标签从右到左插入后缀树
+func (s *DomainSet) insert(domain string) *domainNode {
+	n := &s.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = map[string]*domainNode{}
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = &domainNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	s.size++
+	return n
+}
+
+// AddSuffix 添加域名后缀，匹配该域名及其所有子域名
+func (s *DomainSet) AddSuffix(domain string) {
+	if domain = normalizeDomain(domain); domain != "" {
+		s.insert(domain).suffix = true
+	}
+}
+
+// AddFull 添加完整域名，只匹配该域名本身
+func (s *DomainSet) AddFull(domain string) {
+	if domain = normalizeDomain(domain); domain != "" {
+		s.insert(domain).full = true
+	}
+}
+
+// AddKeyword 添加关键字，域名包含该关键字时匹配
+func (s *DomainSet) AddKeyword(keyword string) {
+	if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+		s.keywords = append(s.keywords, keyword)
+		s.size++
+	}
+}
+
+// AddRegexp 添加正则表达式
+func (s *DomainSet) AddRegexp(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	s.regexps = append(s.regexps, re)
+	s.size++
+	return nil
+}
+
+// Match 判断域名是否在集合中
+func (s *DomainSet) Match(domain string) bool {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return false
+	}
+
+	// 1. 后缀树，沿途遇到后缀节点即命中
+	n := &s.root
+	rest := domain
+	for n != nil {
+		i := strings.LastIndexByte(rest, '.')
+		label := rest[i+1:]
+
+		n = n.children[label]
+		if n == nil {
+			break
+		}
+		if n.suffix || (i < 0 && n.full) {
+			return true
+		}
+		if i < 0 {
+			break
+		}
+		rest = rest[:i]
+	}
+
+	// 2. 关键字
+	for _, k := range s.keywords {
+		if strings.Contains(domain, k) {
+			return true
+		}
+	}
+
+	// 3. 正则
+	for _, re := range s.regexps {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len 返回集合中的条目数
+func (s *DomainSet) Len() int {
+	return s.size
+}
@@ -0,0 +1,235 @@
+package rules
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 可更新的数据库
+const (
+	KindGeoIP   = "geoip"
+	KindGeoSite = "geosite"
+)
+
+// maxDownloadSize 下载数据库的最大长度
+const maxDownloadSize = 256 << 20
+
+// GeoConfig GeoIP/GeoSite数据库配置
+type GeoConfig struct {
+	// MaxMind格式的GeoIP数据库路径(如 Country.mmdb)
+	GeoIP string
+
+	// v2ray格式的 geosite.dat 文件，或存放文本域名列表(每个列表一个文件)的目录
+	GeoSite string
+
+	// 更新数据库时的默认下载地址
+	GeoIPURL   string
+	GeoSiteURL string
+}
+
+// Geo GeoIP/GeoSite数据库，按需加载，更新后整体替换
+type Geo struct {
+	mu    sync.RWMutex
+	cfg   GeoConfig
+	mmdb  *MMDB
+	sites map[string]*DomainSet // 已加载的域名列表，key为小写名称
+
+	// 下载数据库使用的HTTP客户端
+	Client *http.Client
+}
+
+// NewGeo 创建空的数据库
+func NewGeo() *Geo {
+	return &Geo{
+		sites:  map[string]*DomainSet{},
+		Client: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+var defaultGeo = NewGeo()
+
+// DefaultGeo 返回全局数据库，控制接口更新的也是该数据库
+func DefaultGeo() *Geo {
+	return defaultGeo
+}
+
+// Configure 设置数据库路径，已加载的数据在下次使用时重新加载
+func (g *Geo) Configure(cfg GeoConfig) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.cfg = cfg
+	g.mmdb = nil
+	g.sites = map[string]*DomainSet{}
+}
+
+// loadMMDB 返回GeoIP数据库，未加载时从文件加载
+func (g *Geo) loadMMDB() (*MMDB, error) {
+	g.mu.RLock()
+	db, path := g.mmdb, g.cfg.GeoIP
+	g.mu.RUnlock()
+	if db != nil {
+		return db, nil
+	}
+	if path == "" {
+		return nil, errors.New("未配置GeoIP数据库")
+	}
+
+	db, err := OpenMMDB(path)
+	if err != nil {
+		return nil, fmt.Errorf("加载GeoIP数据库失败 path:%s error:%w", path, err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.mmdb == nil && g.cfg.GeoIP == path {
+		g.mmdb = db
+	}
+	return db, nil
+}
+
+// Country 返回地址所属国家/地区的ISO代码，数据库不可用或未找到时返回空
+func (g *Geo) Country(addr netip.Addr) string {
+	db, err := g.loadMMDB()
+	if err != nil {
+		return ""
+	}
+	return db.Country(addr)
+}
+
+// Site 返回指定名称的域名列表，未加载时从文件加载
+func (g *Geo) Site(name string) (*DomainSet, error) {
+	key := strings.ToLower(name)
+
+	g.mu.RLock()
+	set, path := g.sites[key], g.cfg.GeoSite
+	g.mu.RUnlock()
+	if set != nil {
+		return set, nil
+	}
+	if path == "" {
+		return nil, errors.New("未配置GeoSite数据库")
+	}
+
+	set, err := LoadGeoSite(path, name)
+	if err != nil {
+		return nil, fmt.Errorf("加载GeoSite域名列表失败 name:%s error:%w", name, err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cfg.GeoSite == path {
+		g.sites[key] = set
+	}
+	return set, nil
+}
+
+// Update 从url下载数据库并替换本地文件，url为空时使用配置的下载地址
+// 下载的文件校验通过后才替换，之后的匹配使用新数据
+func (g *Geo) Update(ctx context.Context, kind, url string) error {
+	g.mu.RLock()
+	cfg := g.cfg
+	g.mu.RUnlock()
+
+	var path string
+	var validate func([]byte) error
+	switch kind {
+	case KindGeoIP:
+		path, url = cfg.GeoIP, cmp.Or(url, cfg.GeoIPURL)
+		validate = func(b []byte) error {
+			_, err := ParseMMDB(b)
+			return err
+		}
+	case KindGeoSite:
+		path, url = cfg.GeoSite, cmp.Or(url, cfg.GeoSiteURL)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return errors.New("目录形式的域名列表不支持下载更新")
+		}
+		validate = ValidateGeoSite
+		if filepath.Ext(path) != ".dat" {
+			validate = func(b []byte) error {
+				_, err := ParseDomainList(b)
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("未知的数据库: %s", kind)
+	}
+	if path == "" {
+		return fmt.Errorf("未配置%s数据库路径", kind)
+	}
+	if url == "" {
+		return fmt.Errorf("未配置%s下载地址", kind)
+	}
+
+	if err := Download(ctx, g.Client, url, path, validate); err != nil {
+		return err
+	}
+
+	// 清除已加载的数据，下次使用时重新加载
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch kind {
+	case KindGeoIP:
+		g.mmdb = nil
+	case KindGeoSite:
+		g.sites = map[string]*DomainSet{}
+	}
+	return nil
+}
+
+// Download 下载文件，校验通过后原子替换path
+func Download(ctx context.Context, client *http.Client, url, path string, validate func([]byte) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("下载失败 url:%s error:%w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("下载失败 url:%s status:%s", url, resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxDownloadSize+1))
+	if err != nil {
+		return fmt.Errorf("下载失败 url:%s error:%w", url, err)
+	}
+	if len(b) > maxDownloadSize {
+		return fmt.Errorf("下载的文件过大 url:%s", url)
+	}
+	if validate != nil {
+		if err := validate(b); err != nil {
+			return fmt.Errorf("下载的文件校验失败 url:%s error:%w", url, err)
+		}
+	}
+
+	// 写入同目录下的临时文件后重命名，避免替换到一半时被读取
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
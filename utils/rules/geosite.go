@@ -0,0 +1,235 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// v2ray geosite.dat 中的域名类型
+const (
+	siteKeyword = 0 // Plain: 包含关键字
+	siteRegexp  = 1 // Regex: 正则
+	siteSuffix  = 2 // Domain: 域名及其子域名
+	siteFull    = 3 // Full: 完整域名
+)
+
+var errGeoSiteInvalid = errors.New("geosite文件格式错误")
+
+// LoadGeoSite 加载指定名称的域名列表
+// path为 .dat 文件时按v2ray geosite格式解析，为目录时读取目录下的 名称 或 名称.txt 文本文件
+func LoadGeoSite(path, name string) (*DomainSet, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		for _, file := range []string{name, name + ".txt", strings.ToLower(name), strings.ToLower(name) + ".txt"} {
+			b, err := os.ReadFile(filepath.Join(path, file))
+			if err == nil {
+				return ParseDomainList(b)
+			}
+		}
+		return nil, fmt.Errorf("未找到域名列表 %s", name)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) != ".dat" {
+		return ParseDomainList(b)
+	}
+
+	set, err := ParseGeoSite(b, name)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, fmt.Errorf("geosite中未找到 %s", name)
+	}
+	return set, nil
+}
+
+// ParseDomainList 解析文本格式的域名列表
+// 每行一个域名，支持 domain:、full:、keyword:、regexp: 前缀，无前缀时按后缀匹配，#之后为注释，@属性忽略
+func ParseDomainList(b []byte) (*DomainSet, error) {
+	set := NewDomainSet()
+
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if i := strings.Index(line, " @"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "include:") {
+			continue
+		}
+
+		typ, value, ok := strings.Cut(line, ":")
+		if !ok {
+			set.AddSuffix(line)
+			continue
+		}
+		switch typ {
+		case "domain":
+			set.AddSuffix(value)
+		case "full":
+			set.AddFull(value)
+		case "keyword":
+			set.AddKeyword(value)
+		case "regexp":
+			if err := set.AddRegexp(value); err != nil {
+				return nil, fmt.Errorf("正则表达式错误 %s: %w", value, err)
+			}
+		default:
+			return nil, fmt.Errorf("不支持的域名类型: %s", line)
+		}
+	}
+	return set, sc.Err()
+}
+
+// ParseGeoSite 从v2ray geosite.dat中解析指定名称(不区分大小写)的域名列表，未找到时返回nil
+//
+//	message GeoSiteList { repeated GeoSite entry = 1; }
+//	message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+//	message Domain { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+func ParseGeoSite(b []byte, name string) (*DomainSet, error) {
+	var found *DomainSet
+	err := walkProto(b, func(field int, entry []byte) error {
+		if field != 1 || found != nil {
+			return nil
+		}
+
+		var code string
+		var domains [][]byte
+		err := walkProto(entry, func(field int, v []byte) error {
+			switch field {
+			case 1:
+				code = string(v)
+			case 2:
+				domains = append(domains, v)
+			}
+			return nil
+		})
+		if err != nil || !strings.EqualFold(code, name) {
+			return err
+		}
+
+		set := NewDomainSet()
+		for _, d := range domains {
+			if err := addGeoSiteDomain(set, d); err != nil {
+				return err
+			}
+		}
+		found = set
+		return nil
+	})
+	return found, err
+}
+
+// ValidateGeoSite 检查geosite.dat格式是否正确
+func ValidateGeoSite(b []byte) error {
+	var n int
+	err := walkProto(b, func(field int, entry []byte) error {
+		if field == 1 {
+			n++
+		}
+		return nil
+	})
+	if err == nil && n == 0 {
+		err = fmt.Errorf("%w: 没有域名列表", errGeoSiteInvalid)
+	}
+	return err
+}
+
+// addGeoSiteDomain 解析单个Domain消息并加入集合
+func addGeoSiteDomain(set *DomainSet, b []byte) error {
+	typ := siteKeyword
+	var value string
+	err := walkProto(b, func(field int, v []byte) error {
+		switch field {
+		case 1:
+			t, n := binary.Uvarint(v)
+			if n <= 0 {
+				return errGeoSiteInvalid
+			}
+			typ = int(t)
+		case 2:
+			value = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case siteKeyword:
+		set.AddKeyword(value)
+	case siteRegexp:
+		if err := set.AddRegexp(value); err != nil {
+			return fmt.Errorf("正则表达式错误 %s: %w", value, err)
+		}
+	case siteSuffix:
+		set.AddSuffix(value)
+	case siteFull:
+		set.AddFull(value)
+	}
+	return nil
+}
+
+// walkProto 遍历protobuf消息的字段，varint字段以其编码字节传给fn
+func walkProto(b []byte, fn func(field int, v []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errGeoSiteInvalid
+		}
+		b = b[n:]
+		field, wire := int(key>>3), key&0x7
+
+		var v []byte
+		switch wire {
+		case 0: // varint
+			_, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errGeoSiteInvalid
+			}
+			v, b = b[:n], b[n:]
+		case 1: // 64位
+			if len(b) < 8 {
+				return errGeoSiteInvalid
+			}
+			v, b = b[:8], b[8:]
+		case 2: // 长度前缀
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errGeoSiteInvalid
+			}
+			v, b = b[n:n+int(l)], b[n+int(l):]
+		case 5: // 32位
+			if len(b) < 4 {
+				return errGeoSiteInvalid
+			}
+			v, b = b[:4], b[4:]
+		default:
+			return fmt.Errorf("%w: 不支持的字段类型 %d", errGeoSiteInvalid, wire)
+		}
+
+		if err := fn(field, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package rules
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// UpdateRequest 更新数据库的请求，Kind为空时更新所有配置了下载地址的数据库
+// URL只能为空或与配置的下载地址相同，控制接口不能从任意地址下载并替换数据库
+type UpdateRequest struct {
+	Kind string `json:",omitempty"`
+	URL  string `json:",omitempty"`
+}
+
+// GeoStatus 数据库状态
+type GeoStatus struct {
+	GeoIP     string
+	GeoIPType string `json:",omitempty"`
+	GeoSite   string
+	Sites     []string `json:",omitempty"` // 已加载的域名列表
+}
+
+// Status 返回数据库状态
+func (g *Geo) Status() GeoStatus {
+	db, _ := g.loadMMDB()
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	st := GeoStatus{GeoIP: g.cfg.GeoIP, GeoSite: g.cfg.GeoSite}
+	if db != nil {
+		st.GeoIPType = db.Type()
+	}
+	for name := range g.sites {
+		st.Sites = append(st.Sites, name)
+	}
+	sort.Strings(st.Sites)
+	return st
+}
+
+// Handler 数据库控制接口
+// GET 返回数据库状态，POST 提交UpdateRequest从下载地址更新数据库
+func Handler(g *Geo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var u UpdateRequest
+			if req.ContentLength != 0 {
+				if err := json.NewDecoder(req.Body).Decode(&u); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			kinds := []string{u.Kind}
+			if u.Kind == "" {
+				kinds = g.updatable()
+				if len(kinds) == 0 {
+					http.Error(w, "未配置数据库下载地址", http.StatusBadRequest)
+					return
+				}
+			}
+			for _, kind := range kinds {
+				if u.URL != "" && u.URL != g.downloadURL(kind) {
+					http.Error(w, "只能从配置的下载地址更新数据库", http.StatusForbidden)
+					return
+				}
+			}
+			for _, kind := range kinds {
+				if err := g.Update(req.Context(), kind, ""); err != nil {
+					http.Error(w, err.Error(), http.StatusBadGateway)
+					return
+				}
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g.Status())
+	})
+}
+
+// updatable 返回配置了下载地址的数据库
+func (g *Geo) updatable() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var kinds []string
+	if g.cfg.GeoIP != "" && g.cfg.GeoIPURL != "" {
+		kinds = append(kinds, KindGeoIP)
+	}
+	if g.cfg.GeoSite != "" && g.cfg.GeoSiteURL != "" {
+		kinds = append(kinds, KindGeoSite)
+	}
+	return kinds
+}
+
+// downloadURL 返回配置的下载地址，未知的数据库返回空字符串
+func (g *Geo) downloadURL(kind string) string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	switch kind {
+	case KindGeoIP:
+		return g.cfg.GeoIPURL
+	case KindGeoSite:
+		return g.cfg.GeoSiteURL
+	}
+	return ""
+}
@@ -0,0 +1,374 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// mmdbMetadataMarker 元数据段起始标记
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// mmdbDataSeparator 搜索树和数据段之间的16字节分隔
+const mmdbDataSeparator = 16
+
+// mmdb数据段类型
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+var errMMDBInvalid = errors.New("mmdb文件格式错误")
+
+// MMDB MaxMind DB格式(GeoLite2-Country、Country.mmdb等)的只读数据库
+type MMDB struct {
+	buf        []byte
+	data       []byte // 数据段
+	nodeCount  uint32
+	recordSize uint16
+	ipVersion  uint16
+	ipv4Start  uint32 // IPv6数据库中IPv4地址(::/96)对应的起始节点
+	dbType     string
+}
+
+// OpenMMDB 读取并解析mmdb文件
+func OpenMMDB(path string) (*MMDB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMMDB(buf)
+}
+
+// ParseMMDB 解析内存中的mmdb数据
+func ParseMMDB(buf []byte) (*MMDB, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: 未找到元数据", errMMDBInvalid)
+	}
+
+	// 1. 元数据，其中的指针相对于元数据段起始位置
+	meta := &mmdbDecoder{buf: buf[i+len(mmdbMetadataMarker):]}
+	v, _, err := meta.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: 元数据 %w", errMMDBInvalid, err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: 元数据类型错误", errMMDBInvalid)
+	}
+
+	db := &MMDB{buf: buf}
+	nodeCount, ok1 := toUint(m["node_count"])
+	recordSize, ok2 := toUint(m["record_size"])
+	ipVersion, ok3 := toUint(m["ip_version"])
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("%w: 元数据缺少字段", errMMDBInvalid)
+	}
+	db.nodeCount = uint32(nodeCount)
+	db.recordSize = uint16(recordSize)
+	db.ipVersion = uint16(ipVersion)
+	db.dbType, _ = m["database_type"].(string)
+
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: 不支持的记录长度 %d", errMMDBInvalid, db.recordSize)
+	}
+
+	// 2. 搜索树和数据段
+	treeSize := int(db.nodeCount) * int(db.recordSize) / 4
+	if treeSize+mmdbDataSeparator > i {
+		return nil, fmt.Errorf("%w: 搜索树长度错误", errMMDBInvalid)
+	}
+	db.data = buf[treeSize+mmdbDataSeparator : i]
+
+	// 3. IPv6数据库中IPv4地址从 ::/96 对应的节点开始查找
+	if db.ipVersion == 6 {
+		node := uint32(0)
+		for range 96 {
+			if node >= db.nodeCount {
+				break
+			}
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// Type 返回数据库类型，如 GeoLite2-Country
+func (db *MMDB) Type() string {
+	return db.dbType
+}
+
+// record 读取节点的左(bit=0)或右(bit=1)记录
+func (db *MMDB) record(node uint32, bit int) uint32 {
+	switch db.recordSize {
+	case 24:
+		b := db.buf[node*6+uint32(bit)*3:]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		b := db.buf[node*7:]
+		if bit == 0 {
+			return uint32(b[3]&0xF0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0F)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		return binary.BigEndian.Uint32(db.buf[node*8+uint32(bit)*4:])
+	}
+}
+
+// Lookup 查找地址对应的记录，未找到时返回nil
+func (db *MMDB) Lookup(addr netip.Addr) (any, error) {
+	addr = addr.Unmap()
+
+	node := uint32(0)
+	var ip []byte
+	switch {
+	case addr.Is4() && db.ipVersion == 6:
+		node = db.ipv4Start
+		ip = addr.AsSlice()
+	case addr.Is4():
+		ip = addr.AsSlice()
+	case db.ipVersion == 4:
+		return nil, nil
+	default:
+		ip = addr.AsSlice()
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := int(ip[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, fmt.Errorf("%w: 搜索树无效", errMMDBInvalid)
+	}
+
+	offset := int(node-db.nodeCount) - mmdbDataSeparator
+	if offset < 0 || offset >= len(db.data) {
+		return nil, fmt.Errorf("%w: 数据偏移越界", errMMDBInvalid)
+	}
+	v, _, err := (&mmdbDecoder{buf: db.data}).decode(offset)
+	return v, err
+}
+
+// Country 返回地址所属国家/地区的ISO代码(大写)，未找到时返回空
+func (db *MMDB) Country(addr netip.Addr) string {
+	v, err := db.Lookup(addr)
+	if err != nil || v == nil {
+		return ""
+	}
+
+	m, _ := v.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := m[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok && code != "" {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// mmdbDecoder 数据段解码器
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// decode 解码offset处的值，返回值和下一个值的偏移
+func (d *mmdbDecoder) decode(offset int) (any, int, error) {
+	typ, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == mmdbPointer {
+		ptr, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr)
+		return v, next, err
+	}
+	return d.value(typ, size, offset)
+}
+
+// control 解析控制字节，返回类型、长度和数据起始偏移
+func (d *mmdbDecoder) control(offset int) (int, int, int, error) {
+	if offset >= len(d.buf) {
+		return 0, 0, 0, fmt.Errorf("%w: 偏移越界", errMMDBInvalid)
+	}
+	ctrl := d.buf[offset]
+	offset++
+
+	typ := int(ctrl >> 5)
+	if typ == mmdbPointer {
+		// 指针的长度字段另行解析
+		return typ, int(ctrl & 0x1F), offset, nil
+	}
+	if typ == mmdbExtended {
+		if offset >= len(d.buf) {
+			return 0, 0, 0, fmt.Errorf("%w: 偏移越界", errMMDBInvalid)
+		}
+		typ = 7 + int(d.buf[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(d.buf) {
+			return 0, 0, 0, fmt.Errorf("%w: 偏移越界", errMMDBInvalid)
+		}
+		v := 0
+		for _, b := range d.buf[offset : offset+n] {
+			v = v<<8 | int(b)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+	return typ, size, offset, nil
+}
+
+// pointer 解析指针，返回指向的偏移和指针之后的偏移
+func (d *mmdbDecoder) pointer(size, offset int) (int, int, error) {
+	ss := (size >> 3) & 0x3
+	n := ss + 1
+	if offset+n > len(d.buf) {
+		return 0, 0, fmt.Errorf("%w: 偏移越界", errMMDBInvalid)
+	}
+
+	v := 0
+	if ss != 3 {
+		v = size & 0x7
+	}
+	for _, b := range d.buf[offset : offset+n] {
+		v = v<<8 | int(b)
+	}
+
+	switch ss {
+	case 1:
+		v += 2048
+	case 2:
+		v += 526336
+	}
+	return v, offset + n, nil
+}
+
+// value 解码指定类型的值
+func (d *mmdbDecoder) value(typ, size, offset int) (any, int, error) {
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for range size {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map的键不是字符串", errMMDBInvalid)
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, 0, size)
+		for range size {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > len(d.buf) {
+		return nil, 0, fmt.Errorf("%w: 偏移越界", errMMDBInvalid)
+	}
+	b := d.buf[offset : offset+size]
+	next := offset + size
+
+	switch typ {
+	case mmdbString:
+		return string(b), next, nil
+	case mmdbBytes:
+		return bytes.Clone(b), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: double长度错误", errMMDBInvalid)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: float长度错误", errMMDBInvalid)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == mmdbInt32 {
+			return int32(v), next, nil
+		}
+		return v, next, nil
+	case mmdbUint128:
+		// 只用于少量字段，保留原始字节
+		return bytes.Clone(b), next, nil
+	default:
+		return nil, 0, fmt.Errorf("%w: 未知类型 %d", errMMDBInvalid, typ)
+	}
+}
+
+// toUint 将解码出的整数转换为uint64
+func toUint(v any) (uint64, bool) {
+	switch v := v.(type) {
+	case uint64:
+		return v, true
+	case int32:
+		return uint64(v), v >= 0
+	}
+	return 0, false
+}
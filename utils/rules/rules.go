@@ -0,0 +1,290 @@
+package rules
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Action 规则命中后的处理方式
+type Action string
+
+const (
+	ActionProxy  Action = "PROXY"  // 经过上游代理
+	ActionDirect Action = "DIRECT" // 直连目标
+	ActionReject Action = "REJECT" // 拒绝连接
+)
+
+// 规则类型
+const (
+	TypeDomain        = "DOMAIN"
+	TypeDomainSuffix  = "DOMAIN-SUFFIX"
+	TypeDomainKeyword = "DOMAIN-KEYWORD"
+	TypeGeoSite       = "GEOSITE"
+	TypeIPCIDR        = "IP-CIDR"
+	TypeSrcIPCIDR     = "SRC-IP-CIDR"
+	TypeGeoIP         = "GEOIP"
+	TypeDstPort       = "DST-PORT"
+	TypeProcessName   = "PROCESS-NAME"
+	TypeMatch         = "MATCH"
+)
+
+// Metadata 用于匹配规则的连接信息，未知的字段为零值
+type Metadata struct {
+	Host    string     // 目标域名，来自本地代理入站或TLS SNI/HTTP Host
+	DstIP   netip.Addr // 目标地址
+	DstPort uint16
+	SrcIP   netip.Addr // 发起连接的地址，网关模式下为局域网设备地址
+	Process string     // 发起连接的进程名
+}
+
+// Rule 一条路由规则
+type Rule struct {
+	raw    string
+	names  []string // 合并到该规则的所有规则原文，第一个为raw
+	typ    string
+	action Action
+	match  func(md *Metadata) bool
+}
+
+// String 返回规则原文，合并的规则使用第一条的原文
+func (r *Rule) String() string {
+	return r.raw
+}
+
+// Names 返回合并到该规则的所有规则原文，用作按规则限速的名称
+func (r *Rule) Names() []string {
+	return r.names
+}
+
+// Action 返回规则的处理方式
+func (r *Rule) Action() Action {
+	return r.action
+}
+
+// Engine 按顺序匹配的路由规则
+// 连续的同类型同动作的域名规则合并到一棵后缀树，IP-CIDR规则合并到一个网段集合
+type Engine struct {
+	rules []*Rule
+	geo   *Geo
+
+	needHost    bool
+	needProcess bool
+}
+
+// New 解析路由规则，格式为 类型,值,动作，如 "GEOIP,CN,DIRECT"、"GEOSITE,google,PROXY"、"MATCH,PROXY"
+// geo为nil时使用全局数据库，GEOIP/GEOSITE规则引用的数据库在解析时加载，加载失败返回错误
+// keep中的规则(按原文)不与相邻规则合并，用于需要单独限速的规则
+func New(lines []string, geo *Geo, keep ...string) (*Engine, error) {
+	if geo == nil {
+		geo = DefaultGeo()
+	}
+	e := &Engine{geo: geo}
+	alone := make(map[string]bool, len(keep))
+	for _, k := range keep {
+		alone[strings.TrimSpace(k)] = true
+	}
+
+	// 正在合并的规则，类型和动作相同时追加到同一集合
+	var (
+		domains *DomainSet
+		cidrs   *CIDRSet
+		last    *Rule
+	)
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		typ := strings.ToUpper(parts[0])
+
+		var value string
+		var action Action
+		switch {
+		case typ == TypeMatch && len(parts) == 2:
+			action = Action(strings.ToUpper(parts[1]))
+		case typ != TypeMatch && len(parts) >= 3:
+			value, action = parts[1], Action(strings.ToUpper(parts[2]))
+		default:
+			return nil, fmt.Errorf("规则格式错误: %s", line)
+		}
+		switch action {
+		case ActionProxy, ActionDirect, ActionReject:
+		default:
+			return nil, fmt.Errorf("不支持的规则动作 %s: %s", action, line)
+		}
+
+		// 与上一条规则合并
+		mergeable := last != nil && last.typ == typ && last.action == action && !alone[last.raw] && !alone[line]
+		switch typ {
+		case TypeDomain, TypeDomainSuffix, TypeDomainKeyword:
+			if mergeable && domains != nil {
+				addDomain(domains, typ, value)
+				last.names = append(last.names, line)
+				continue
+			}
+		case TypeIPCIDR, TypeSrcIPCIDR:
+			if mergeable && cidrs != nil {
+				p, err := parsePrefix(value)
+				if err != nil {
+					return nil, fmt.Errorf("网段格式错误 %s: %w", line, err)
+				}
+				cidrs.Add(p)
+				last.names = append(last.names, line)
+				continue
+			}
+		}
+
+		r := &Rule{raw: line, names: []string{line}, typ: typ, action: action}
+		domains, cidrs = nil, nil
+
+		switch typ {
+		case TypeDomain, TypeDomainSuffix, TypeDomainKeyword:
+			set := NewDomainSet()
+			addDomain(set, typ, value)
+			domains = set
+			r.match = func(md *Metadata) bool { return md.Host != "" && set.Match(md.Host) }
+			e.needHost = true
+		case TypeGeoSite:
+			if _, err := geo.Site(value); err != nil {
+				return nil, err
+			}
+			name := value
+			r.match = func(md *Metadata) bool {
+				if md.Host == "" {
+					return false
+				}
+				set, err := geo.Site(name)
+				return err == nil && set.Match(md.Host)
+			}
+			e.needHost = true
+		case TypeIPCIDR, TypeSrcIPCIDR:
+			p, err := parsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("网段格式错误 %s: %w", line, err)
+			}
+			set := NewCIDRSet()
+			set.Add(p)
+			cidrs = set
+			if typ == TypeIPCIDR {
+				r.match = func(md *Metadata) bool { return md.DstIP.IsValid() && set.Contains(md.DstIP) }
+			} else {
+				r.match = func(md *Metadata) bool { return md.SrcIP.IsValid() && set.Contains(md.SrcIP) }
+			}
+		case TypeGeoIP:
+			code := strings.ToUpper(value)
+			if code == "LAN" || code == "PRIVATE" {
+				r.match = func(md *Metadata) bool { return md.DstIP.IsValid() && isPrivate(md.DstIP) }
+				break
+			}
+			if _, err := geo.loadMMDB(); err != nil {
+				return nil, err
+			}
+			r.match = func(md *Metadata) bool { return md.DstIP.IsValid() && geo.Country(md.DstIP) == code }
+		case TypeDstPort:
+			lo, hi, err := parsePorts(value)
+			if err != nil {
+				return nil, fmt.Errorf("端口格式错误 %s: %w", line, err)
+			}
+			r.match = func(md *Metadata) bool { return md.DstPort >= lo && md.DstPort <= hi }
+		case TypeProcessName:
+			name := value
+			r.match = func(md *Metadata) bool { return strings.EqualFold(md.Process, name) }
+			e.needProcess = true
+		case TypeMatch:
+			r.match = func(*Metadata) bool { return true }
+		default:
+			return nil, fmt.Errorf("不支持的规则类型 %s: %s", typ, line)
+		}
+
+		e.rules = append(e.rules, r)
+		last = r
+	}
+	return e, nil
+}
+
+// Match 按顺序匹配规则，未命中时返回nil
+func (e *Engine) Match(md *Metadata) *Rule {
+	for _, r := range e.rules {
+		if r.match(md) {
+			return r
+		}
+	}
+	return nil
+}
+
+// NeedHost 是否有需要目标域名的规则
+func (e *Engine) NeedHost() bool {
+	return e.needHost
+}
+
+// NeedProcess 是否有需要进程名的规则
+func (e *Engine) NeedProcess() bool {
+	return e.needProcess
+}
+
+// Len 返回合并后的规则数
+func (e *Engine) Len() int {
+	return len(e.rules)
+}
+
+// addDomain 按规则类型把域名加入集合
+func addDomain(set *DomainSet, typ, value string) {
+	switch typ {
+	case TypeDomain:
+		set.AddFull(value)
+	case TypeDomainSuffix:
+		set.AddSuffix(value)
+	case TypeDomainKeyword:
+		set.AddKeyword(value)
+	}
+}
+
+// parsePrefix 解析网段，单个地址按完整前缀处理
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parsePorts 解析端口或 起始-结束 端口范围
+func parsePorts(s string) (uint16, uint16, error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		hi = lo
+	}
+	l, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	h, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if l > h {
+		return 0, 0, fmt.Errorf("起始端口大于结束端口")
+	}
+	return uint16(l), uint16(h), nil
+}
+
+// isPrivate 判断是否为私有、回环或链路本地地址
+func isPrivate(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() ||
+		addr.IsUnspecified() || cgnat.Contains(addr)
+}
+
+// cgnat 运营商级NAT地址段
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
@@ -0,0 +1,359 @@
+package rules
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// buildMMDB 构造只有一个节点的IPv4数据库，0.0.0.0/1 属于country，其余地址未收录
+func buildMMDB(country string) []byte {
+	var b []byte
+
+	// 1. 搜索树: 左记录指向数据段偏移0，右记录为空(等于节点数)
+	b = append(b, 0x00, 0x00, 1+mmdbDataSeparator, 0x00, 0x00, 0x01)
+	b = append(b, make([]byte, mmdbDataSeparator)...)
+
+	// 2. 数据段: {"country": {"iso_code": country}}
+	b = append(b, 0xE1, 0x47)
+	b = append(b, "country"...)
+	b = append(b, 0xE1, 0x48)
+	b = append(b, "iso_code"...)
+	b = append(b, 0x40|byte(len(country)))
+	b = append(b, country...)
+
+	// 3. 元数据
+	b = append(b, mmdbMetadataMarker...)
+	b = append(b, 0xE4)
+	b = append(b, 0x4A)
+	b = append(b, "node_count"...)
+	b = append(b, 0xC1, 0x01)
+	b = append(b, 0x4B)
+	b = append(b, "record_size"...)
+	b = append(b, 0xA1, 24)
+	b = append(b, 0x4A)
+	b = append(b, "ip_version"...)
+	b = append(b, 0xA1, 4)
+	b = append(b, 0x4D)
+	b = append(b, "database_type"...)
+	b = append(b, 0x44)
+	b = append(b, "Test"...)
+	return b
+}
+
+// protoField 编码长度前缀字段
+func protoField(field int, v []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// buildGeoSite 构造v2ray格式的geosite.dat
+func buildGeoSite() []byte {
+	domain := func(typ int, value string) []byte {
+		b := binary.AppendUvarint(nil, 1<<3)
+		b = binary.AppendUvarint(b, uint64(typ))
+		return append(b, protoField(2, []byte(value))...)
+	}
+
+	var site []byte
+	site = append(site, protoField(1, []byte("TEST"))...)
+	site = append(site, protoField(2, domain(siteSuffix, "example.com"))...)
+	site = append(site, protoField(2, domain(siteFull, "full.org"))...)
+	site = append(site, protoField(2, domain(siteKeyword, "tracker"))...)
+
+	other := protoField(1, []byte("OTHER"))
+	other = append(other, protoField(2, domain(siteSuffix, "other.net"))...)
+
+	return append(protoField(1, other), protoField(1, site)...)
+}
+
+func TestCIDRSet(t *testing.T) {
+	s := NewCIDRSet()
+	for _, p := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.0.128/25", "192.168.1.1/32", "2001:db8::/32"} {
+		s.Add(netip.MustParsePrefix(p))
+	}
+
+	// 相邻和重叠的网段合并
+	if s.Len() != 3 {
+		t.Fatalf("unexpected len: %d", s.Len())
+	}
+
+	for addr, want := range map[string]bool{
+		"10.0.0.0":        true,
+		"10.0.1.255":      true,
+		"10.0.2.0":        false,
+		"192.168.1.1":     true,
+		"192.168.1.2":     false,
+		"::ffff:10.0.0.1": true,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+	} {
+		if got := s.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v", addr, got)
+		}
+	}
+}
+
+func TestDomainSet(t *testing.T) {
+	s := NewDomainSet()
+	s.AddSuffix("example.com")
+	s.AddFull("full.org")
+	s.AddKeyword("tracker")
+	if err := s.AddRegexp(`^ad\d+\.`); err != nil {
+		t.Fatal(err)
+	}
+
+	for host, want := range map[string]bool{
+		"example.com":      true,
+		"www.Example.com.": true,
+		"badexample.com":   false,
+		"full.org":         true,
+		"www.full.org":     false,
+		"a.tracker.io":     true,
+		"ad12.site.net":    true,
+		"other.net":        false,
+	} {
+		if got := s.Match(host); got != want {
+			t.Errorf("Match(%s) = %v", host, got)
+		}
+	}
+}
+
+func TestMMDB(t *testing.T) {
+	db, err := ParseMMDB(buildMMDB("CN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Type() != "Test" {
+		t.Fatalf("unexpected type: %s", db.Type())
+	}
+	if c := db.Country(netip.MustParseAddr("1.2.3.4")); c != "CN" {
+		t.Fatalf("unexpected country: %q", c)
+	}
+	if c := db.Country(netip.MustParseAddr("200.1.1.1")); c != "" {
+		t.Fatalf("unexpected country: %q", c)
+	}
+
+	if _, err := ParseMMDB([]byte("invalid")); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestGeoSite(t *testing.T) {
+	b := buildGeoSite()
+	if err := ValidateGeoSite(b); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ParseGeoSite(b, "test")
+	if err != nil || s == nil {
+		t.Fatal(s, err)
+	}
+	if !s.Match("www.example.com") || !s.Match("full.org") || !s.Match("tracker.cn") || s.Match("other.net") {
+		t.Fatal("unexpected match")
+	}
+
+	if s, err := ParseGeoSite(b, "missing"); err != nil || s != nil {
+		t.Fatal("expected missing list", err)
+	}
+
+	s, err = ParseDomainList([]byte("# comment\nexample.com\nfull:full.org @cn\nkeyword:tracker\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Match("a.example.com") || !s.Match("full.org") || s.Match("a.full.org") {
+		t.Fatal("unexpected match")
+	}
+}
+
+func TestEngine(t *testing.T) {
+	dir := t.TempDir()
+	cfg := GeoConfig{GeoIP: filepath.Join(dir, "Country.mmdb"), GeoSite: filepath.Join(dir, "geosite.dat")}
+	if err := os.WriteFile(cfg.GeoIP, buildMMDB("CN"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.GeoSite, buildGeoSite(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	geo := NewGeo()
+	geo.Configure(cfg)
+
+	e, err := New([]string{
+		"# 注释",
+		"DOMAIN-SUFFIX,ads.com,REJECT",
+		"DOMAIN,full.ads.org,reject",
+		"GEOSITE,test,PROXY",
+		"IP-CIDR,10.0.0.0/8,DIRECT",
+		"IP-CIDR,172.16.0.0/12,DIRECT",
+		"SRC-IP-CIDR,192.168.2.0/24,PROXY",
+		"DST-PORT,6000-7000,REJECT",
+		"PROCESS-NAME,game.exe,DIRECT",
+		"GEOIP,CN,DIRECT",
+		"MATCH,PROXY",
+	}, geo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 连续的同类型同动作规则合并
+	if e.Len() != 9 || !e.NeedHost() || !e.NeedProcess() {
+		t.Fatalf("unexpected engine: len=%d", e.Len())
+	}
+
+	tests := []struct {
+		md   Metadata
+		rule string
+	}{
+		{Metadata{Host: "x.ads.com"}, "DOMAIN-SUFFIX,ads.com,REJECT"},
+		{Metadata{Host: "full.ads.org"}, "DOMAIN,full.ads.org,reject"},
+		{Metadata{Host: "www.example.com", DstIP: netip.MustParseAddr("1.1.1.1")}, "GEOSITE,test,PROXY"},
+		{Metadata{DstIP: netip.MustParseAddr("172.20.0.1")}, "IP-CIDR,10.0.0.0/8,DIRECT"},
+		{Metadata{SrcIP: netip.MustParseAddr("192.168.2.9"), DstIP: netip.MustParseAddr("1.1.1.1")}, "SRC-IP-CIDR,192.168.2.0/24,PROXY"},
+		{Metadata{DstIP: netip.MustParseAddr("200.1.1.1"), DstPort: 6500}, "DST-PORT,6000-7000,REJECT"},
+		{Metadata{Process: "Game.exe"}, "PROCESS-NAME,game.exe,DIRECT"},
+		{Metadata{DstIP: netip.MustParseAddr("1.1.1.1"), DstPort: 443}, "GEOIP,CN,DIRECT"},
+		{Metadata{DstIP: netip.MustParseAddr("200.1.1.1"), DstPort: 443}, "MATCH,PROXY"},
+	}
+	for _, tt := range tests {
+		r := e.Match(&tt.md)
+		if r == nil || r.String() != tt.rule {
+			t.Errorf("Match(%+v) = %v, want %s", tt.md, r, tt.rule)
+		}
+	}
+
+	for _, bad := range []string{"DOMAIN,example.com", "IP-CIDR,1.1.1.300,DIRECT", "FOO,bar,PROXY", "MATCH,DROP", "GEOSITE,missing,PROXY"} {
+		if _, err := New([]string{bad}, geo); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestGeoUpdate(t *testing.T) {
+	body := buildMMDB("US")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/bad" {
+			w.Write([]byte("not a database"))
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Country.mmdb")
+	if err := os.WriteFile(path, buildMMDB("CN"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	geo := NewGeo()
+	geo.Configure(GeoConfig{GeoIP: path, GeoIPURL: srv.URL + "/bad"})
+
+	addr := netip.MustParseAddr("1.2.3.4")
+	if c := geo.Country(addr); c != "CN" {
+		t.Fatalf("unexpected country: %q", c)
+	}
+
+	// 校验失败时保留原文件
+	if err := geo.Update(context.Background(), KindGeoIP, ""); err == nil {
+		t.Fatal("expected validation error")
+	}
+	if c := geo.Country(addr); c != "CN" {
+		t.Fatalf("database replaced after failed update: %q", c)
+	}
+
+	if err := geo.Update(context.Background(), KindGeoIP, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if c := geo.Country(addr); c != "US" {
+		t.Fatalf("database not reloaded: %q", c)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("temporary files left: %d", len(entries))
+	}
+}
+
+func TestHandlerRejectsURL(t *testing.T) {
+	var downloads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		downloads.Add(1)
+		w.Write(buildMMDB("US"))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "Country.mmdb")
+	if err := os.WriteFile(path, buildMMDB("CN"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	geo := NewGeo()
+	geo.Configure(GeoConfig{GeoIP: path, GeoIPURL: srv.URL + "/Country.mmdb"})
+	h := Handler(geo)
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"Kind":"geoip","URL":"http://attacker.example/Country.mmdb"}`, http.StatusForbidden},
+		{`{"URL":"http://attacker.example/Country.mmdb"}`, http.StatusForbidden},
+		{`{"Kind":"geoip","URL":"` + srv.URL + `/Country.mmdb"}`, http.StatusOK},
+		{`{"Kind":"geoip"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/geo", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%s: code = %d, want %d", tt.body, w.Code, tt.code)
+		}
+	}
+	if n := downloads.Load(); n != 2 {
+		t.Fatalf("downloads = %d", n)
+	}
+}
+
+func TestRuleMergeNames(t *testing.T) {
+	lines := []string{
+		"DOMAIN-SUFFIX,a.com,PROXY",
+		"DOMAIN-SUFFIX,b.com,PROXY",
+		"DOMAIN-SUFFIX,c.com,PROXY",
+		"IP-CIDR,10.0.0.0/8,DIRECT",
+		"IP-CIDR,172.16.0.0/12,DIRECT",
+	}
+	tests := []struct {
+		keep  []string
+		len   int
+		host  string
+		ip    string
+		names []string
+	}{
+		// 合并的规则保留所有原文
+		{nil, 2, "x.b.com", "", []string{"DOMAIN-SUFFIX,a.com,PROXY", "DOMAIN-SUFFIX,b.com,PROXY", "DOMAIN-SUFFIX,c.com,PROXY"}},
+		{nil, 2, "", "172.16.0.1", []string{"IP-CIDR,10.0.0.0/8,DIRECT", "IP-CIDR,172.16.0.0/12,DIRECT"}},
+		// 需要单独限速的规则不合并
+		{[]string{" DOMAIN-SUFFIX,b.com,PROXY"}, 4, "x.b.com", "", []string{"DOMAIN-SUFFIX,b.com,PROXY"}},
+		{[]string{"DOMAIN-SUFFIX,b.com,PROXY"}, 4, "x.c.com", "", []string{"DOMAIN-SUFFIX,c.com,PROXY"}},
+		{[]string{"IP-CIDR,10.0.0.0/8,DIRECT"}, 3, "", "172.16.0.1", []string{"IP-CIDR,172.16.0.0/12,DIRECT"}},
+	}
+	for _, tt := range tests {
+		e, err := New(lines, NewGeo(), tt.keep...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Len() != tt.len {
+			t.Errorf("keep=%q: len = %d, want %d", tt.keep, e.Len(), tt.len)
+		}
+		md := Metadata{Host: tt.host}
+		if tt.ip != "" {
+			md.DstIP = netip.MustParseAddr(tt.ip)
+		}
+		r := e.Match(&md)
+		if r == nil || !slices.Equal(r.Names(), tt.names) {
+			t.Errorf("keep=%q: Match(%+v) = %v, want %q", tt.keep, md, r, tt.names)
+		}
+	}
+}
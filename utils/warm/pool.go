@@ -0,0 +1,277 @@
+package warm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxIdle 默认的空闲连接最长保留时长(秒)
+	DefaultMaxIdle = 30
+
+	// activeWindow 超过该时长没有取用时不再补充连接，空闲的机器不会持续重建连接
+	activeWindow = 5 * time.Minute
+
+	// maxBackoff 建立连接失败后的最长重试间隔
+	maxBackoff = 30 * time.Second
+)
+
+// Config 预连接池配置
+type Config struct {
+	// 保持的空闲连接数，为0时不开启
+	Size int
+
+	// 空闲连接最长保留时长(秒)，超过后关闭并重新建立，应小于服务端的空闲超时，为0时使用默认值30
+	MaxIdle int
+}
+
+// Stats 预连接池统计
+type Stats struct {
+	Idle   int    // 当前空闲连接数
+	Hits   uint64 // 取到预先建立的连接的次数
+	Misses uint64 // 没有可用连接的次数
+}
+
+// entry 空闲连接，等待期间由协程阻塞读取以发现被对端关闭的连接
+type entry struct {
+	conn    net.Conn
+	created time.Time
+	done    chan struct{} // 读取协程结束时关闭
+	dead    bool          // 连接已被对端关闭或收到了不应出现的数据
+}
+
+// Pool 预先建立的传输层连接池，后台补充到 Size 个空闲连接，取用后立即补充
+// 连接只完成传输层握手(TCP连接或TLS握手)，取用后由调用方发送目标地址
+type Pool struct {
+	cfg  Config
+	dial func(ctx context.Context) (net.Conn, error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	refill chan struct{}
+
+	mu      sync.Mutex
+	idle    []*entry // 按建立时间排序，最新的在最后
+	lastUse time.Time
+	hits    uint64
+	misses  uint64
+}
+
+// New 创建预连接池并开始建立连接，ctx取消时关闭所有空闲连接，Size为0时返回nil
+func New(ctx context.Context, cfg Config, dial func(ctx context.Context) (net.Conn, error)) *Pool {
+	if cfg.Size <= 0 {
+		return nil
+	}
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = DefaultMaxIdle
+	}
+
+	p := &Pool{
+		cfg:     cfg,
+		dial:    dial,
+		refill:  make(chan struct{}, 1),
+		lastUse: time.Now(),
+	}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	go p.run()
+	return p
+}
+
+// Get 取出最新的可用空闲连接，没有时返回nil，为nil时始终返回nil
+func (p *Pool) Get() net.Conn {
+	if p == nil {
+		return nil
+	}
+	defer p.signal()
+
+	p.mu.Lock()
+	p.lastUse = time.Now()
+	for len(p.idle) > 0 {
+		e := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if conn := p.take(e); conn != nil {
+			p.mu.Lock()
+			p.hits++
+			p.mu.Unlock()
+			return conn
+		}
+		p.mu.Lock()
+	}
+	p.misses++
+	p.mu.Unlock()
+	return nil
+}
+
+// Stats 返回统计
+func (p *Pool) Stats() Stats {
+	if p == nil {
+		return Stats{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Stats{Idle: len(p.idle), Hits: p.hits, Misses: p.misses}
+}
+
+// Close 停止补充并关闭所有空闲连接
+func (p *Pool) Close() {
+	if p != nil {
+		p.cancel()
+	}
+}
+
+// take 停止读取协程并取回连接，连接已失效或超过最长保留时长时关闭并返回nil
+func (p *Pool) take(e *entry) net.Conn {
+	e.conn.SetReadDeadline(time.Unix(1, 0))
+	<-e.done
+	if e.dead || time.Since(e.created) > p.maxIdle() {
+		e.conn.Close()
+		return nil
+	}
+	e.conn.SetReadDeadline(time.Time{})
+	return e.conn
+}
+
+// run 补充空闲连接并关闭超过最长保留时长的连接，直到ctx取消
+func (p *Pool) run() {
+	defer p.closeIdle()
+
+	ticker := time.NewTicker(p.maxIdle() / 2)
+	defer ticker.Stop()
+
+	var backoff time.Duration
+	var retryAt time.Time // 退避期间不补充，取用的通知同样等到该时间之后
+	for {
+		p.evict()
+
+		// 建立连接失败时按退避时长等待，避免代理服务器不可用时持续重试
+		for time.Now().After(retryAt) && p.need() {
+			conn, err := p.dial(p.ctx)
+			if err != nil {
+				backoff = min(max(backoff*2, time.Second), maxBackoff)
+				retryAt = time.Now().Add(backoff)
+				break
+			}
+			backoff = 0
+			p.put(conn)
+		}
+
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if d := time.Until(retryAt); d > 0 {
+			timer = time.NewTimer(d)
+			retry = timer.C
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.refill:
+		case <-ticker.C:
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// need 是否需要补充连接: 空闲连接不足且最近有取用
+func (p *Pool) need() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ctx.Err() == nil && len(p.idle) < p.cfg.Size && time.Since(p.lastUse) < activeWindow
+}
+
+// put 放入新建立的连接，并开始阻塞读取
+// 空闲期间对端不应发送数据，读到数据或出错都说明连接不可用
+func (p *Pool) put(conn net.Conn) {
+	e := &entry{conn: conn, created: time.Now(), done: make(chan struct{})}
+
+	p.mu.Lock()
+	p.idle = append(p.idle, e)
+	p.mu.Unlock()
+
+	go func() {
+		defer close(e.done)
+
+		var b [1]byte
+		n, err := conn.Read(b[:])
+		if n == 0 && isTimeout(err) {
+			return // 被取用
+		}
+		e.dead = true
+		conn.Close()
+		p.remove(e)
+	}()
+}
+
+// remove 移除失效的连接并补充
+func (p *Pool) remove(e *entry) {
+	p.mu.Lock()
+	for i, v := range p.idle {
+		if v == e {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			break
+		}
+	}
+	p.mu.Unlock()
+	p.signal()
+}
+
+// evict 关闭超过最长保留时长的连接
+func (p *Pool) evict() {
+	p.mu.Lock()
+	var stale []*entry
+	live := p.idle[:0]
+	for _, e := range p.idle {
+		if time.Since(e.created) > p.maxIdle() {
+			stale = append(stale, e)
+		} else {
+			live = append(live, e)
+		}
+	}
+	clear(p.idle[len(live):])
+	p.idle = live
+	p.mu.Unlock()
+
+	for _, e := range stale {
+		e.conn.Close()
+	}
+}
+
+// closeIdle 关闭所有空闲连接
+func (p *Pool) closeIdle() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, e := range idle {
+		e.conn.Close()
+	}
+}
+
+// signal 通知后台补充连接
+func (p *Pool) signal() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// maxIdle 空闲连接最长保留时长
+func (p *Pool) maxIdle() time.Duration {
+	return time.Duration(p.cfg.MaxIdle) * time.Second
+}
+
+// isTimeout 判断错误是否为读超时
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
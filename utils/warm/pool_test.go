@@ -0,0 +1,176 @@
+package warm
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// server 把收到的数据原样发回的服务器，记录接受的连接
+type server struct {
+	addr string
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newServer(t *testing.T) *server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &server{addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return s
+}
+
+// accepted 返回已接受的连接数
+func (s *server) accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// closeAll 关闭已接受的所有连接
+func (s *server) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func newPool(t *testing.T, s *server, cfg Config) *Pool {
+	p := New(context.Background(), cfg, func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", s.addr)
+	})
+	t.Cleanup(p.Close)
+	return p
+}
+
+// waitFor 等待条件成立
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// roundTrip 确认连接可用
+func roundTrip(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q, err=%v", buf, err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	s := newServer(t)
+	p := newPool(t, s, Config{Size: 2})
+	waitFor(t, "idle conns", func() bool { return p.Stats().Idle == 2 })
+
+	// 取用的连接可以直接使用，之后补充
+	conn := p.Get()
+	if conn == nil {
+		t.Fatal("expected pooled conn")
+	}
+	defer conn.Close()
+	roundTrip(t, conn)
+
+	waitFor(t, "refill", func() bool { return p.Stats().Idle == 2 })
+	if st := p.Stats(); st.Hits != 1 || st.Misses != 0 || s.accepted() != 3 {
+		t.Fatalf("unexpected stats: %+v accepted=%d", st, s.accepted())
+	}
+
+	// 未开启时返回nil
+	var off *Pool
+	if New(context.Background(), Config{}, nil) != nil || off.Get() != nil {
+		t.Fatal("expected disabled pool")
+	}
+}
+
+func TestDeadConn(t *testing.T) {
+	s := newServer(t)
+	p := newPool(t, s, Config{Size: 2})
+	waitFor(t, "idle conns", func() bool { return p.Stats().Idle == 2 })
+
+	// 被对端关闭的连接从池中移除并重新建立
+	s.closeAll()
+	waitFor(t, "reconnect", func() bool { return s.accepted() >= 4 && p.Stats().Idle == 2 })
+
+	conn := p.Get()
+	if conn == nil {
+		t.Fatal("expected pooled conn")
+	}
+	defer conn.Close()
+	roundTrip(t, conn)
+}
+
+func TestMaxIdle(t *testing.T) {
+	s := newServer(t)
+	p := newPool(t, s, Config{Size: 1, MaxIdle: 1})
+	waitFor(t, "idle conns", func() bool { return p.Stats().Idle == 1 })
+
+	// 超过最长保留时长的连接被关闭后重新建立
+	waitFor(t, "evict", func() bool { return s.accepted() >= 2 && p.Stats().Idle == 1 })
+}
+
+func TestDialFailure(t *testing.T) {
+	dials := make(chan struct{}, 16)
+	p := New(context.Background(), Config{Size: 2}, func(ctx context.Context) (net.Conn, error) {
+		dials <- struct{}{}
+		return nil, net.ErrClosed
+	})
+	defer p.Close()
+
+	// 建立失败后退避，不会持续重试
+	<-dials
+	time.Sleep(200 * time.Millisecond)
+	if n := len(dials); n != 0 {
+		t.Fatalf("dials during backoff = %d", n)
+	}
+	if p.Get() != nil || p.Stats().Misses != 1 {
+		t.Fatalf("unexpected stats: %+v", p.Stats())
+	}
+
+	// 退避期间取用也不会立即重试
+	time.Sleep(200 * time.Millisecond)
+	if n := len(dials); n != 0 {
+		t.Fatalf("dials after get = %d", n)
+	}
+
+	// 退避结束后重试
+	select {
+	case <-dials:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected retry after backoff")
+	}
+}